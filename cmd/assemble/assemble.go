@@ -9,23 +9,33 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"docker-reassembler/pkg/audit"
+	"docker-reassembler/pkg/auth"
 	builder "docker-reassembler/pkg/build"
+	"docker-reassembler/pkg/checkpoint"
 	"docker-reassembler/pkg/download"
+	"docker-reassembler/pkg/endpoint"
+	"docker-reassembler/pkg/report"
+	"docker-reassembler/pkg/rewrite"
+	"docker-reassembler/pkg/scan"
+	"docker-reassembler/pkg/source"
+	"docker-reassembler/pkg/throttle"
+	"docker-reassembler/pkg/tracing"
 	"docker-reassembler/pkg/upload"
 	"docker-reassembler/pkg/utils"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrTypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/dustin/go-humanize"
 	"github.com/pterm/pterm"
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type fs struct{}
@@ -38,19 +48,44 @@ func (f *fs) MkdirAll(name string, perm os.FileMode) error {
 	return os.MkdirAll(name, perm)
 }
 
+func (f *fs) Open(name string) (*os.File, error) {
+	return os.Open(name)
+}
+
+func (f *fs) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (f *fs) Remove(name string) error {
+	return os.Remove(name)
+}
+
 var (
-	s3Prefix          string
-	repositoryName    string
-	localPath         string
-	tag               string
-	remove            bool
-	downloadOnly      bool
-	noDownload        bool
-	putRoleToAssume   string
-	putRoleExternalId string
-	layersPath        string
-	buildLocal        bool
-	assembleCmd       = &cobra.Command{
+	s3Prefix                string
+	repositoryName          string
+	localPath               string
+	tag                     string
+	remove                  bool
+	downloadOnly            bool
+	noDownload              bool
+	s3Creds                 auth.ProfileFlags
+	putCreds                auth.ProfileFlags
+	ecrEndpoint             endpoint.ECRFlags
+	credentialsExpiryWindow time.Duration
+	uploadFlags             upload.Flags
+	destinations            []string
+	scanFlags               scan.Flags
+	reportFlags             report.Flags
+	throttleFlags           throttle.Flags
+	downloadFlags           download.Flags
+	s3Endpoint              endpoint.S3Flags
+	checkpointFile          string
+	layersPath              string
+	sourceFlag              string
+	rewriteFlags            rewrite.Flags
+	buildLocal              bool
+	stream                  bool
+	assembleCmd             = &cobra.Command{
 		Use:     "assemble",
 		Aliases: []string{"a"},
 		Short:   "Assemble a Docker image from layers stored in S3 Bucket",
@@ -63,71 +98,189 @@ func NewAssembleCmd() *cobra.Command {
 	assembleCmd.Flags().StringVarP(&repositoryName, "repository-name", "r", "", "repository name")
 	assembleCmd.Flags().StringVarP(&localPath, "local-path", "l", "/tmp/docker-reassembler", "local directory path to save the image layers")
 	assembleCmd.Flags().StringVarP(&tag, "tag", "t", "", "tag to apply to the image")
-	assembleCmd.Flags().StringVarP(&putRoleToAssume, "put-role-to-assume", "P", "", "The IAM role to assume for ECR image put")
-	assembleCmd.Flags().StringVarP(&putRoleExternalId, "put-role-external-id", "", "", "External Id for the assumed role")
+	s3Creds.AddFlags(assembleCmd.Flags(), "s3", "", "S3 reads")
+	putCreds.AddFlags(assembleCmd.Flags(), "put", "P", "ECR image put")
+	ecrEndpoint.AddFlags(assembleCmd.Flags())
+	assembleCmd.Flags().DurationVarP(&credentialsExpiryWindow, "credentials-expiry-window", "", auth.DEFAULT_EXPIRY_WINDOW, "refresh credentials this long before they expire")
+	uploadFlags.AddFlags(assembleCmd.Flags())
+	rewriteFlags.AddFlags(assembleCmd.Flags())
+	scanFlags.AddFlags(assembleCmd.Flags())
+	reportFlags.AddFlags(assembleCmd.Flags())
+	throttleFlags.AddDownloadFlags(assembleCmd.Flags())
+	downloadFlags.AddFlags(assembleCmd.Flags())
+	s3Endpoint.AddFlags(assembleCmd.Flags())
+	throttleFlags.AddFlags(assembleCmd.Flags())
+	assembleCmd.Flags().StringArrayVarP(&destinations, "destination", "", nil,
+		"put the image to region=<region>,account=<account id>,role=<role arn>,external-id=<id>, repeat for each registry, the role is assumed after any --put-role-to-assume")
 	assembleCmd.Flags().BoolVarP(&remove, "rm", "", false, "remove downloaded assets after put")
 	assembleCmd.Flags().BoolVarP(&downloadOnly, "download-only", "", false, "download image layers from S3 only")
 	assembleCmd.Flags().BoolVarP(&noDownload, "no-download", "", false, "do not download any layers from s3 before uploading - expects layers to be locally available")
+	assembleCmd.Flags().StringVarP(&checkpointFile, "checkpoint-file", "", "", "file recording completed downloads so an interrupted run can resume, defaults to checkpoint.json in --local-path")
 	assembleCmd.Flags().StringVarP(&layersPath, "layers-path", "", "", "local path to image layer files")
+	assembleCmd.Flags().StringVarP(&sourceFlag, "source", "", "",
+		"image to assemble: s3://bucket/prefix, dir:/path, docker-archive:/file.tar, oci:/layout[:tag] or tar:/export.tgz, replaces --s3-prefix, --no-download and --layers-path")
 	assembleCmd.Flags().BoolVarP(&buildLocal, "build-local", "", false, "build the image locally")
+	assembleCmd.Flags().BoolVarP(&stream, "stream", "", false, "stream image layers from S3 straight to ECR without staging them on local disk")
 	assembleCmd.MarkFlagsMutuallyExclusive("s3-prefix", "no-download")
+	assembleCmd.MarkFlagsMutuallyExclusive("source", "s3-prefix")
+	assembleCmd.MarkFlagsMutuallyExclusive("source", "no-download")
+	assembleCmd.MarkFlagsMutuallyExclusive("source", "layers-path")
 	assembleCmd.MarkFlagsMutuallyExclusive("repository-name", "download-only")
 	assembleCmd.MarkFlagsMutuallyExclusive("download-only", "no-download")
 	assembleCmd.MarkFlagsMutuallyExclusive("download-only", "repository-name")
 	assembleCmd.MarkFlagsMutuallyExclusive("download-only", "tag")
 	assembleCmd.MarkFlagsMutuallyExclusive("download-only", "rm")
+	assembleCmd.MarkFlagsMutuallyExclusive("stream", "download-only")
+	assembleCmd.MarkFlagsMutuallyExclusive("stream", "no-download")
+	assembleCmd.MarkFlagsMutuallyExclusive("stream", "build-local")
+	assembleCmd.MarkFlagsMutuallyExclusive("stream", "rm")
 	return assembleCmd
 }
 
-func runAssembleCmd(cmd *cobra.Command, args []string) error {
-	bucket := cmd.Parent().PersistentFlags().Lookup("s3-bucket").Value.String()
+func runAssembleCmd(cmd *cobra.Command, args []string) (err error) {
+	imageReport := report.New("assemble")
+	var reportSource, imgTag string
+	defer func() { err = writeReport(imageReport, reportSource, imgTag, err) }()
+
+	uri, err := sourceURI(cmd)
+	if err != nil {
+		return err
+	}
+	reportSource = uri.String()
+	bucket, prefix := uri.Bucket, uri.Prefix
 
-	imgTag := tag
+	ctx, span := tracing.Start(cmd.Context(), "assemble", attribute.String("source", uri.String()))
+	defer func() { tracing.End(span, err) }()
+
+	imgTag = tag
 	if imgTag == "" {
-		imgTag = filepath.Base(s3Prefix)
+		switch uri.Scheme {
+		case source.SCHEME_S3:
+			imgTag = filepath.Base(prefix)
+		case source.SCHEME_DIR:
+			if base := filepath.Base(uri.Path); base != "." && base != string(filepath.Separator) {
+				imgTag = base
+			}
+		case source.SCHEME_OCI:
+			imgTag = uri.Tag
+		}
+		if imgTag == "" && !downloadOnly {
+			return fmt.Errorf("--tag is required to assemble from %s", uri)
+		}
+	}
+	if uri.Scheme != source.SCHEME_S3 && (stream || downloadOnly) {
+		return fmt.Errorf("--stream and --download-only need an s3:// source")
+	}
+	if err := rewriteFlags.Validate(); err != nil {
+		return err
+	}
+	if err := scanFlags.Validate(); err != nil {
+		return err
 	}
 
 	region := cmd.Parent().PersistentFlags().Lookup("region")
 
 	pterm.Debug.Printfln("********************************************************")
 	pterm.Debug.Printfln("Region: %s", region.Value.String())
-	pterm.Debug.Printfln("S3 Bucket: %s", bucket)
-	pterm.Debug.Printfln("S3 Prefix: %s", s3Prefix)
+	pterm.Debug.Printfln("Source: %s", uri)
 	pterm.Debug.Printfln("Repository Name: %s", repositoryName)
 	pterm.Debug.Printfln("Local Path: %s", localPath)
 	pterm.Debug.Printfln("Tag: %s", imgTag)
 	pterm.Debug.Printfln("********************************************************")
 
 	logger := &utils.PtermLogger{}
+
+	auditLog, err := audit.Open(cmd.Parent().PersistentFlags().Lookup("audit-log").Value.String())
+	if err != nil {
+		return err
+	}
+	defer auditLog.Close()
+
+	if err := throttleFlags.Watch(ctx); err != nil {
+		return err
+	}
+	downloadLimiter, uploadLimiter, err := throttleFlags.Limiters()
+	if err != nil {
+		return err
+	}
+
 	var downloadRes []string
-	if !noDownload {
+	var imageSource source.ISource
+	var pathToLayers string
+	if uri.Scheme != source.SCHEME_S3 {
+		src, cleanup, err := source.Open(ctx, uri, localPath, logger)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		imageSource = src
+		if dir, ok := src.(*source.Dir); ok {
+			pathToLayers = dir.Path
+		}
+	} else if stream {
+		// Streamed reads are retried by the source under the upload policy
+		client, err := newS3Client(ctx, region.Value.String(), logger, func(o *s3.Options) {
+			o.Retryer = aws.NopRetryer{}
+		})
+		if err != nil {
+			return fmt.Errorf("assemble error: %w", err)
+		}
+
+		pterm.Info.Printfln("streaming image layers from %s", uri)
+		s3Source := source.NewS3(client, bucket, prefix)
+		s3Source.Limiter = downloadLimiter
+		s3Source.Retry, s3Source.Logger = uploadFlags.Policy(), logger
+		imageSource = s3Source
+	} else {
 		dloader := download.NewDownloader()
+		filter, err := downloadFlags.Filter()
+		if err != nil {
+			return err
+		}
+
+		checkpointPath := checkpointFile
+		if checkpointPath == "" {
+			checkpointPath = filepath.Join(localPath, checkpoint.FILE_NAME)
+		}
+		progress, err := checkpoint.Load(checkpointPath)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := progress.Flush(); err != nil {
+				pterm.Warning.Printfln("%v", err)
+			}
+		}()
 
-		cfg, err := config.LoadDefaultConfig(context.TODO(),
-			config.WithDefaultRegion(region.Value.String()),
-			config.WithLogConfigurationWarnings(true),
-			config.WithLogger(&utils.PtermLogger{}))
+		client, err := newS3Client(ctx, region.Value.String(), logger)
 		if err != nil {
 			return fmt.Errorf("assemble error: %w", err)
 		}
 
-		client := s3.NewFromConfig(cfg)
 		manager := manager.NewDownloader(client)
 		manager.Logger = logger
 
 		pager := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
 			Bucket: aws.String(bucket),
-			Prefix: aws.String(s3Prefix),
+			Prefix: aws.String(prefix),
 		})
 
-		downloadRes, err = dloader.Download(context.TODO(), download.S3DownloaderInput{
+		dlCtx, dlSpan := tracing.Start(ctx, "stage.download")
+		downloadRes, err = dloader.Download(dlCtx, download.S3DownloaderInput{
 			Pager:          pager,
 			Downloader:     manager,
 			Filesystem:     &fs{},
 			Bucket:         bucket,
 			LocalDirectory: localPath,
 			Logger:         logger,
+			Limiter:        downloadLimiter,
+			Checkpoint:     progress,
+			Filter:         filter,
+			FromManifest:   downloadFlags.FromManifest,
 		})
+		dlSpan.SetAttributes(attribute.Int("objects", len(downloadRes)))
+		tracing.End(dlSpan, err)
 		if err != nil {
 			return fmt.Errorf("error download docker layers from s3: %w", err)
 		}
@@ -136,19 +289,20 @@ func runAssembleCmd(cmd *cobra.Command, args []string) error {
 			pterm.Error.WithFatal(false).Printfln("no layers downloaded")
 			return nil
 		}
+		pathToLayers = filepath.Dir(downloadRes[0])
 	}
 
 	if downloadOnly {
 		return nil
 	}
 
-	pathToLayers := layersPath
-	if downloadRes != nil {
-		pathToLayers = filepath.Dir(downloadRes[0])
-	}
-
 	if buildLocal {
-		img, err := builder.Build(pathToLayers, repositoryName, imgTag, "/tmp/", true, logger)
+		if pathToLayers == "" {
+			return fmt.Errorf("--build-local is not supported for %s", uri)
+		}
+		_, buildSpan := tracing.Start(ctx, "stage.build")
+		img, err := builder.Build(ctx, pathToLayers, repositoryName, imgTag, "/tmp/", true, logger)
+		tracing.End(buildSpan, err)
 		if err != nil {
 			return fmt.Errorf("error building container image locally: %w", err)
 		}
@@ -160,50 +314,120 @@ func runAssembleCmd(cmd *cobra.Command, args []string) error {
 		pterm.Success.Printfln("Container image was built locally (%s)", humanize.Bytes(uint64(size)))
 	}
 
-	ecrCfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithDefaultRegion(region.Value.String()),
-		config.WithLogConfigurationWarnings(true),
-		config.WithLogger(&utils.PtermLogger{}))
+	if imageSource == nil {
+		dir := source.NewDir(pathToLayers)
+		defer dir.Close()
+		imageSource = dir
+	}
+	rewriteCtx, rewriteSpan := tracing.Start(ctx, "stage.rewrite")
+	imageSource, cleanupRewrite, err := rewriteFlags.Apply(rewriteCtx, imageSource, localPath, logger)
+	tracing.End(rewriteSpan, err)
 	if err != nil {
-		return fmt.Errorf("assemble error: %w", err)
+		return fmt.Errorf("error rewriting image: %w", err)
+	}
+	defer cleanupRewrite()
+
+	dests := []upload.Destination{{}}
+	if len(destinations) > 0 {
+		dests = dests[:0]
+		for _, value := range destinations {
+			dest, err := upload.ParseDestination(value)
+			if err != nil {
+				return fmt.Errorf("invalid --destination %q: %w", value, err)
+			}
+			dests = append(dests, dest)
+		}
 	}
 
-	// We now need to assume the role where we are putting image
-	// https://pkg.go.dev/github.com/aws/aws-sdk-go-v2/credentials/stscreds#hdr-Assume_Role
-	stsClient := sts.NewFromConfig(ecrCfg)
-	assumeCreds := stscreds.NewAssumeRoleProvider(stsClient,
-		putRoleToAssume, func(aro *stscreds.AssumeRoleOptions) {
-			if putRoleExternalId != "" {
-				aro.ExternalID = &putRoleExternalId
+	results := make([]upload.Result, len(dests))
+	inputs := []*upload.UploadInput{}
+	indexes := []int{}
+	for i, dest := range dests {
+		input, err := newUploadInput(ctx, dest, region.Value.String(), auditLog, logger)
+		if err != nil {
+			results[i] = upload.Result{
+				Input: &upload.UploadInput{RepositoryName: repositoryName, RegistryId: dest.Account, Tag: imgTag},
+				Err:   err,
 			}
-			aro.Duration = time.Minute * 60
-		})
+			continue
+		}
+		input.ImageLayersPath = pathToLayers
+		input.Source = imageSource
+		input.Tag = imgTag
+		input.Limiter = uploadLimiter
+		if err := uploadFlags.Apply(input); err != nil {
+			return err
+		}
+
+		inputs = append(inputs, input)
+		indexes = append(indexes, i)
+	}
+
+	// Every destination reads the same source, local layers are only
+	// downloaded once however many registries they are put to
+	uploadCtx, uploadSpan := tracing.Start(ctx, "stage.upload", attribute.Int("destinations", len(inputs)))
+	var uploadErr error
+	uploadFailed := 0
+	for i, result := range upload.UploadAll(uploadCtx, inputs) {
+		results[indexes[i]] = result
+		if result.Err != nil {
+			uploadFailed++
+		}
+	}
+	if uploadFailed > 0 {
+		uploadErr = fmt.Errorf("%d of %d destination(s) failed", uploadFailed, len(inputs))
+	}
+	tracing.End(uploadSpan, uploadErr)
+
+	failed := 0
+	for i, result := range results {
+		destRegion := dests[i].Region
+		if destRegion == "" {
+			destRegion = region.Value.String()
+		}
+		imageReport.AddUpload(reportSource, destRegion, result.Input, result.Image, result.Duration, result.Err)
 
-	ecrCfg.Credentials = aws.NewCredentialsCache(assumeCreds)
+		if result.Err != nil {
+			failed++
+			pterm.Error.Printfln("error uploading docker image to ECR %s: %v", dests[i], result.Err)
+			continue
+		}
 
-	ecrClient := ecr.NewFromConfig(ecrCfg)
+		if len(dests) > 1 {
+			pterm.Info.Printfln("upload summary for %s", dests[i])
+		}
+		printUploadStats(result.Input.Stats)
 
-	idOut, err := stsClient.GetCallerIdentity(context.TODO(), nil, func(o *sts.Options) {
-		o.Credentials = ecrCfg.Credentials
-	})
-	if err != nil {
-		return fmt.Errorf("error getting called identity: %w", err)
+		pterm.Success.Printfln("image %v successfully put to %s in registry with id %s",
+			*result.Image.ImageId.ImageTag, *result.Image.RepositoryName, result.Input.RegistryId)
 	}
 
-	img, err := upload.Upload(context.TODO(), &upload.UploadInput{
-		RepositoryName:  repositoryName,
-		RegistryId:      *idOut.Account,
-		ImageLayersPath: pathToLayers,
-		Logger:          logger,
-		Tag:             imgTag,
-		Client:          ecrClient,
-	})
-	if err != nil {
-		return fmt.Errorf("error uploading docker image to ECR: %w", err)
+	var scanErr error
+	if scanFlags.Wait {
+		waits := []*scan.WaitInput{}
+		for _, result := range results {
+			if result.Err == nil {
+				wait, err := newScanInput(result.Input, result.Image, logger)
+				if err != nil {
+					return err
+				}
+				waits = append(waits, wait)
+			}
+		}
+		scanCtx, scanSpan := tracing.Start(ctx, "stage.scan")
+		scanErr = scanFlags.Run(scanCtx, waits)
+		tracing.End(scanSpan, scanErr)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("error uploading docker image to ECR: %d of %d destination(s) failed", failed, len(dests))
+	}
+	if scanErr != nil {
+		return scanErr
 	}
 
-	if remove {
-		err = os.RemoveAll(filepath.Join(localPath, bucket, s3Prefix))
+	if remove && uri.Scheme == source.SCHEME_S3 {
+		err = os.RemoveAll(filepath.Join(localPath, bucket, prefix))
 		if err != nil {
 			pterm.Warning.Printfln("error removing %q", localPath)
 		} else {
@@ -211,8 +435,164 @@ func runAssembleCmd(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	pterm.Success.Printfln("image %v successfully put to %s in registry with id %s",
-		*img.ImageId.ImageTag, *img.RepositoryName, *idOut.Account)
-
 	return nil
 }
+
+// writeReport writes the report however the command ends, an error before
+// any upload was recorded is reported as a failure of the image.
+func writeReport(imageReport *report.Report, reportSource, imgTag string, err error) error {
+	if err != nil && len(imageReport.Images) == 0 {
+		imageReport.AddFailure(reportSource, repositoryName, imgTag, err)
+	}
+	if writeErr := reportFlags.Write(imageReport); writeErr != nil {
+		if err != nil {
+			pterm.Error.Printfln("%v", writeErr)
+			return err
+		}
+		return writeErr
+	}
+	return err
+}
+
+// sourceURI is --source, or else the equivalent of the older --s3-prefix,
+// --no-download and --layers-path flags.
+func sourceURI(cmd *cobra.Command) (*source.URI, error) {
+	if sourceFlag != "" {
+		return source.ParseURI(sourceFlag)
+	}
+
+	if noDownload {
+		path := layersPath
+		if path == "" {
+			path = "."
+		}
+		return &source.URI{Scheme: source.SCHEME_DIR, Path: path}, nil
+	}
+
+	bucket, err := utils.RequiredPersistentFlag(cmd, "s3-bucket")
+	if err != nil {
+		return nil, err
+	}
+
+	return &source.URI{Scheme: source.SCHEME_S3, Bucket: bucket, Prefix: s3Prefix}, nil
+}
+
+// newUploadInput loads the put credentials for dest, the registry id is the
+// destination account or else the account of the credentials.
+func newUploadInput(ctx context.Context, dest upload.Destination, region string, auditLog *audit.Log,
+	logger *utils.PtermLogger,
+) (*upload.UploadInput, error) {
+	putProfile, err := putCreds.Profile(region, credentialsExpiryWindow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid put credentials: %w", err)
+	}
+	putProfile.ConfigOptions, err = ecrEndpoint.ConfigOptions()
+	if err != nil {
+		return nil, err
+	}
+	if dest.Region != "" {
+		putProfile.Region = dest.Region
+	}
+	if dest.RoleArn != "" {
+		putProfile.Roles = append(putProfile.Roles, auth.Role{Arn: dest.RoleArn, ExternalId: dest.ExternalId})
+	}
+
+	ecrCfg, err := auth.LoadConfig(ctx, putProfile, logger)
+	if err != nil {
+		return nil, fmt.Errorf("assemble error: %w", err)
+	}
+
+	idOut, err := auth.CallerIdentity(ctx, ecrCfg)
+	if err != nil {
+		return nil, fmt.Errorf("error getting called identity: %w", err)
+	}
+	registryId := dest.Account
+	if registryId == "" {
+		registryId = *idOut.Account
+	}
+
+	// Long uploads outlive the assumed role session, so hand the cache to the
+	// uploader to allow it to force a refresh on an expired token
+	var ecrCreds upload.ICredentialsCache
+	if cache, ok := ecrCfg.Credentials.(*aws.CredentialsCache); ok {
+		ecrCreds = cache
+	}
+
+	return &upload.UploadInput{
+		RepositoryName: repositoryName,
+		RegistryId:     registryId,
+		Logger:         logger,
+		Client:         audit.NewECRClient(ecr.NewFromConfig(ecrCfg, upload.SingleAttempt), auditLog, audit.NewIdentity(idOut)),
+		Credentials:    ecrCreds,
+		Stats:          &upload.Stats{},
+	}, nil
+}
+
+func newScanInput(input *upload.UploadInput, img *ecrTypes.Image, logger *utils.PtermLogger) (*scan.WaitInput, error) {
+	client, ok := input.Client.(scan.IScanClient)
+	if !ok {
+		return nil, fmt.Errorf("the ECR client for registry %s can not describe image scan findings", input.RegistryId)
+	}
+
+	return &scan.WaitInput{
+		Client:         client,
+		RegistryId:     input.RegistryId,
+		RepositoryName: input.RepositoryName,
+		ImageTag:       *img.ImageId.ImageTag,
+		ImageDigest:    *img.ImageId.ImageDigest,
+		Retry:          input.Retry,
+		Logger:         logger,
+	}, nil
+}
+
+func printUploadStats(stats *upload.Stats) {
+	data := pterm.TableData{{"Digest", "Size", "Parts", "Part sizes", "Retries", "Duration"}}
+	for _, layer := range stats.Layers {
+		if layer.Skipped {
+			data = append(data, []string{layer.Digest, "-", "skipped", "", "", ""})
+			continue
+		}
+
+		// Run length encode the sizes so a large layer stays on one line
+		sizes := []string{}
+		for i := 0; i < len(layer.PartSizes); {
+			j := i
+			for j < len(layer.PartSizes) && layer.PartSizes[j] == layer.PartSizes[i] {
+				j++
+			}
+			sizes = append(sizes, fmt.Sprintf("%s x%d", humanize.IBytes(uint64(layer.PartSizes[i])), j-i))
+			i = j
+		}
+		data = append(data, []string{
+			layer.Digest,
+			humanize.IBytes(uint64(layer.Bytes)),
+			fmt.Sprint(len(layer.PartSizes)),
+			strings.Join(sizes, ","),
+			fmt.Sprint(layer.Retries),
+			layer.Duration.Round(time.Millisecond).String(),
+		})
+	}
+
+	if err := pterm.DefaultTable.WithHasHeader().WithData(data).Render(); err != nil {
+		pterm.Warning.Printfln("error rendering upload summary: %v", err)
+	}
+}
+
+func newS3Client(ctx context.Context, region string, logger *utils.PtermLogger, optFns ...func(*s3.Options)) (*s3.Client, error) {
+	profile, err := s3Creds.Profile(region, credentialsExpiryWindow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 credentials: %w", err)
+	}
+
+	cfg, err := auth.LoadConfig(ctx, profile, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	endpointOptions, err := s3Endpoint.Options()
+	if err != nil {
+		return nil, err
+	}
+
+	return s3.NewFromConfig(cfg, append([]func(*s3.Options){endpointOptions}, optFns...)...), nil
+}
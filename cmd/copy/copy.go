@@ -0,0 +1,211 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package copy
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package copy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"docker-reassembler/pkg/auth"
+	"docker-reassembler/pkg/batch"
+	"docker-reassembler/pkg/source"
+	"docker-reassembler/pkg/upload"
+	"docker-reassembler/pkg/utils"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+const ECR_SOURCE_PREFIX = "ecr:"
+
+var (
+	from              string
+	sourceRegistryId  string
+	sourceUsername    string
+	sourcePassword    string
+	sourceInsecure    bool
+	repositoryName    string
+	tags              []string
+	tagFilters        []string
+	excludeTagFilters []string
+	sourceCreds       auth.ProfileFlags
+	batchFlags        batch.Flags
+	copyCmd           = &cobra.Command{
+		Use:     "copy",
+		Aliases: []string{"c"},
+		Short:   "Copy Docker images from a registry to ECR",
+		RunE:    runCopyCmd,
+	}
+)
+
+func NewCopyCmd() *cobra.Command {
+	copyCmd.Flags().StringVarP(&from, "from", "f", "", "source repository, ecr:<repository> or <registry>/<repository>")
+	copyCmd.Flags().StringVarP(&sourceRegistryId, "source-registry-id", "", "", "registry id of an ecr: source, defaults to the account of the source credentials")
+	copyCmd.Flags().StringVarP(&sourceUsername, "source-username", "", "", "username for the source registry, the docker config is used when not set")
+	copyCmd.Flags().StringVarP(&sourcePassword, "source-password", "", "", "password for the source registry")
+	copyCmd.Flags().BoolVarP(&sourceInsecure, "source-insecure", "", false, "allow plain http to the source registry")
+	copyCmd.Flags().StringVarP(&repositoryName, "repository-name", "r", "", "destination repository name, defaults to the source repository name")
+	copyCmd.Flags().StringSliceVarP(&tags, "tag", "t", nil, "tag(s) to copy, all tags when not set")
+	copyCmd.Flags().StringArrayVarP(&tagFilters, "tag-filter", "", nil, "only copy tags matching this regular expression, can be repeated")
+	copyCmd.Flags().StringArrayVarP(&excludeTagFilters, "exclude-tag-filter", "", nil, "do not copy tags matching this regular expression, can be repeated")
+	sourceCreds.AddFlags(copyCmd.Flags(), "source", "", "ECR image pull")
+	batchFlags.AddFlags(copyCmd.Flags())
+	utils.MarkFlagAsRequired(copyCmd, "from", false)
+	utils.MarkFlagsRequiredTogether(copyCmd, "source-username", "source-password")
+	return copyCmd
+}
+
+type imageSourceFactory struct {
+	repository string
+	listTags   func(ctx context.Context) ([]string, error)
+	newSource  func(tag string) (source.ISource, error)
+}
+
+func runCopyCmd(cmd *cobra.Command, args []string) (err error) {
+	region := cmd.Parent().PersistentFlags().Lookup("region").Value.String()
+	logger := &utils.PtermLogger{}
+
+	if err := batchFlags.Validate(); err != nil {
+		return err
+	}
+
+	factory, err := newImageSourceFactory(cmd.Context(), region, logger)
+	if err != nil {
+		return err
+	}
+
+	destRepository := repositoryName
+	if destRepository == "" {
+		destRepository = factory.repository
+	}
+
+	pterm.Debug.Printfln("********************************************************")
+	pterm.Debug.Printfln("Region: %s", region)
+	pterm.Debug.Printfln("From: %s", from)
+	pterm.Debug.Printfln("Repository Name: %s", destRepository)
+	pterm.Debug.Printfln("********************************************************")
+
+	toCopy := tags
+	if len(toCopy) == 0 {
+		toCopy, err = factory.listTags(cmd.Context())
+		if err != nil {
+			return fmt.Errorf("error listing source tags: %w", err)
+		}
+	}
+	toCopy, err = utils.FilterTags(toCopy, tagFilters, excludeTagFilters)
+	if err != nil {
+		return err
+	}
+	if len(toCopy) == 0 {
+		pterm.Warning.Printfln("no tags to copy from %s", from)
+		return nil
+	}
+
+	put, err := batchFlags.Open(cmd.Context(), "copy", region,
+		cmd.Parent().PersistentFlags().Lookup("audit-log").Value.String(), logger)
+	if err != nil {
+		return err
+	}
+	defer put.Close()
+	defer func() { err = put.Finish(cmd.Context(), err) }()
+
+	pterm.Info.Printfln("copying %d tag(s) from %s to %s", len(toCopy), from, destRepository)
+
+	failed := 0
+	for _, tag := range toCopy {
+		uploadInput, err := put.UploadInput(destRepository, tag)
+		if err != nil {
+			return err
+		}
+
+		started := time.Now()
+		src, err := factory.newSource(tag)
+		if err != nil {
+			pterm.Error.Printfln("error reading %s:%s: %v", from, tag, err)
+			put.Add(from+":"+tag, uploadInput, nil, time.Since(started), err)
+			failed++
+			continue
+		}
+		uploadInput.Source = src
+
+		img, err := upload.Upload(cmd.Context(), uploadInput)
+		put.Add(from+":"+tag, uploadInput, img, time.Since(started), err)
+		if err != nil {
+			pterm.Error.Printfln("error copying %s:%s: %v", from, tag, err)
+			failed++
+			if cmd.Context().Err() != nil {
+				break
+			}
+			continue
+		}
+
+		pterm.Success.Printfln("image %v successfully copied to %s in registry with id %s",
+			*img.ImageId.ImageTag, *img.RepositoryName, put.RegistryId)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d image(s) failed to copy", failed, len(toCopy))
+	}
+
+	return nil
+}
+
+func newImageSourceFactory(ctx context.Context, region string, logger *utils.PtermLogger) (*imageSourceFactory, error) {
+	if strings.HasPrefix(from, ECR_SOURCE_PREFIX) {
+		repository := strings.TrimPrefix(from, ECR_SOURCE_PREFIX)
+
+		profile, err := sourceCreds.Profile(region, batchFlags.CredentialsExpiryWindow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source credentials: %w", err)
+		}
+		cfg, err := auth.LoadConfig(ctx, profile, logger)
+		if err != nil {
+			return nil, fmt.Errorf("copy error: %w", err)
+		}
+		client := ecr.NewFromConfig(cfg)
+
+		return &imageSourceFactory{
+			repository: repository,
+			listTags: func(ctx context.Context) ([]string, error) {
+				return source.ECRTags(ctx, client, sourceRegistryId, repository)
+			},
+			newSource: func(tag string) (source.ISource, error) {
+				return source.NewECR(client, sourceRegistryId, repository, tag, logger), nil
+			},
+		}, nil
+	}
+
+	opts := []name.Option{}
+	if sourceInsecure {
+		opts = append(opts, name.Insecure)
+	}
+	repo, err := name.NewRepository(from, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --from %q: %w", from, err)
+	}
+
+	var authenticator authn.Authenticator = &authn.Basic{Username: sourceUsername, Password: sourcePassword}
+	if sourceUsername == "" {
+		authenticator, err = authn.DefaultKeychain.Resolve(repo.Registry)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving credentials for %s: %w", repo.RegistryStr(), err)
+		}
+	}
+
+	return &imageSourceFactory{
+		repository: repo.RepositoryStr(),
+		listTags: func(ctx context.Context) ([]string, error) {
+			return source.RegistryTags(ctx, from, sourceInsecure, authenticator)
+		},
+		newSource: func(tag string) (source.ISource, error) {
+			return source.NewRegistry(from+":"+tag, sourceInsecure, authenticator, logger)
+		},
+	}, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package disassemble
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package disassemble
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"docker-reassembler/pkg/audit"
+	"docker-reassembler/pkg/auth"
+	"docker-reassembler/pkg/endpoint"
+	"docker-reassembler/pkg/export"
+	"docker-reassembler/pkg/source"
+	"docker-reassembler/pkg/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+var (
+	s3Prefix                string
+	repositoryName          string
+	tag                     string
+	registryId              string
+	ecrCreds                auth.ProfileFlags
+	s3Creds                 auth.ProfileFlags
+	credentialsExpiryWindow time.Duration
+	s3Endpoint              endpoint.S3Flags
+	disassembleCmd          = &cobra.Command{
+		Use:     "disassemble",
+		Aliases: []string{"d"},
+		Short:   "Disassemble a Docker image from ECR into layers stored in S3 Bucket",
+		RunE:    runDisassembleCmd,
+	}
+)
+
+func NewDisassembleCmd() *cobra.Command {
+	disassembleCmd.Flags().StringVarP(&s3Prefix, "s3-prefix", "p", "", "S3 object key to write the image layers to, defaults to <repository-name>/<tag>")
+	disassembleCmd.Flags().StringVarP(&repositoryName, "repository-name", "r", "", "repository name")
+	disassembleCmd.Flags().StringVarP(&tag, "tag", "t", "", "tag of the image to disassemble")
+	disassembleCmd.Flags().StringVarP(&registryId, "registry-id", "", "", "registry id of the repository, defaults to the account of the ECR credentials")
+	ecrCreds.AddFlags(disassembleCmd.Flags(), "ecr", "", "ECR image pull")
+	s3Creds.AddFlags(disassembleCmd.Flags(), "s3", "", "S3 writes")
+	s3Endpoint.AddFlags(disassembleCmd.Flags())
+	disassembleCmd.Flags().DurationVarP(&credentialsExpiryWindow, "credentials-expiry-window", "", auth.DEFAULT_EXPIRY_WINDOW, "refresh credentials this long before they expire")
+	utils.MarkFlagAsRequired(disassembleCmd, "repository-name", false)
+	utils.MarkFlagAsRequired(disassembleCmd, "tag", false)
+	return disassembleCmd
+}
+
+func runDisassembleCmd(cmd *cobra.Command, args []string) error {
+	bucket, err := utils.RequiredPersistentFlag(cmd, "s3-bucket")
+	if err != nil {
+		return err
+	}
+	region := cmd.Parent().PersistentFlags().Lookup("region").Value.String()
+
+	prefix := s3Prefix
+	if prefix == "" {
+		prefix = path.Join(repositoryName, tag)
+	}
+
+	pterm.Debug.Printfln("********************************************************")
+	pterm.Debug.Printfln("Region: %s", region)
+	pterm.Debug.Printfln("S3 Bucket: %s", bucket)
+	pterm.Debug.Printfln("S3 Prefix: %s", prefix)
+	pterm.Debug.Printfln("Repository Name: %s", repositoryName)
+	pterm.Debug.Printfln("Tag: %s", tag)
+	pterm.Debug.Printfln("********************************************************")
+
+	logger := &utils.PtermLogger{}
+
+	auditLog, err := audit.Open(cmd.Parent().PersistentFlags().Lookup("audit-log").Value.String())
+	if err != nil {
+		return err
+	}
+	defer auditLog.Close()
+
+	ecrProfile, err := ecrCreds.Profile(region, credentialsExpiryWindow)
+	if err != nil {
+		return fmt.Errorf("invalid ecr credentials: %w", err)
+	}
+	ecrCfg, err := auth.LoadConfig(cmd.Context(), ecrProfile, logger)
+	if err != nil {
+		return fmt.Errorf("disassemble error: %w", err)
+	}
+
+	s3Profile, err := s3Creds.Profile(region, credentialsExpiryWindow)
+	if err != nil {
+		return fmt.Errorf("invalid s3 credentials: %w", err)
+	}
+	s3Cfg, err := auth.LoadConfig(cmd.Context(), s3Profile, logger)
+	if err != nil {
+		return fmt.Errorf("disassemble error: %w", err)
+	}
+
+	s3Options, err := s3Endpoint.Options()
+	if err != nil {
+		return err
+	}
+
+	var uploader export.IUploader = manager.NewUploader(s3.NewFromConfig(s3Cfg, s3Options))
+	if auditLog != nil {
+		caller, err := s3Caller(cmd.Context(), s3Cfg)
+		if err != nil {
+			return err
+		}
+		uploader = audit.NewS3Uploader(uploader, auditLog, caller)
+	}
+
+	keys, err := export.Export(cmd.Context(), &export.ExportInput{
+		Source:   source.NewECR(ecr.NewFromConfig(ecrCfg), registryId, repositoryName, tag, logger),
+		Uploader: uploader,
+		Bucket:   bucket,
+		Prefix:   prefix,
+		Logger:   logger,
+	})
+	if err != nil {
+		return fmt.Errorf("error exporting docker image to S3: %w", err)
+	}
+
+	pterm.Success.Printfln("image %s:%s successfully disassembled to s3://%s/%s (%d objects)",
+		repositoryName, tag, bucket, prefix, len(keys))
+
+	return nil
+}
+
+// s3Caller is who the export is audited as. An S3 compatible store does not
+// accept the credentials at STS, its caller is its access key id instead.
+func s3Caller(ctx context.Context, cfg aws.Config) (audit.Identity, error) {
+	if s3Endpoint.Endpoint != "" {
+		return audit.NewAccessKeyIdentity(ctx, cfg.Credentials)
+	}
+
+	idOut, err := auth.CallerIdentity(ctx, cfg)
+	if err != nil {
+		return audit.Identity{}, fmt.Errorf("error getting called identity: %w", err)
+	}
+	return audit.NewIdentity(idOut), nil
+}
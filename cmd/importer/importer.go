@@ -0,0 +1,139 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package importer
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package importer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"docker-reassembler/pkg/batch"
+	"docker-reassembler/pkg/rewrite"
+	"docker-reassembler/pkg/source"
+	"docker-reassembler/pkg/upload"
+	"docker-reassembler/pkg/utils"
+
+	ecrTypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+var (
+	archive        string
+	images         []string
+	repositoryName string
+	tag            string
+	localPath      string
+	batchFlags     batch.Flags
+	rewriteFlags   rewrite.Flags
+	importCmd      = &cobra.Command{
+		Use:     "import",
+		Aliases: []string{"i"},
+		Short:   "Import Docker images from a docker save archive to ECR",
+		Long: `Import Docker images from a docker save archive to ECR.
+
+assemble --source docker-archive:<file> puts the one image of an archive.
+import puts every tagged image of an archive, or those picked with --image,
+each to the repository and tag it was saved as, with one set of credentials
+and one report for the whole archive.`,
+		RunE: runImportCmd,
+	}
+)
+
+func NewImportCmd() *cobra.Command {
+	importCmd.Flags().StringVarP(&archive, "archive", "a", "", "docker save archive to import")
+	importCmd.Flags().StringSliceVarP(&images, "image", "i", nil, "image(s) in the archive to import, e.g. app:1.0, all tagged images when not set")
+	importCmd.Flags().StringVarP(&repositoryName, "repository-name", "r", "", "destination repository name, defaults to the repository the image was saved as")
+	importCmd.Flags().StringVarP(&tag, "tag", "t", "", "destination tag, defaults to the tag the image was saved as, only for a single image")
+	importCmd.Flags().StringVarP(&localPath, "local-path", "l", filepath.Join(os.TempDir(), "docker-reassembler"), "local directory path to unpack the image layers to")
+	batchFlags.AddFlags(importCmd.Flags())
+	rewriteFlags.AddFlags(importCmd.Flags())
+	utils.MarkFlagAsRequired(importCmd, "archive", false)
+	return importCmd
+}
+
+func runImportCmd(cmd *cobra.Command, args []string) (err error) {
+	region := cmd.Parent().PersistentFlags().Lookup("region").Value.String()
+	logger := &utils.PtermLogger{}
+
+	if err := rewriteFlags.Validate(); err != nil {
+		return err
+	}
+	if err := batchFlags.Validate(); err != nil {
+		return err
+	}
+	toImport, err := source.DockerArchiveImages(archive, images, repositoryName, tag)
+	if err != nil {
+		return err
+	}
+
+	pterm.Debug.Printfln("********************************************************")
+	pterm.Debug.Printfln("Region: %s", region)
+	pterm.Debug.Printfln("Archive: %s", archive)
+	pterm.Debug.Printfln("Images: %d", len(toImport))
+	pterm.Debug.Printfln("********************************************************")
+
+	put, err := batchFlags.Open(cmd.Context(), "import", region,
+		cmd.Parent().PersistentFlags().Lookup("audit-log").Value.String(), logger)
+	if err != nil {
+		return err
+	}
+	defer put.Close()
+	defer func() { err = put.Finish(cmd.Context(), err) }()
+
+	pterm.Info.Printfln("importing %d image(s) from %s", len(toImport), archive)
+
+	failed := 0
+	for _, image := range toImport {
+		uploadInput, err := put.UploadInput(image.Repository, image.Tag)
+		if err != nil {
+			return err
+		}
+
+		uri := &source.URI{Scheme: source.SCHEME_DOCKER_ARCHIVE, Path: archive, Tag: image.Ref}
+		started := time.Now()
+		img, err := importImage(cmd.Context(), uri, uploadInput, logger)
+		put.Add(uri.String(), uploadInput, img, time.Since(started), err)
+		if err != nil {
+			pterm.Error.Printfln("error importing %s: %v", uri, err)
+			failed++
+			if cmd.Context().Err() != nil {
+				break
+			}
+			continue
+		}
+
+		pterm.Success.Printfln("image %v successfully imported to %s in registry with id %s",
+			*img.ImageId.ImageTag, *img.RepositoryName, put.RegistryId)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d image(s) failed to import", failed, len(toImport))
+	}
+
+	return nil
+}
+
+// importImage unpacks one image of the archive and uploads it, the
+// unpacked layers are removed afterwards.
+func importImage(ctx context.Context, uri *source.URI, input *upload.UploadInput, logger *utils.PtermLogger,
+) (*ecrTypes.Image, error) {
+	unpacked, cleanup, err := source.Open(ctx, uri, localPath, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	src, cleanupRewrite, err := rewriteFlags.Apply(ctx, unpacked, localPath, logger)
+	if err != nil {
+		return nil, fmt.Errorf("error rewriting image: %w", err)
+	}
+	defer cleanupRewrite()
+	input.Source = src
+
+	return upload.Upload(ctx, input)
+}
@@ -5,15 +5,28 @@
 package root
 
 import (
+	"context"
+	"net/http"
+	"time"
+
 	assembleCmd "docker-reassembler/cmd/assemble"
-	utils "docker-reassembler/pkg/utils"
+	copyCmd "docker-reassembler/cmd/copy"
+	disassembleCmd "docker-reassembler/cmd/disassemble"
+	importCmd "docker-reassembler/cmd/importer"
+	"docker-reassembler/pkg/metrics"
+	"docker-reassembler/pkg/tracing"
 
 	"github.com/pterm/pterm"
 	"github.com/spf13/cobra"
 )
 
 var (
+	metricsServer          *http.Server
 	s3Bucket               string
+	auditLog               string
+	metricsAddr            string
+	traceOptions           tracing.Options
+	shutdownTracing        func(context.Context) error
 	region                 string
 	debug, dryRun, verbose bool
 	rootCmd                = &cobra.Command{
@@ -33,18 +46,58 @@ func rootPersistentPreRunE(cmd *cobra.Command, args []string) error {
 		pterm.Info.Printfln("Dry run mode enabled.")
 	}
 
+	traceOptions.Version = cmd.Root().Version
+	shutdown, err := tracing.Setup(cmd.Context(), traceOptions)
+	if err != nil {
+		return err
+	}
+	shutdownTracing = shutdown
+
+	if metricsAddr != "" {
+		server, err := metrics.Serve(metricsAddr)
+		if err != nil {
+			return err
+		}
+		metricsServer = server
+	}
+
 	return nil
 }
 
+// Shutdown flushes any spans and stops the metrics server, it is called
+// after the command has run whether or not it failed.
+func Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if shutdownTracing != nil {
+		if err := shutdownTracing(ctx); err != nil {
+			pterm.Warning.Printfln("error flushing traces: %v", err)
+		}
+	}
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(ctx); err != nil {
+			pterm.Warning.Printfln("error stopping metrics server: %v", err)
+		}
+	}
+}
+
 func NewRootCmd() *cobra.Command {
 	rootCmd.PersistentFlags().StringVarP(&s3Bucket, "s3-bucket", "b", "", "S3 bucket to migrate to")
 	rootCmd.PersistentFlags().StringVarP(&region, "region", "", "eu-west-2", "AWS Region.")
 	rootCmd.PersistentFlags().BoolVarP(&debug, "debug", "d", false, "Enable debug mode.")
 	rootCmd.PersistentFlags().BoolVarP(&dryRun, "dry-run", "D", false, "Enable dry run mode.")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "", false, "Enable verbose mode.")
-	utils.MarkFlagAsRequired(rootCmd, "s3-bucket", true)
+	rootCmd.PersistentFlags().StringVarP(&metricsAddr, "metrics-addr", "", "", "Serve Prometheus metrics on this address, e.g. :9090.")
+	rootCmd.PersistentFlags().StringVarP(&traceOptions.Endpoint, "otlp-endpoint", "", "", "Export traces to this OTLP/HTTP collector, e.g. localhost:4318.")
+	rootCmd.PersistentFlags().BoolVarP(&traceOptions.Insecure, "otlp-insecure", "", false, "Export traces to the OTLP collector over plain http.")
+	rootCmd.PersistentFlags().StringVarP(&traceOptions.File, "trace-file", "", "", "Write traces as JSON to this file.")
+	rootCmd.PersistentFlags().StringVarP(&auditLog, "audit-log", "", "", "Append every mutating AWS call to this JSONL audit log.")
 
 	rootCmd.AddCommand(assembleCmd.NewAssembleCmd())
+	rootCmd.AddCommand(disassembleCmd.NewDisassembleCmd())
+	rootCmd.AddCommand(copyCmd.NewCopyCmd())
+	rootCmd.AddCommand(importCmd.NewImportCmd())
 
 	return rootCmd
 }
@@ -5,7 +5,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 
 	rootCmd "docker-reassembler/cmd/root"
 	utils "docker-reassembler/pkg/utils"
@@ -29,7 +33,19 @@ func main() {
 		version, commit, date, builtBy)
 
 	utils.Banner(version)
-	if err := rCmd.Execute(); err != nil {
+
+	// The first interrupt cancels the run so it can stop cleanly, a second
+	// one gets the default behaviour and exits straight away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		pterm.Warning.Printfln("interrupted, stopping after the parts in flight, interrupt again to exit now")
+	}()
+
+	err := rCmd.ExecuteContext(ctx)
+	rootCmd.Shutdown()
+	if err != nil {
 		pterm.Fatal.WithShowLineNumber().Printfln("Error running docker-reassembler: %v", err)
 	}
 
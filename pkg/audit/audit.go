@@ -0,0 +1,221 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package audit
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package audit
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const (
+	OUTCOME_SUCCESS = "success"
+	OUTCOME_ERROR   = "error"
+)
+
+// Identity is who a mutating call was made as.
+type Identity struct {
+	Arn         string `json:"arn"`
+	Account     string `json:"account"`
+	UserId      string `json:"userId"`
+	AccessKeyId string `json:"accessKeyId,omitempty"`
+}
+
+func NewIdentity(out *sts.GetCallerIdentityOutput) Identity {
+	return Identity{
+		Arn:     aws.ToString(out.Arn),
+		Account: aws.ToString(out.Account),
+		UserId:  aws.ToString(out.UserId),
+	}
+}
+
+// NewAccessKeyIdentity identifies the caller by the access key id of its
+// credentials, for S3 compatible stores that have no STS to ask.
+func NewAccessKeyIdentity(ctx context.Context, provider aws.CredentialsProvider) (Identity, error) {
+	if provider == nil {
+		return Identity{}, fmt.Errorf("no credentials to identify the caller by")
+	}
+	creds, err := provider.Retrieve(ctx)
+	if err != nil {
+		return Identity{}, fmt.Errorf("error retrieving credentials: %w", err)
+	}
+
+	return Identity{AccessKeyId: creds.AccessKeyID}, nil
+}
+
+// Entry is one line of the audit log. Each entry carries the hash of the one
+// before it, so removing or editing a line breaks the chain.
+type Entry struct {
+	Sequence  int64           `json:"seq"`
+	Time      time.Time       `json:"time"`
+	Caller    Identity        `json:"caller"`
+	Service   string          `json:"service"`
+	Operation string          `json:"operation"`
+	Params    json.RawMessage `json:"params"`
+	Outcome   string          `json:"outcome"`
+	Error     string          `json:"error,omitempty"`
+	PrevHash  string          `json:"prevHash"`
+	Hash      string          `json:"hash"`
+}
+
+func (e *Entry) hash() (string, error) {
+	unhashed := *e
+	unhashed.Hash = ""
+	buf, err := json.Marshal(unhashed)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Log appends entries to a JSONL file. A nil *Log records nothing, so callers
+// do not need to check whether auditing is enabled.
+type Log struct {
+	mu   sync.Mutex
+	file *os.File
+	seq  int64
+	prev string
+}
+
+// Open appends to the log at path, continuing the hash chain of any entries
+// already in it. An empty path returns a nil Log.
+func Open(path string) (*Log, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	l := &Log{}
+	if existing, err := os.Open(path); err == nil {
+		last, err := Verify(existing)
+		existing.Close()
+		if err != nil {
+			return nil, fmt.Errorf("existing audit log %q is invalid: %w", path, err)
+		}
+		if last != nil {
+			l.seq = last.Sequence
+			l.prev = last.Hash
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading audit log %q: %w", path, err)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log %q: %w", path, err)
+	}
+	l.file = file
+
+	return l, nil
+}
+
+// Record appends an entry for a call made as caller, err is the outcome of
+// the call.
+func (l *Log) Record(caller Identity, service, operation string, params interface{}, err error) error {
+	if l == nil {
+		return nil
+	}
+
+	// Keep the params as written, so the hash holds when the line is read back
+	rawParams, pErr := json.Marshal(params)
+	if pErr != nil {
+		return fmt.Errorf("error encoding audit params: %w", pErr)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry := &Entry{
+		Sequence:  l.seq + 1,
+		Time:      time.Now().UTC(),
+		Caller:    caller,
+		Service:   service,
+		Operation: operation,
+		Params:    rawParams,
+		Outcome:   OUTCOME_SUCCESS,
+		PrevHash:  l.prev,
+	}
+	if err != nil {
+		entry.Outcome = OUTCOME_ERROR
+		entry.Error = err.Error()
+	}
+
+	hash, hErr := entry.hash()
+	if hErr != nil {
+		return fmt.Errorf("error hashing audit entry: %w", hErr)
+	}
+	entry.Hash = hash
+
+	buf, mErr := json.Marshal(entry)
+	if mErr != nil {
+		return fmt.Errorf("error encoding audit entry: %w", mErr)
+	}
+	// Sync each entry, a crash must not lose the record of a call that was made
+	if _, wErr := l.file.Write(append(buf, '\n')); wErr != nil {
+		return fmt.Errorf("error writing audit entry: %w", wErr)
+	}
+	if sErr := l.file.Sync(); sErr != nil {
+		return fmt.Errorf("error syncing audit log: %w", sErr)
+	}
+
+	l.seq = entry.Sequence
+	l.prev = entry.Hash
+	return nil
+}
+
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// Verify checks the sequence and hash chain of every entry and returns the
+// last one, nil for an empty log.
+func Verify(r io.Reader) (*Entry, error) {
+	var last *Entry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		entry := &Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		prev, seq := "", int64(0)
+		if last != nil {
+			prev, seq = last.Hash, last.Sequence
+		}
+		if entry.Sequence != seq+1 {
+			return nil, fmt.Errorf("line %d: sequence %d follows %d", line, entry.Sequence, seq)
+		}
+		if entry.PrevHash != prev {
+			return nil, fmt.Errorf("line %d: previous hash does not match line %d", line, line-1)
+		}
+		hash, err := entry.hash()
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if hash != entry.Hash {
+			return nil, fmt.Errorf("line %d: hash does not match the entry", line)
+		}
+		last = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return last, nil
+}
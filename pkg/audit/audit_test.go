@@ -0,0 +1,153 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package audit_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package audit_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"docker-reassembler/pkg/audit"
+	"docker-reassembler/pkg/endpoint"
+	"docker-reassembler/pkg/export"
+	"docker-reassembler/pkg/internal/testsource"
+	"docker-reassembler/pkg/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+var caller = audit.Identity{Arn: "arn:aws:sts::123456789012:assumed-role/push/session", Account: "123456789012"}
+
+func TestLogChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	log, err := audit.Open(path)
+	assert.Nil(t, err)
+	assert.Nil(t, log.Record(caller, "ecr", "CreateRepository", map[string]string{"RepositoryName": "app"}, nil))
+	assert.Nil(t, log.Record(caller, "ecr", "PutImage", map[string]string{"ImageTag": "1.0"}, errors.New("denied")))
+	assert.Nil(t, log.Close())
+
+	// Reopening continues the chain
+	log, err = audit.Open(path)
+	assert.Nil(t, err)
+	assert.Nil(t, log.Record(caller, "ecr", "PutImage", map[string]string{"ImageTag": "1.0"}, nil))
+	assert.Nil(t, log.Close())
+
+	buf, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	last, err := audit.Verify(bytes.NewReader(buf))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), last.Sequence)
+
+	tampered := strings.Replace(string(buf), `"outcome":"error"`, `"outcome":"success"`, 1)
+	_, err = audit.Verify(strings.NewReader(tampered))
+	assert.NotNil(t, err)
+
+	lines := strings.SplitAfter(string(buf), "\n")
+	_, err = audit.Verify(strings.NewReader(lines[0] + lines[2]))
+	assert.NotNil(t, err, "a removed line breaks the chain")
+}
+
+func TestNilLog(t *testing.T) {
+	log, err := audit.Open("")
+	assert.Nil(t, err)
+	assert.Nil(t, log)
+	assert.Nil(t, log.Record(caller, "ecr", "PutImage", nil, nil))
+	assert.Nil(t, log.Close())
+}
+
+type stubECR struct {
+	audit.IECRClient
+}
+
+func (s *stubECR) UploadLayerPart(ctx context.Context, params *ecr.UploadLayerPartInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.UploadLayerPartOutput, error) {
+	return &ecr.UploadLayerPartOutput{}, nil
+}
+
+func TestECRClientOmitsBlobs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := audit.Open(path)
+	assert.Nil(t, err)
+
+	client := audit.NewECRClient(&stubECR{}, log, caller)
+	_, err = client.UploadLayerPart(context.Background(), &ecr.UploadLayerPartInput{
+		LayerPartBlob:  []byte("secret-layer-bytes"),
+		PartFirstByte:  aws.Int64(0),
+		PartLastByte:   aws.Int64(17),
+		RepositoryName: aws.String("app"),
+		UploadId:       aws.String("upload"),
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, log.Close())
+
+	buf, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(buf, []byte("secret-layer-bytes")))
+	assert.False(t, bytes.Contains(buf, []byte("c2VjcmV0")), "nor base64 encoded")
+	assert.True(t, bytes.Contains(buf, []byte(`"PartSize":18`)))
+	assert.True(t, bytes.Contains(buf, []byte(`"operation":"UploadLayerPart"`)))
+}
+
+func TestS3UploaderCustomEndpoint(t *testing.T) {
+	var mu sync.Mutex
+	puts := []string{}
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodPut {
+			puts = append(puts, r.URL.Path)
+		}
+		w.Header().Set("ETag", `"etag"`)
+	}))
+	defer store.Close()
+
+	options, err := (&endpoint.S3Flags{Endpoint: store.URL, PathStyle: true}).Options()
+	assert.Nil(t, err)
+	creds := credentials.NewStaticCredentialsProvider("minio", "minio123", "")
+	client := s3.NewFromConfig(aws.Config{Region: "us-east-1", RetryMaxAttempts: 1, Credentials: creds}, options)
+
+	// An S3 compatible store has no STS, the caller is its access key
+	caller, err := audit.NewAccessKeyIdentity(context.Background(), creds)
+	assert.Nil(t, err)
+	assert.Equal(t, "minio", caller.AccessKeyId)
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := audit.Open(path)
+	assert.Nil(t, err)
+
+	keys, err := export.Export(context.Background(), &export.ExportInput{
+		Source:   testsource.NewImage([]byte(`{"architecture":"amd64"}`), []byte("layer")),
+		Uploader: audit.NewS3Uploader(manager.NewUploader(client), log, caller),
+		Bucket:   "images",
+		Prefix:   "app/1.0",
+		Logger:   &utils.PtermLogger{},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, log.Close())
+
+	assert.Len(t, puts, len(keys))
+	assert.Contains(t, puts, "/images/app/1.0/manifest.json")
+
+	buf, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	last, err := audit.Verify(bytes.NewReader(buf))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(keys)), last.Sequence)
+	assert.Equal(t, "minio", last.Caller.AccessKeyId)
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package audit
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package audit
+
+import (
+	"context"
+
+	"docker-reassembler/pkg/export"
+	"docker-reassembler/pkg/scan"
+	"docker-reassembler/pkg/upload"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pterm/pterm"
+)
+
+type IECRClient interface {
+	upload.IClient
+	scan.IScanClient
+}
+
+// ECRClient records the mutating calls made through an ECR client, reads are
+// passed straight through.
+type ECRClient struct {
+	IECRClient
+	Log    *Log
+	Caller Identity
+}
+
+// NewECRClient returns client unchanged when log is nil.
+func NewECRClient(client IECRClient, log *Log, caller Identity) IECRClient {
+	if log == nil {
+		return client
+	}
+	return &ECRClient{IECRClient: client, Log: log, Caller: caller}
+}
+
+func (c *ECRClient) record(operation string, params interface{}, err error) {
+	if lErr := c.Log.Record(c.Caller, "ecr", operation, params, err); lErr != nil {
+		pterm.Error.Printfln("error auditing %s: %v", operation, lErr)
+	}
+}
+
+func (c *ECRClient) CreateRepository(ctx context.Context, params *ecr.CreateRepositoryInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.CreateRepositoryOutput, error) {
+	out, err := c.IECRClient.CreateRepository(ctx, params, optFns...)
+	c.record("CreateRepository", params, err)
+	return out, err
+}
+
+func (c *ECRClient) InitiateLayerUpload(ctx context.Context, params *ecr.InitiateLayerUploadInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.InitiateLayerUploadOutput, error) {
+	out, err := c.IECRClient.InitiateLayerUpload(ctx, params, optFns...)
+	logged := struct {
+		*ecr.InitiateLayerUploadInput
+		UploadId *string
+	}{InitiateLayerUploadInput: params}
+	if out != nil {
+		logged.UploadId = out.UploadId
+	}
+	c.record("InitiateLayerUpload", logged, err)
+	return out, err
+}
+
+func (c *ECRClient) UploadLayerPart(ctx context.Context, params *ecr.UploadLayerPartInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.UploadLayerPartOutput, error) {
+	out, err := c.IECRClient.UploadLayerPart(ctx, params, optFns...)
+
+	// Log the part's range, never its bytes
+	logged := *params
+	logged.LayerPartBlob = nil
+	c.record("UploadLayerPart", struct {
+		ecr.UploadLayerPartInput
+		PartSize int
+	}{logged, len(params.LayerPartBlob)}, err)
+
+	return out, err
+}
+
+func (c *ECRClient) CompleteLayerUpload(ctx context.Context, params *ecr.CompleteLayerUploadInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.CompleteLayerUploadOutput, error) {
+	out, err := c.IECRClient.CompleteLayerUpload(ctx, params, optFns...)
+	c.record("CompleteLayerUpload", params, err)
+	return out, err
+}
+
+func (c *ECRClient) PutImage(ctx context.Context, params *ecr.PutImageInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.PutImageOutput, error) {
+	out, err := c.IECRClient.PutImage(ctx, params, optFns...)
+	c.record("PutImage", params, err)
+	return out, err
+}
+
+// S3Uploader records the objects written through an export uploader.
+type S3Uploader struct {
+	export.IUploader
+	Log    *Log
+	Caller Identity
+}
+
+// NewS3Uploader returns uploader unchanged when log is nil.
+func NewS3Uploader(uploader export.IUploader, log *Log, caller Identity) export.IUploader {
+	if log == nil {
+		return uploader
+	}
+	return &S3Uploader{IUploader: uploader, Log: log, Caller: caller}
+}
+
+func (u *S3Uploader) Upload(ctx context.Context, input *s3.PutObjectInput,
+	opts ...func(*manager.Uploader),
+) (*manager.UploadOutput, error) {
+	out, err := u.IUploader.Upload(ctx, input, opts...)
+
+	params := map[string]string{
+		"Bucket": aws.ToString(input.Bucket),
+		"Key":    aws.ToString(input.Key),
+	}
+	if out != nil {
+		params["Location"] = out.Location
+		if out.VersionID != nil {
+			params["VersionId"] = *out.VersionID
+		}
+	}
+	if lErr := u.Log.Record(u.Caller, "s3", "PutObject", params, err); lErr != nil {
+		pterm.Error.Printfln("error auditing PutObject: %v", lErr)
+	}
+
+	return out, err
+}
@@ -0,0 +1,180 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package auth
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	lgr "docker-reassembler/pkg/logger"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+	"github.com/pterm/pterm"
+)
+
+const (
+	DEFAULT_ROLE_DURATION = time.Minute * 60
+	// Credentials are refreshed this long before they expire so that a
+	// layer part is never sent with a token that is about to lapse
+	DEFAULT_EXPIRY_WINDOW = time.Minute * 5
+)
+
+// Role is a single link in a role chain. Each role is assumed using the
+// credentials obtained from the previous link.
+type Role struct {
+	Arn         string
+	ExternalId  string
+	SessionName string
+}
+
+// Profile describes how to obtain credentials for one side of a migration
+// (the S3 source or the ECR destination).
+type Profile struct {
+	// Name of the shared config profile, empty for the default chain
+	Name   string
+	Region string
+	// Roles are assumed in order, the first one with the base credentials
+	Roles    []Role
+	Duration time.Duration
+	// WebIdentityTokenFile, when set, is used to assume the first role
+	// with AssumeRoleWithWebIdentity instead of AssumeRole
+	WebIdentityTokenFile string
+	// ExpiryWindow is how long before expiry the credentials are refreshed
+	ExpiryWindow time.Duration
+	// ConfigOptions are extra load options, such as endpoint overrides
+	ConfigOptions []func(*config.LoadOptions) error
+}
+
+// NewRoles zips role ARNs with their external ids and session names,
+// matched by position.
+func NewRoles(arns, externalIds, sessionNames []string) ([]Role, error) {
+	if len(externalIds) > len(arns) {
+		return nil, fmt.Errorf("%d external ids given for %d roles", len(externalIds), len(arns))
+	}
+	if len(sessionNames) > len(arns) {
+		return nil, fmt.Errorf("%d session names given for %d roles", len(sessionNames), len(arns))
+	}
+
+	roles := make([]Role, 0, len(arns))
+	for i, arn := range arns {
+		if arn == "" {
+			continue
+		}
+		role := Role{Arn: arn}
+		if i < len(externalIds) {
+			role.ExternalId = externalIds[i]
+		}
+		if i < len(sessionNames) {
+			role.SessionName = sessionNames[i]
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, nil
+}
+
+func LoadConfig(ctx context.Context, profile Profile, logger lgr.ILogger) (aws.Config, error) {
+	opts := []func(*config.LoadOptions) error{
+		config.WithDefaultRegion(profile.Region),
+		config.WithLogConfigurationWarnings(true),
+		config.WithLogger(logger),
+	}
+	if profile.Name != "" {
+		opts = append(opts, config.WithSharedConfigProfile(profile.Name))
+	}
+
+	expiryWindow := profile.ExpiryWindow
+	if expiryWindow == 0 {
+		expiryWindow = DEFAULT_EXPIRY_WINDOW
+	}
+	cacheOptions := func(o *aws.CredentialsCacheOptions) {
+		o.ExpiryWindow = expiryWindow
+		o.ExpiryWindowJitterFrac = 0.1
+	}
+	opts = append(opts, config.WithCredentialsCacheOptions(cacheOptions))
+	opts = append(opts, profile.ConfigOptions...)
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("error loading aws config: %w", err)
+	}
+
+	if profile.WebIdentityTokenFile != "" && len(profile.Roles) == 0 {
+		return aws.Config{}, fmt.Errorf("a role is required to use web identity token %q",
+			profile.WebIdentityTokenFile)
+	}
+
+	duration := profile.Duration
+	if duration == 0 {
+		duration = DEFAULT_ROLE_DURATION
+	}
+
+	// https://pkg.go.dev/github.com/aws/aws-sdk-go-v2/credentials/stscreds#hdr-Assume_Role
+	for i, role := range profile.Roles {
+		stsClient := sts.NewFromConfig(cfg)
+
+		sessionName := role.SessionName
+		if sessionName == "" {
+			sessionName = fmt.Sprintf("docker-reassembler-%d", time.Now().UnixNano())
+		}
+
+		var provider aws.CredentialsProvider
+		if i == 0 && profile.WebIdentityTokenFile != "" {
+			logger.Printfln(pterm.Debug, "assuming role %s with web identity", role.Arn)
+			provider = stscreds.NewWebIdentityRoleProvider(stsClient, role.Arn,
+				stscreds.IdentityTokenFile(profile.WebIdentityTokenFile),
+				func(o *stscreds.WebIdentityRoleOptions) {
+					o.RoleSessionName = sessionName
+					o.Duration = duration
+				})
+		} else {
+			logger.Printfln(pterm.Debug, "assuming role %s", role.Arn)
+			externalId := role.ExternalId
+			provider = stscreds.NewAssumeRoleProvider(stsClient, role.Arn,
+				func(aro *stscreds.AssumeRoleOptions) {
+					if externalId != "" {
+						aro.ExternalID = aws.String(externalId)
+					}
+					aro.RoleSessionName = sessionName
+					aro.Duration = duration
+				})
+		}
+
+		cfg.Credentials = aws.NewCredentialsCache(provider, cacheOptions)
+	}
+
+	return cfg, nil
+}
+
+func CallerIdentity(ctx context.Context, cfg aws.Config) (*sts.GetCallerIdentityOutput, error) {
+	out, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting caller identity: %w", err)
+	}
+
+	return out, nil
+}
+
+// IsExpiredTokenError reports whether the request was rejected because the
+// credentials used to sign it have expired.
+func IsExpiredTokenError(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	switch apiErr.ErrorCode() {
+	case "ExpiredToken", "ExpiredTokenException", "RequestExpired", "TokenRefreshRequired":
+		return true
+	}
+
+	return false
+}
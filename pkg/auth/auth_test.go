@@ -0,0 +1,70 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package auth_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package auth_test
+
+import (
+	"fmt"
+	"testing"
+
+	"docker-reassembler/pkg/auth"
+
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRoles(t *testing.T) {
+	cases := []struct {
+		arns         []string
+		externalIds  []string
+		sessionNames []string
+		expected     []auth.Role
+		expectErr    bool
+	}{
+		{
+			arns:     nil,
+			expected: []auth.Role{},
+		},
+		{
+			// an empty --put-role-to-assume must not produce a role
+			arns:     []string{""},
+			expected: []auth.Role{},
+		},
+		{
+			arns:         []string{"arn:aws:iam::111111111111:role/a", "arn:aws:iam::222222222222:role/b"},
+			externalIds:  []string{"", "ext-b"},
+			sessionNames: []string{"session-a"},
+			expected: []auth.Role{
+				{Arn: "arn:aws:iam::111111111111:role/a", SessionName: "session-a"},
+				{Arn: "arn:aws:iam::222222222222:role/b", ExternalId: "ext-b"},
+			},
+		},
+		{
+			arns:        []string{"arn:aws:iam::111111111111:role/a"},
+			externalIds: []string{"ext-a", "ext-b"},
+			expectErr:   true,
+		},
+	}
+
+	for _, tt := range cases {
+		roles, err := auth.NewRoles(tt.arns, tt.externalIds, tt.sessionNames)
+		if tt.expectErr {
+			assert.NotNil(t, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, tt.expected, roles)
+	}
+}
+
+func TestIsExpiredTokenError(t *testing.T) {
+	expired := &smithy.GenericAPIError{Code: "ExpiredTokenException", Message: "token expired"}
+	throttled := &smithy.GenericAPIError{Code: "ThrottlingException", Message: "rate exceeded"}
+
+	assert.True(t, auth.IsExpiredTokenError(expired))
+	assert.True(t, auth.IsExpiredTokenError(fmt.Errorf("upload layer part error: %w", expired)))
+	assert.False(t, auth.IsExpiredTokenError(throttled))
+	assert.False(t, auth.IsExpiredTokenError(fmt.Errorf("boom")))
+	assert.False(t, auth.IsExpiredTokenError(nil))
+}
@@ -0,0 +1,57 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package auth
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// ProfileFlags holds the command line flags describing one Profile, so each
+// command can offer the same credential options for each side it talks to.
+type ProfileFlags struct {
+	Region               string
+	ProfileName          string
+	RoleToAssume         []string
+	RoleExternalId       []string
+	RoleSessionName      []string
+	RoleDuration         time.Duration
+	WebIdentityTokenFile string
+}
+
+// AddFlags registers the flags as --<prefix>-profile, --<prefix>-role-to-assume
+// and so on, usage names what the credentials are used for.
+func (f *ProfileFlags) AddFlags(flags *pflag.FlagSet, prefix, roleShorthand, usage string) {
+	flags.StringVarP(&f.Region, prefix+"-region", "", "", fmt.Sprintf("AWS Region for %s, defaults to --region", usage))
+	flags.StringVarP(&f.ProfileName, prefix+"-profile", "", "", fmt.Sprintf("shared config profile used for %s", usage))
+	flags.StringArrayVarP(&f.RoleToAssume, prefix+"-role-to-assume", roleShorthand, nil, fmt.Sprintf("IAM role(s) to assume for %s, repeat in the order they are assumed", usage))
+	flags.StringArrayVarP(&f.RoleExternalId, prefix+"-role-external-id", "", nil, fmt.Sprintf("External Id for the %s assumed role(s), repeat in the same order as the roles", usage))
+	flags.StringArrayVarP(&f.RoleSessionName, prefix+"-role-session-name", "", nil, fmt.Sprintf("session name(s) for the %s assumed role(s), repeat in the same order as the roles", usage))
+	flags.DurationVarP(&f.RoleDuration, prefix+"-role-duration", "", DEFAULT_ROLE_DURATION, fmt.Sprintf("duration of the %s assumed role session(s)", usage))
+	flags.StringVarP(&f.WebIdentityTokenFile, prefix+"-web-identity-token-file", "", "", fmt.Sprintf("web identity token file used to assume the first %s role", usage))
+}
+
+func (f *ProfileFlags) Profile(defaultRegion string, expiryWindow time.Duration) (Profile, error) {
+	roles, err := NewRoles(f.RoleToAssume, f.RoleExternalId, f.RoleSessionName)
+	if err != nil {
+		return Profile{}, fmt.Errorf("invalid role flags: %w", err)
+	}
+
+	region := f.Region
+	if region == "" {
+		region = defaultRegion
+	}
+
+	return Profile{
+		Name:                 f.ProfileName,
+		Region:               region,
+		Roles:                roles,
+		Duration:             f.RoleDuration,
+		WebIdentityTokenFile: f.WebIdentityTokenFile,
+		ExpiryWindow:         expiryWindow,
+	}, nil
+}
@@ -0,0 +1,36 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package auth_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package auth_test
+
+import (
+	"testing"
+	"time"
+
+	"docker-reassembler/pkg/auth"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProfileFlagsValuesWithComma(t *testing.T) {
+	f := &auth.ProfileFlags{}
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	f.AddFlags(flags, "put", "P", "ECR image put")
+	assert.Nil(t, flags.Parse([]string{
+		"--put-role-to-assume", "arn:aws:iam::111111111111:role/a",
+		"--put-role-to-assume", "arn:aws:iam::222222222222:role/b",
+		"--put-role-external-id", "team=a,env=prod",
+		"--put-role-external-id", "ext-b",
+		"--put-role-session-name", "push,eu",
+		"--put-role-session-name", "push",
+	}))
+
+	profile, err := f.Profile("eu-west-1", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, []auth.Role{
+		{Arn: "arn:aws:iam::111111111111:role/a", ExternalId: "team=a,env=prod", SessionName: "push,eu"},
+		{Arn: "arn:aws:iam::222222222222:role/b", ExternalId: "ext-b", SessionName: "push"},
+	}, profile.Roles)
+}
@@ -0,0 +1,189 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package batch
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package batch
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"docker-reassembler/pkg/audit"
+	"docker-reassembler/pkg/auth"
+	"docker-reassembler/pkg/endpoint"
+	lgr "docker-reassembler/pkg/logger"
+	"docker-reassembler/pkg/report"
+	"docker-reassembler/pkg/scan"
+	"docker-reassembler/pkg/throttle"
+	"docker-reassembler/pkg/upload"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrTypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/spf13/pflag"
+)
+
+// Flags are the options of the commands that put a batch of images to the
+// registry of the put credentials.
+type Flags struct {
+	PutCreds                auth.ProfileFlags
+	ECREndpoint             endpoint.ECRFlags
+	CredentialsExpiryWindow time.Duration
+	Upload                  upload.Flags
+	Scan                    scan.Flags
+	Report                  report.Flags
+	Throttle                throttle.Flags
+}
+
+func (f *Flags) AddFlags(flags *pflag.FlagSet) {
+	f.PutCreds.AddFlags(flags, "put", "P", "ECR image put")
+	f.ECREndpoint.AddFlags(flags)
+	flags.DurationVarP(&f.CredentialsExpiryWindow, "credentials-expiry-window", "", auth.DEFAULT_EXPIRY_WINDOW, "refresh credentials this long before they expire")
+	f.Upload.AddFlags(flags)
+	f.Scan.AddFlags(flags)
+	f.Report.AddFlags(flags)
+	f.Throttle.AddFlags(flags)
+}
+
+// Validate checks the flags before any image is read.
+func (f *Flags) Validate() error {
+	return f.Scan.Validate()
+}
+
+// Batch puts images to one registry and keeps the report and the scans to
+// wait for of every image put.
+type Batch struct {
+	RegistryId  string
+	Region      string
+	Client      audit.IECRClient
+	Credentials upload.ICredentialsCache
+	Limiter     *throttle.Limiter
+	Logger      lgr.ILogger
+
+	flags    *Flags
+	auditLog *audit.Log
+	report   *report.Report
+	waits    []*scan.WaitInput
+}
+
+func New(command string, flags *Flags, logger lgr.ILogger) *Batch {
+	return &Batch{Logger: logger, flags: flags, report: report.New(command)}
+}
+
+// Open starts a batch for command, the ECR client is made with the put
+// credentials and every call it makes is written to the audit log at
+// auditPath, when there is one. Close the batch once it is done.
+func (f *Flags) Open(ctx context.Context, command, region, auditPath string, logger lgr.ILogger) (
+	batch *Batch, err error,
+) {
+	b := New(command, f, logger)
+	b.auditLog, err = audit.Open(auditPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			b.Close()
+		}
+	}()
+
+	if err = f.Throttle.Watch(ctx); err != nil {
+		return nil, err
+	}
+	// Only puts are limited, the control file rejects download rates
+	_, b.Limiter, err = f.Throttle.Limiters()
+	if err != nil {
+		return nil, err
+	}
+
+	putProfile, err := f.PutCreds.Profile(region, f.CredentialsExpiryWindow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid put credentials: %w", err)
+	}
+	putProfile.ConfigOptions, err = f.ECREndpoint.ConfigOptions()
+	if err != nil {
+		return nil, err
+	}
+	ecrCfg, err := auth.LoadConfig(ctx, putProfile, logger)
+	if err != nil {
+		return nil, fmt.Errorf("%s error: %w", command, err)
+	}
+	idOut, err := auth.CallerIdentity(ctx, ecrCfg)
+	if err != nil {
+		return nil, fmt.Errorf("error getting called identity: %w", err)
+	}
+
+	b.RegistryId = aws.ToString(idOut.Account)
+	b.Region = putProfile.Region
+	b.Client = audit.NewECRClient(ecr.NewFromConfig(ecrCfg, upload.SingleAttempt), b.auditLog, audit.NewIdentity(idOut))
+	// The uploader forces a refresh of expired credentials through the cache
+	if cache, ok := ecrCfg.Credentials.(*aws.CredentialsCache); ok {
+		b.Credentials = cache
+	}
+
+	return b, nil
+}
+
+// UploadInput is the input to put an image to repository under tag.
+func (b *Batch) UploadInput(repository, tag string) (*upload.UploadInput, error) {
+	input := &upload.UploadInput{
+		RepositoryName: repository,
+		RegistryId:     b.RegistryId,
+		Logger:         b.Logger,
+		Tag:            tag,
+		Client:         b.Client,
+		Credentials:    b.Credentials,
+		Stats:          &upload.Stats{},
+		Limiter:        b.Limiter,
+	}
+	if err := b.flags.Upload.Apply(input); err != nil {
+		return nil, err
+	}
+
+	return input, nil
+}
+
+// Add records the outcome of putting an image read from source, an image
+// that was put is waited on when the scans are.
+func (b *Batch) Add(source string, input *upload.UploadInput, img *ecrTypes.Image, duration time.Duration, err error) {
+	b.report.AddUpload(source, b.Region, input, img, duration, err)
+	if err != nil {
+		return
+	}
+
+	b.waits = append(b.waits, &scan.WaitInput{
+		Client:         b.Client,
+		RegistryId:     input.RegistryId,
+		RepositoryName: input.RepositoryName,
+		ImageTag:       input.Tag,
+		ImageDigest:    aws.ToString(img.ImageId.ImageDigest),
+		Retry:          input.Retry,
+		Logger:         b.Logger,
+	})
+}
+
+// Finish waits for the scans when asked to and writes the report, it is
+// deferred with the error the command ends with so the report is written
+// however it ends. The error is err, or that of the scans when there is
+// none, with any error writing the report alongside.
+func (b *Batch) Finish(ctx context.Context, err error) error {
+	if b.flags.Scan.Wait {
+		if scanErr := b.flags.Scan.Run(ctx, b.waits); err == nil {
+			err = scanErr
+		}
+	}
+
+	if writeErr := b.flags.Report.Write(b.report); writeErr != nil {
+		if err != nil {
+			return fmt.Errorf("%w, and the report was not written: %v", err, writeErr)
+		}
+		return writeErr
+	}
+
+	return err
+}
+
+func (b *Batch) Close() error {
+	return b.auditLog.Close()
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package batch_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package batch_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"docker-reassembler/pkg/audit"
+	"docker-reassembler/pkg/batch"
+	"docker-reassembler/pkg/report"
+	"docker-reassembler/pkg/scan"
+	"docker-reassembler/pkg/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrTypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+)
+
+// scannedECR reports a completed scan with one finding of severity for
+// every image it is asked about.
+type scannedECR struct {
+	audit.IECRClient
+	severity string
+	scanned  []string
+}
+
+func (m *scannedECR) DescribeImageScanFindings(ctx context.Context, params *ecr.DescribeImageScanFindingsInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.DescribeImageScanFindingsOutput, error) {
+	m.scanned = append(m.scanned, aws.ToString(params.ImageId.ImageDigest))
+	return &ecr.DescribeImageScanFindingsOutput{
+		ImageScanStatus:   &ecrTypes.ImageScanStatus{Status: ecrTypes.ScanStatusComplete},
+		ImageScanFindings: &ecrTypes.ImageScanFindings{FindingSeverityCounts: map[string]int32{m.severity: 1}},
+	}, nil
+}
+
+func newBatch(t *testing.T, client *scannedECR, failOn, path string) *batch.Batch {
+	flags := &batch.Flags{}
+	flagSet := pflag.NewFlagSet("import", pflag.ContinueOnError)
+	flags.AddFlags(flagSet)
+	assert.Nil(t, flagSet.Parse([]string{
+		"--wait-for-scan", "--scan-timeout=1s", "--scan-poll-interval=1ms", "--scan-fail-on=" + failOn, "--report=" + path,
+	}))
+	assert.Nil(t, flags.Validate())
+
+	b := batch.New("import", flags, &utils.PtermLogger{})
+	b.RegistryId, b.Region, b.Client = "123456789012", "eu-west-2", client
+	return b
+}
+
+func TestBatch(t *testing.T) {
+	client := &scannedECR{severity: "LOW"}
+	path := filepath.Join(t.TempDir(), "report.json")
+	b := newBatch(t, client, "HIGH", path)
+
+	input, err := b.UploadInput("app", "1.0")
+	assert.Nil(t, err)
+	assert.Equal(t, "123456789012", input.RegistryId)
+	assert.NotNil(t, input.Stats)
+	image := &ecrTypes.Image{ImageId: &ecrTypes.ImageIdentifier{ImageTag: aws.String("1.0"), ImageDigest: aws.String("sha256:aaa")}}
+	b.Add("docker-archive:/saved.tar:app:1.0", input, image, time.Second, nil)
+
+	failed, err := b.UploadInput("app", "2.0")
+	assert.Nil(t, err)
+	b.Add("docker-archive:/saved.tar:app:2.0", failed, nil, time.Second, errors.New("denied"))
+
+	assert.Nil(t, b.Finish(context.Background(), nil))
+	assert.Equal(t, []string{"sha256:aaa"}, client.scanned, "only images that were put are scanned")
+
+	buf, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	written := report.Report{}
+	assert.Nil(t, json.Unmarshal(buf, &written))
+	assert.Equal(t, "import", written.Command)
+	assert.Len(t, written.Images, 2)
+	assert.Equal(t, "eu-west-2", written.Images[0].Region)
+	assert.Equal(t, report.STATUS_FAILED, written.Images[1].Status)
+}
+
+func TestBatchFinishFailsOnFindings(t *testing.T) {
+	client := &scannedECR{severity: "CRITICAL"}
+	path := filepath.Join(t.TempDir(), "report.json")
+	b := newBatch(t, client, "HIGH", path)
+
+	input, err := b.UploadInput("app", "1.0")
+	assert.Nil(t, err)
+	b.Add("app:1.0", input, &ecrTypes.Image{ImageId: &ecrTypes.ImageIdentifier{ImageDigest: aws.String("sha256:aaa")}}, time.Second, nil)
+
+	assert.NotNil(t, b.Finish(context.Background(), nil))
+	_, err = ioutil.ReadFile(path)
+	assert.Nil(t, err, "the report is written when a scan fails")
+}
+
+func TestBatchFinishKeepsErrorWhenReportFails(t *testing.T) {
+	// The report goes under a file, so it cannot be written
+	blocked := filepath.Join(t.TempDir(), "blocked")
+	assert.Nil(t, ioutil.WriteFile(blocked, nil, 0o644))
+	b := newBatch(t, &scannedECR{severity: "LOW"}, "HIGH", filepath.Join(blocked, "report.json"))
+
+	failed := errors.New("1 of 1 image(s) failed to import")
+	err := b.Finish(context.Background(), failed)
+	assert.ErrorIs(t, err, failed)
+	assert.Contains(t, err.Error(), "the report was not written")
+}
+
+func TestFlagsValidate(t *testing.T) {
+	flags := &batch.Flags{Scan: scan.Flags{FailOn: "urgent"}}
+	assert.NotNil(t, flags.Validate())
+}
@@ -6,6 +6,7 @@ package build
 
 import (
 	"archive/tar"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -20,7 +21,7 @@ import (
 	"github.com/pterm/pterm"
 )
 
-func Build(path, repository, tag, destinationPath string, createTar bool, logger lgr.ILogger) (v1.Image, error) {
+func Build(ctx context.Context, path, repository, tag, destinationPath string, createTar bool, logger lgr.ILogger) (v1.Image, error) {
 	err := os.Chdir(path)
 	if err != nil {
 		return nil, fmt.Errorf("error changing directory: %w", err)
@@ -39,6 +40,9 @@ func Build(path, repository, tag, destinationPath string, createTar bool, logger
 	if createTar {
 		filesToInclude := []string{}
 		err := filepath.WalkDir("./", func(p string, d os.DirEntry, err error) error {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
 			if _, err := os.Stat(p); err == nil {
 				if !d.IsDir() {
 					filesToInclude = append(filesToInclude, p)
@@ -58,8 +62,9 @@ func Build(path, repository, tag, destinationPath string, createTar bool, logger
 
 		logger.Printfln(pterm.Info, "creating %q", tarballPath)
 		logger.Printfln(pterm.Debug, "with files: %v", filesToInclude)
-		err = createTarball(tarballPath, filesToInclude)
+		err = createTarball(ctx, tarballPath, filesToInclude)
 		if err != nil {
+			os.Remove(tarballPath)
 			return nil, err
 		}
 	}
@@ -72,7 +77,7 @@ func Build(path, repository, tag, destinationPath string, createTar bool, logger
 	return img, err
 }
 
-func createTarball(path string, filepaths []string) error {
+func createTarball(ctx context.Context, path string, filepaths []string) error {
 	file, err := os.Create(path)
 	if err != nil {
 		return fmt.Errorf("error creating tarball %q: %w", path, err)
@@ -83,6 +88,9 @@ func createTarball(path string, filepaths []string) error {
 	defer tarWriter.Close()
 
 	for _, fp := range filepaths {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("tarball creation interrupted: %w", err)
+		}
 		err := addFileToTarWriter(fp, tarWriter)
 		if err != nil {
 			return fmt.Errorf("error adding file to tar writer: %w", err)
@@ -0,0 +1,107 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package checkpoint
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package checkpoint
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const FILE_NAME = "checkpoint.json"
+
+// Object is a download that was written completely.
+type Object struct {
+	Size int64  `json:"size"`
+	ETag string `json:"etag"`
+}
+
+// Checkpoint records the progress of a run so an interrupted run can pick up
+// where it stopped. A nil Checkpoint records nothing.
+type Checkpoint struct {
+	mu        sync.Mutex
+	path      string
+	Downloads map[string]Object `json:"downloads"`
+}
+
+// Load reads the checkpoint at path, a missing file is an empty checkpoint.
+func Load(path string) (*Checkpoint, error) {
+	c := &Checkpoint{path: path, Downloads: map[string]Object{}}
+
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading checkpoint %q: %w", path, err)
+	}
+	if err := json.Unmarshal(buf, c); err != nil {
+		return nil, fmt.Errorf("error parsing checkpoint %q: %w", path, err)
+	}
+	if c.Downloads == nil {
+		c.Downloads = map[string]Object{}
+	}
+
+	return c, nil
+}
+
+// Downloaded reports whether file was completely downloaded from an object
+// that still has the same size and ETag, and is still on disk.
+func (c *Checkpoint) Downloaded(file string, object Object) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	recorded, ok := c.Downloads[file]
+	c.mu.Unlock()
+	if !ok || recorded != object {
+		return false
+	}
+
+	info, err := os.Stat(file)
+	return err == nil && info.Size() == object.Size
+}
+
+func (c *Checkpoint) AddDownload(file string, object Object) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Downloads[file] = object
+}
+
+// Flush writes the checkpoint through a temporary file, so an interrupted
+// flush leaves the previous checkpoint in place.
+func (c *Checkpoint) Flush() error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	buf, err := json.MarshalIndent(c, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("error encoding checkpoint: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o775); err != nil {
+		return fmt.Errorf("error creating checkpoint directory: %w", err)
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0o644); err != nil {
+		return fmt.Errorf("error writing checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("error writing checkpoint: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package checkpoint_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package checkpoint_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"docker-reassembler/pkg/checkpoint"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, checkpoint.FILE_NAME)
+	layer := filepath.Join(dir, "sha256__abc")
+	assert.Nil(t, ioutil.WriteFile(layer, []byte("0123456789"), 0o644))
+	object := checkpoint.Object{Size: 10, ETag: `"etag"`}
+
+	c, err := checkpoint.Load(path)
+	assert.Nil(t, err)
+	assert.False(t, c.Downloaded(layer, object))
+
+	c.AddDownload(layer, object)
+	assert.Nil(t, c.Flush())
+
+	c, err = checkpoint.Load(path)
+	assert.Nil(t, err)
+	assert.True(t, c.Downloaded(layer, object))
+	assert.False(t, c.Downloaded(layer, checkpoint.Object{Size: 10, ETag: `"changed"`}), "object changed in S3")
+
+	assert.Nil(t, ioutil.WriteFile(layer, []byte("01234"), 0o644))
+	assert.False(t, c.Downloaded(layer, object), "local file truncated")
+}
+
+func TestNilCheckpoint(t *testing.T) {
+	var c *checkpoint.Checkpoint
+	c.AddDownload("file", checkpoint.Object{})
+	assert.False(t, c.Downloaded("file", checkpoint.Object{}))
+	assert.Nil(t, c.Flush())
+}
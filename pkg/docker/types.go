@@ -6,8 +6,13 @@ package docker
 
 const (
 	// Even though the documentation says 20Mb or 20971520 bytes
-	// we have erratic results, so reducing to 10Mb or 10485760
-	// to give some leeway
-	LAYER_PART_MAX_SIZE     int64 = 10485760
+	// we have had erratic results, 10Mb or 10485760 is the size
+	// known to work
+	LAYER_PART_MAX_SIZE int64 = 10485760
+	// Parts start at 20Mb or 20971520, the largest part ECR takes,
+	// shrink towards 5Mb or 5242880, the smallest part it accepts,
+	// when rejected and grow back after a run of accepted parts
+	LAYER_PART_MIN_SIZE     int64 = 5242880
+	LAYER_PART_CEILING_SIZE int64 = 20971520
 	IMAGE_MANIFEST_MAX_SIZE int64 = 4194304
 )
@@ -8,15 +8,27 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 
+	"docker-reassembler/pkg/checkpoint"
 	lgr "docker-reassembler/pkg/logger"
+	"docker-reassembler/pkg/metrics"
+	"docker-reassembler/pkg/source"
+	"docker-reassembler/pkg/throttle"
+	"docker-reassembler/pkg/tracing"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	s3man "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	humanize "github.com/dustin/go-humanize"
+	"github.com/opencontainers/go-digest"
 	"github.com/pterm/pterm"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type IS3Downloader interface {
@@ -36,8 +48,14 @@ type IDownloadManager interface {
 type IFileSystem interface {
 	Create(name string) (file *os.File, err error)
 	MkdirAll(name string, perm os.FileMode) error
+	Open(name string) (file *os.File, err error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
 }
 
+// PARTIAL_SUFFIX marks a download that is still being written.
+const PARTIAL_SUFFIX = ".partial"
+
 type (
 	S3Downloader      struct{}
 	S3DownloaderInput struct {
@@ -47,6 +65,14 @@ type (
 		Bucket         string
 		LocalDirectory string
 		Logger         lgr.ILogger
+		// Limiter is shared by every download of the run, nil for no limit
+		Limiter *throttle.Limiter
+		// Checkpoint skips objects a previous run downloaded completely
+		Checkpoint *checkpoint.Checkpoint
+		// Filter selects the objects to download, nil for all of them
+		Filter *Filter
+		// FromManifest downloads the manifest and only the blobs it references
+		FromManifest bool
 	}
 	osFS struct{}
 )
@@ -59,56 +85,254 @@ func (osFS) MkdirAll(name string, perm os.FileMode) error {
 	return os.MkdirAll(name, perm)
 }
 
+func (osFS) Open(name string) (*os.File, error) {
+	return os.Open(name)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
 func (d *S3Downloader) Download(ctx context.Context, input S3DownloaderInput) (
 	results []string, err error,
 ) {
-	downloaded := []string{}
+	objects := []s3types.Object{}
 	for input.Pager.HasMorePages() {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("download interrupted: %w", err)
+		}
 		page, err := input.Pager.NextPage(ctx)
 		if err != nil {
+			metrics.APIError("ListObjectsV2", err)
 			return nil, fmt.Errorf("failed to list objects: %w", err)
 		}
 		for _, object := range page.Contents {
-			if _, err := downloadToFile(input.Downloader, input.LocalDirectory, input.Bucket,
-				*object.Key, input.Filesystem, input.Logger); err != nil {
-				return nil, fmt.Errorf("failed to download object: %w", err)
+			if input.Filter.Match(*object.Key) {
+				objects = append(objects, object)
+			} else if input.Logger != nil {
+				input.Logger.Printfln(pterm.Debug, "%s filtered out, skipping", *object.Key)
 			}
-			downloaded = append(downloaded, filepath.Join(input.LocalDirectory, input.Bucket, *object.Key))
+		}
+	}
+
+	downloaded := []string{}
+	if input.FromManifest {
+		manifest, err := manifestObject(objects)
+		if err != nil {
+			return nil, err
+		}
+		file, err := d.downloadObject(ctx, input, manifest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download manifest: %w", err)
+		}
+		downloaded = append(downloaded, file)
+
+		objects, err = referencedObjects(input.Filesystem, file, *manifest.Key, objects, input.Logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, object := range objects {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("download interrupted: %w", err)
 		}
 
+		file, err := d.downloadObject(ctx, input, object)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download object: %w", err)
+		}
+		downloaded = append(downloaded, file)
 	}
 
 	return downloaded, nil
 }
 
+func (d *S3Downloader) downloadObject(ctx context.Context, input S3DownloaderInput, object s3types.Object) (
+	string, error,
+) {
+	file := filepath.Join(input.LocalDirectory, input.Bucket, *object.Key)
+	done := checkpoint.Object{Size: object.Size, ETag: aws.ToString(object.ETag)}
+	if input.Checkpoint.Downloaded(file, done) {
+		if input.Logger != nil {
+			input.Logger.Printfln(pterm.Info, "%s already downloaded, skipping", file)
+		}
+		return file, nil
+	}
+
+	if _, err := downloadToFile(ctx, input.Downloader, input.LocalDirectory, input.Bucket,
+		*object.Key, object.Size, input.Filesystem, input.Limiter, input.Logger); err != nil {
+		return "", err
+	}
+	input.Checkpoint.AddDownload(file, done)
+
+	return file, nil
+}
+
+// manifestObject finds the manifest among the listed objects.
+func manifestObject(objects []s3types.Object) (s3types.Object, error) {
+	found := []s3types.Object{}
+	for _, object := range objects {
+		if path.Base(*object.Key) == source.MANIFEST_FILE_NAME {
+			found = append(found, object)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return s3types.Object{}, fmt.Errorf("no %s found to download from", source.MANIFEST_FILE_NAME)
+	case 1:
+		return found[0], nil
+	default:
+		return s3types.Object{}, fmt.Errorf("found %d %s files, narrow the prefix to one image",
+			len(found), source.MANIFEST_FILE_NAME)
+	}
+}
+
+// referencedObjects keeps the listed objects the downloaded manifest refers
+// to, and fails before anything else is downloaded when some are missing.
+func referencedObjects(fs IFileSystem, manifestFile, manifestKey string, objects []s3types.Object,
+	logger lgr.ILogger,
+) ([]s3types.Object, error) {
+	fd, err := fs.Open(manifestFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer fd.Close()
+
+	manBuffer, err := ioutil.ReadAll(fd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	names, err := source.BlobFileNames(manBuffer, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := map[string]s3types.Object{}
+	for _, object := range objects {
+		listed[*object.Key] = object
+	}
+
+	referenced := []s3types.Object{}
+	missing := []string{}
+	for _, name := range names {
+		key := path.Join(path.Dir(manifestKey), name)
+		object, ok := listed[key]
+		if !ok {
+			missing = append(missing, key)
+			continue
+		}
+		referenced = append(referenced, object)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("manifest references blobs missing from the bucket: %s", strings.Join(missing, ", "))
+	}
+
+	return referenced, nil
+}
+
 func NewDownloader() S3Downloader {
 	return S3Downloader{}
 }
 
-func downloadToFile(downloader IDownloadManager, localDirectory, bucket, key string, fs IFileSystem, logger lgr.ILogger) (int64, error) {
+func downloadToFile(ctx context.Context, downloader IDownloadManager, localDirectory, bucket, key string,
+	expectedSize int64, fs IFileSystem, limiter *throttle.Limiter, logger lgr.ILogger,
+) (size int64, err error) {
+	ctx, span := tracing.Start(ctx, "s3.download",
+		attribute.String("s3.bucket", bucket), attribute.String("s3.key", key))
+	defer func() {
+		span.SetAttributes(attribute.Int64("size", size))
+		tracing.End(span, err)
+	}()
+
 	// Create the directories in the path
 	file := filepath.Join(localDirectory, bucket, key)
 	if err := fs.MkdirAll(filepath.Dir(file), 0o775); err != nil {
 		return 0, fmt.Errorf("failed to create directories for file: %w", err)
 	}
 
-	// Set up the local file
-	fd, err := fs.Create(file)
+	// Download next to the final file and only rename it into place once it
+	// is complete, so a file under its final name is always a whole one
+	partial := file + PARTIAL_SUFFIX
+	fd, err := fs.Create(partial)
 	if err != nil {
 		return 0, fmt.Errorf("failed to create file: %w", err)
 	}
-	defer fd.Close()
+	defer func() {
+		fd.Close()
+		if err == nil {
+			return
+		}
+		if rErr := fs.Remove(partial); rErr != nil && !os.IsNotExist(rErr) && logger != nil {
+			logger.Printfln(pterm.Warning, "error removing partial download %s: %v", partial, rErr)
+		}
+	}()
 
-	size, err := downloader.Download(context.TODO(),
-		fd,
+	size, err = downloader.Download(ctx,
+		limiter.WriterAt(ctx, fd),
 		&s3.GetObjectInput{Bucket: &bucket, Key: &key})
 	if err != nil {
+		metrics.APIError("GetObject", err)
 		return 0, fmt.Errorf("failed to download file: %w", err)
 	}
+	metrics.BytesDownloaded.Add(float64(size))
+
+	if err = fd.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err = fd.Close(); err != nil {
+		return 0, fmt.Errorf("failed to close file: %w", err)
+	}
+
+	if size != expectedSize {
+		err = fmt.Errorf("downloaded %d bytes of %s, expected %d", size, key, expectedSize)
+		return 0, err
+	}
+	if err = verifyBlobDigest(fs, partial, filepath.Base(file)); err != nil {
+		return 0, err
+	}
+
+	if err = fs.Rename(partial, file); err != nil {
+		return 0, fmt.Errorf("failed to move download into place: %w", err)
+	}
 
 	if logger != nil {
-		logger.Printfln(pterm.Info, "Downloaded %s (%s)", fd.Name(), humanize.Bytes(uint64(size)))
+		logger.Printfln(pterm.Info, "Downloaded %s (%s)", file, humanize.Bytes(uint64(size)))
 	}
 
 	return size, nil
 }
+
+// verifyBlobDigest checks the content of files named after a blob digest,
+// sha256__<hex>, other files such as the manifest are not checked.
+func verifyBlobDigest(fs IFileSystem, path, name string) error {
+	algorithm, encoded, ok := strings.Cut(name, "__")
+	if !ok {
+		return nil
+	}
+	expected, err := digest.Parse(algorithm + ":" + encoded)
+	if err != nil {
+		return nil
+	}
+
+	fd, err := fs.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open download for verification: %w", err)
+	}
+	defer fd.Close()
+
+	verifier := expected.Verifier()
+	if _, err := io.Copy(verifier, fd); err != nil {
+		return fmt.Errorf("failed to read download for verification: %w", err)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("downloaded blob %s does not match its digest", name)
+	}
+
+	return nil
+}
@@ -6,12 +6,16 @@ package download_test
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"docker-reassembler/pkg/download"
+	"docker-reassembler/pkg/utils"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	s3man "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
@@ -52,6 +56,9 @@ type mockFs struct{}
 var (
 	fsCreateFunc   func(name string) (file *os.File, err error)
 	fsMkdirAllFunc func(name string, perm os.FileMode) error
+	fsRemoveFunc   func(name string) error
+	fsOpenFunc     func(name string) (file *os.File, err error)
+	fsRenameFunc   func(oldpath, newpath string) error
 )
 
 func (m *mockFs) Create(name string) (file *os.File, err error) {
@@ -62,6 +69,21 @@ func (m *mockFs) MkdirAll(name string, perm os.FileMode) error {
 	return fsMkdirAllFunc(name, perm)
 }
 
+func (m *mockFs) Open(name string) (file *os.File, err error) {
+	return fsOpenFunc(name)
+}
+
+func (m *mockFs) Rename(oldpath, newpath string) error {
+	return fsRenameFunc(oldpath, newpath)
+}
+
+func (m *mockFs) Remove(name string) error {
+	if fsRemoveFunc == nil {
+		return nil
+	}
+	return fsRemoveFunc(name)
+}
+
 func TestDownloaderDownloadPagerError(t *testing.T) {
 	cases := []struct {
 		pager          download.IListObjectsV2Pager
@@ -235,7 +257,8 @@ func TestDownload(t *testing.T) {
 				KeyCount: 1,
 				Contents: []s3types.Object{
 					{
-						Key: aws.String("test-key"),
+						Key:  aws.String("test-key"),
+						Size: 123,
 					},
 				},
 			},
@@ -253,20 +276,226 @@ func TestDownload(t *testing.T) {
 	downloadFunc = func(downloader download.IDownloadManager, localDirectory, bucket, key string) (int64, error) {
 		return 123, nil
 	}
-	fsCreateFunc = func(name string) (file *os.File, err error) {
-		return &os.File{}, nil
+	useOsFs()
+
+	dir := t.TempDir()
+	results, err := dl.Download(context.Background(), download.S3DownloaderInput{
+		Pager:          pager,
+		Downloader:     &mockDownloadManager{},
+		Bucket:         "test-bucket",
+		LocalDirectory: dir,
+		Filesystem:     &mockFs{},
+	})
+
+	assert.Equal(t, []string{filepath.Join(dir, "test-bucket/test-key")}, results)
+	assert.Nil(t, err)
+	_, statErr := os.Stat(filepath.Join(dir, "test-bucket", "test-key"+download.PARTIAL_SUFFIX))
+	assert.True(t, os.IsNotExist(statErr), "partial file must be renamed")
+}
+
+func useOsFs() {
+	fsCreateFunc = os.Create
+	fsMkdirAllFunc = os.MkdirAll
+	fsOpenFunc = os.Open
+	fsRenameFunc = os.Rename
+	fsRemoveFunc = os.Remove
+}
+
+func TestDownloadVerification(t *testing.T) {
+	const blob = "sha256__2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	cases := []struct {
+		name    string
+		key     string
+		size    int64
+		content string
+		err     string
+	}{
+		{name: "blob", key: blob, size: 5, content: "hello"},
+		{name: "short", key: "manifest.json", size: 10, content: "hello", err: "downloaded 5 bytes of manifest.json, expected 10"},
+		{name: "corrupt blob", key: blob, size: 5, content: "world", err: "downloaded blob " + blob + " does not match its digest"},
 	}
-	fsMkdirAllFunc = func(name string, perm os.FileMode) error {
-		return nil
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			dl := download.NewDownloader()
+			dir := t.TempDir()
+			pages := []*s3.ListObjectsV2Output{
+				{Contents: []s3types.Object{{Key: aws.String(tt.key), Size: tt.size}}},
+			}
+			nextPageFunc = func(ctx context.Context, options ...func(*s3.Options)) (output *s3.ListObjectsV2Output, err error) {
+				output, pages = pages[0], pages[1:]
+				return output, nil
+			}
+			hasMorePagesFunc = func() bool { return len(pages) > 0 }
+			useOsFs()
+			downloadFunc = func(downloader download.IDownloadManager, localDirectory, bucket, key string) (int64, error) {
+				partial := filepath.Join(dir, "test-bucket", tt.key+download.PARTIAL_SUFFIX)
+				return int64(len(tt.content)), os.WriteFile(partial, []byte(tt.content), 0o644)
+			}
+
+			_, err := dl.Download(context.Background(), download.S3DownloaderInput{
+				Pager:          &mockListObjectsV2Pager{},
+				Downloader:     &mockDownloadManager{},
+				Bucket:         "test-bucket",
+				LocalDirectory: dir,
+				Filesystem:     &mockFs{},
+			})
+
+			entries, _ := os.ReadDir(filepath.Join(dir, "test-bucket"))
+			if tt.err == "" {
+				assert.Nil(t, err)
+				assert.Len(t, entries, 1)
+				assert.Equal(t, tt.key, entries[0].Name())
+				return
+			}
+			assert.EqualError(t, err, "failed to download object: "+tt.err)
+			assert.Empty(t, entries, "nothing should be left behind")
+		})
 	}
+}
+
+func TestDownloadCanceledRemovesPartialFile(t *testing.T) {
+	dl := download.NewDownloader()
+	dir := t.TempDir()
+
+	pager := &mockListObjectsV2Pager{
+		Pages: []*s3.ListObjectsV2Output{
+			{
+				KeyCount: 1,
+				Contents: []s3types.Object{
+					{
+						Key: aws.String("test-key"),
+					},
+				},
+			},
+		},
+	}
+	nextPageFunc = func(ctx context.Context, options ...func(*s3.Options)) (output *s3.ListObjectsV2Output, err error) {
+		output = pager.Pages[pager.PageNum]
+		pager.PageNum++
+		return output, nil
+	}
+	hasMorePagesFunc = func() bool { return pager.PageNum < len(pager.Pages) }
+	partial := filepath.Join(dir, "test-bucket", "test-key"+download.PARTIAL_SUFFIX)
+	partialCreated := false
+	downloadFunc = func(downloader download.IDownloadManager, localDirectory, bucket, key string) (int64, error) {
+		_, statErr := os.Stat(partial)
+		partialCreated = statErr == nil
+		return 0, context.Canceled
+	}
+	useOsFs()
 
 	results, err := dl.Download(context.Background(), download.S3DownloaderInput{
-		Pager:      pager,
-		Downloader: &mockDownloadManager{},
-		Bucket:     "test-bucket",
-		Filesystem: &mockFs{},
+		Pager:          pager,
+		Downloader:     &mockDownloadManager{},
+		Bucket:         "test-bucket",
+		LocalDirectory: dir,
+		Filesystem:     &mockFs{},
 	})
 
-	assert.Equal(t, []string{"test-bucket/test-key"}, results)
-	assert.Nil(t, err)
+	assert.Nil(t, results)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.True(t, partialCreated, "the download must write to the partial file")
+	_, statErr := os.Stat(partial)
+	assert.True(t, os.IsNotExist(statErr), "partial file must be removed")
+	_, statErr = os.Stat(filepath.Join(dir, "test-bucket", "test-key"))
+	assert.True(t, os.IsNotExist(statErr), "final file must never be created")
+}
+
+func TestDownloadInterrupted(t *testing.T) {
+	dl := download.NewDownloader()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	nextPageFunc = func(ctx context.Context, options ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+		return &s3.ListObjectsV2Output{Contents: []s3types.Object{{Key: aws.String("test-key")}}}, nil
+	}
+	hasMorePagesFunc = func() bool { return true }
+
+	_, err := dl.Download(ctx, download.S3DownloaderInput{Pager: &mockListObjectsV2Pager{}})
+
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestDownloadFromManifest(t *testing.T) {
+	config, layer := []byte(`{}`), []byte("layer")
+	configName := "sha256__" + fmt.Sprintf("%x", sha256.Sum256(config))
+	layerName := "sha256__" + fmt.Sprintf("%x", sha256.Sum256(layer))
+	manifest := []byte(fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+		"config": {"mediaType": "application/vnd.docker.container.image.v1+json", "size": %d, "digest": "%s"},
+		"layers": [{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "size": %d, "digest": "%s"}]
+	}`, len(config), strings.Replace(configName, "__", ":", 1), len(layer), strings.Replace(layerName, "__", ":", 1)))
+	contents := map[string][]byte{
+		"app/manifest.json": manifest,
+		"app/" + configName: config,
+		"app/" + layerName:  layer,
+	}
+
+	cases := []struct {
+		name    string
+		objects []string
+		results []string
+		err     string
+	}{
+		{
+			name:    "referenced blobs only",
+			objects: []string{"app/manifest.json", "app/" + configName, "app/" + layerName, "app/" + layerName + ".sha1", "app/old.marker"},
+			results: []string{"app/manifest.json", "app/" + configName, "app/" + layerName},
+		},
+		{
+			name:    "missing blob",
+			objects: []string{"app/manifest.json", "app/" + configName},
+			results: []string{"app/manifest.json"},
+			err:     "manifest references blobs missing from the bucket: app/" + layerName,
+		},
+		{
+			name:    "no manifest",
+			objects: []string{"app/" + configName},
+			err:     "no manifest.json found to download from",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			dl := download.NewDownloader()
+			dir := t.TempDir()
+			page := &s3.ListObjectsV2Output{}
+			for _, key := range tt.objects {
+				page.Contents = append(page.Contents, s3types.Object{Key: aws.String(key), Size: int64(len(contents[key]))})
+			}
+			pages := []*s3.ListObjectsV2Output{page}
+			nextPageFunc = func(ctx context.Context, options ...func(*s3.Options)) (output *s3.ListObjectsV2Output, err error) {
+				output, pages = pages[0], pages[1:]
+				return output, nil
+			}
+			hasMorePagesFunc = func() bool { return len(pages) > 0 }
+			useOsFs()
+			fetched := []string{}
+			downloadFunc = func(downloader download.IDownloadManager, bucket, key, _ string) (int64, error) {
+				fetched = append(fetched, key)
+				partial := filepath.Join(dir, bucket, key+download.PARTIAL_SUFFIX)
+				return int64(len(contents[key])), os.WriteFile(partial, contents[key], 0o644)
+			}
+
+			results, err := dl.Download(context.Background(), download.S3DownloaderInput{
+				Pager:          &mockListObjectsV2Pager{},
+				Downloader:     &mockDownloadManager{},
+				Bucket:         "test-bucket",
+				LocalDirectory: dir,
+				Filesystem:     &mockFs{},
+				FromManifest:   true,
+				Logger:         &utils.PtermLogger{},
+			})
+
+			assert.ElementsMatch(t, tt.results, fetched)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Len(t, results, len(tt.results))
+		})
+	}
 }
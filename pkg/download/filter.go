@@ -0,0 +1,89 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package download
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package download
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// REGEX_PREFIX marks a filter pattern as a regular expression rather than
+// a glob.
+const REGEX_PREFIX = "re:"
+
+// Filter selects which objects under the prefix are downloaded. A nil
+// Filter downloads everything.
+type Filter struct {
+	include []func(key string) bool
+	exclude []func(key string) bool
+}
+
+// NewFilter keeps the objects that match any include pattern (all objects
+// when there are none) and no exclude pattern. Globs are matched against
+// the object's file name, or the whole key when they contain a /, and
+// patterns starting with re: are regular expressions searched for in the
+// whole key.
+func NewFilter(include, exclude []string) (*Filter, error) {
+	compile := func(patterns []string) ([]func(string) bool, error) {
+		matchers := []func(string) bool{}
+		for _, p := range patterns {
+			if expr := strings.TrimPrefix(p, REGEX_PREFIX); expr != p {
+				re, err := regexp.Compile(expr)
+				if err != nil {
+					return nil, fmt.Errorf("invalid filter %q: %w", p, err)
+				}
+				matchers = append(matchers, re.MatchString)
+				continue
+			}
+
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("invalid filter %q: %w", p, err)
+			}
+			glob := p
+			matchers = append(matchers, func(key string) bool {
+				if !strings.Contains(glob, "/") {
+					key = path.Base(key)
+				}
+				ok, _ := path.Match(glob, key)
+				return ok
+			})
+		}
+		return matchers, nil
+	}
+
+	includes, err := compile(include)
+	if err != nil {
+		return nil, err
+	}
+	excludes, err := compile(exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filter{include: includes, exclude: excludes}, nil
+}
+
+func (f *Filter) Match(key string) bool {
+	if f == nil {
+		return true
+	}
+
+	matchAny := func(matchers []func(string) bool) bool {
+		for _, match := range matchers {
+			if match(key) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(f.include) > 0 && !matchAny(f.include) {
+		return false
+	}
+
+	return !matchAny(f.exclude)
+}
@@ -0,0 +1,52 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package docker-reassembler
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package download_test
+
+import (
+	"testing"
+
+	"docker-reassembler/pkg/download"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter(t *testing.T) {
+	cases := []struct {
+		name    string
+		include []string
+		exclude []string
+		key     string
+		match   bool
+	}{
+		{name: "no patterns", key: "app/sha256__abc", match: true},
+		{name: "glob include", include: []string{"sha256__*"}, key: "app/sha256__abc", match: true},
+		{name: "glob not included", include: []string{"sha256__*", "manifest.json"}, key: "app/old.marker", match: false},
+		{name: "glob exclude", exclude: []string{"*.sha1", "*.marker"}, key: "app/old.marker", match: false},
+		{name: "glob with directory", exclude: []string{"_uploads/*"}, key: "_uploads/sha256__abc", match: false},
+		{name: "regex exclude", exclude: []string{"re:/_uploads/"}, key: "app/_uploads/sha256__abc", match: false},
+		{name: "exclude wins", include: []string{"*"}, exclude: []string{"re:\\.sha1$"}, key: "app/sha256__abc.sha1", match: false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := download.NewFilter(tt.include, tt.exclude)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.match, filter.Match(tt.key))
+		})
+	}
+}
+
+func TestFilterInvalid(t *testing.T) {
+	_, err := download.NewFilter([]string{"re:("}, nil)
+	assert.NotNil(t, err)
+
+	_, err = download.NewFilter(nil, []string{"[a-"})
+	assert.NotNil(t, err)
+}
+
+func TestNilFilterMatchesEverything(t *testing.T) {
+	var filter *download.Filter
+	assert.True(t, filter.Match("anything"))
+}
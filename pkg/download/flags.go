@@ -0,0 +1,33 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package download
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package download
+
+import (
+	"github.com/spf13/pflag"
+)
+
+type Flags struct {
+	Include      []string
+	Exclude      []string
+	FromManifest bool
+}
+
+func (f *Flags) AddFlags(flags *pflag.FlagSet) {
+	flags.StringArrayVarP(&f.Include, "include", "", nil,
+		"only download objects matching this glob, or regular expression when prefixed with re:, can be repeated")
+	flags.StringArrayVarP(&f.Exclude, "exclude", "", nil,
+		"do not download objects matching this glob, or regular expression when prefixed with re:, can be repeated")
+	flags.BoolVarP(&f.FromManifest, "from-manifest", "", false,
+		"download manifest.json first and then only the config and layer blobs it references, failing early if any are missing")
+}
+
+// Filter compiles the --include and --exclude patterns.
+func (f *Flags) Filter() (*Filter, error) {
+	if len(f.Include) == 0 && len(f.Exclude) == 0 {
+		return nil, nil
+	}
+
+	return NewFilter(f.Include, f.Exclude)
+}
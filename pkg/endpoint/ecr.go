@@ -0,0 +1,73 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package endpoint
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package endpoint
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/spf13/pflag"
+)
+
+// ECRFlags selects the endpoints of the ECR and STS clients used for
+// uploads, for FIPS and VPC interface endpoints or a local stand-in.
+type ECRFlags struct {
+	Endpoint     string
+	STSEndpoint  string
+	UseFIPS      bool
+	UseDualStack bool
+}
+
+func (f *ECRFlags) AddFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&f.Endpoint, "ecr-endpoint", "", "", "URL of the ECR API to use instead of the regional endpoint, e.g. a VPC interface endpoint")
+	flags.StringVarP(&f.STSEndpoint, "sts-endpoint", "", "", "URL of the STS API used to assume roles and identify the ECR caller")
+	flags.BoolVarP(&f.UseFIPS, "use-fips", "", false, "use the FIPS endpoints of ECR and STS")
+	flags.BoolVarP(&f.UseDualStack, "use-dualstack", "", false, "use the dual-stack (IPv4 and IPv6) endpoints of ECR and STS")
+}
+
+// ConfigOptions returns the aws config load options for the flags, every
+// ECR and STS client made from the loaded config uses them.
+func (f *ECRFlags) ConfigOptions() ([]func(*config.LoadOptions) error, error) {
+	opts := []func(*config.LoadOptions) error{}
+	if f.UseFIPS {
+		opts = append(opts, config.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+	if f.UseDualStack {
+		opts = append(opts, config.WithUseDualStackEndpoint(aws.DualStackEndpointStateEnabled))
+	}
+
+	endpoints := map[string]string{}
+	for service, value := range map[string]struct{ flag, url string }{
+		ecr.ServiceID: {"--ecr-endpoint", f.Endpoint},
+		sts.ServiceID: {"--sts-endpoint", f.STSEndpoint},
+	} {
+		if value.url == "" {
+			continue
+		}
+		u, err := url.Parse(value.url)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid %s %q, expected a URL such as https://host:port", value.flag, value.url)
+		}
+		endpoints[service] = value.url
+	}
+
+	if len(endpoints) > 0 {
+		resolver := aws.EndpointResolverWithOptionsFunc(
+			func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+				if url, ok := endpoints[service]; ok {
+					return aws.Endpoint{URL: url, HostnameImmutable: true, SigningRegion: region}, nil
+				}
+				// Fall back to the default resolver for everything else
+				return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+			})
+		opts = append(opts, config.WithEndpointResolverWithOptions(resolver))
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package docker-reassembler
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package endpoint_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"docker-reassembler/pkg/auth"
+	"docker-reassembler/pkg/endpoint"
+	"docker-reassembler/pkg/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/stretchr/testify/assert"
+)
+
+const callerIdentity = `<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <GetCallerIdentityResult>
+    <Account>123456789012</Account>
+    <Arn>arn:aws:iam::123456789012:user/test</Arn>
+    <UserId>AIDTEST</UserId>
+  </GetCallerIdentityResult>
+</GetCallerIdentityResponse>`
+
+func loadConfig(t *testing.T, flags endpoint.ECRFlags) aws.Config {
+	opts, err := flags.ConfigOptions()
+	assert.Nil(t, err)
+
+	cfg, err := auth.LoadConfig(context.Background(), auth.Profile{
+		Region: "eu-west-2",
+		ConfigOptions: append(opts,
+			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider("id", "secret", "")),
+			config.WithRetryer(func() aws.Retryer { return aws.NopRetryer{} })),
+	}, &utils.PtermLogger{})
+	assert.Nil(t, err)
+
+	return cfg
+}
+
+func TestECRAndSTSStandIn(t *testing.T) {
+	requests := []string{}
+	standIn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.Header.Get("X-Amz-Target"); target != "" {
+			requests = append(requests, target)
+			fmt.Fprint(w, `{"repositories": [{"repositoryName": "app"}]}`)
+			return
+		}
+		requests = append(requests, "sts")
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprint(w, callerIdentity)
+	}))
+	defer standIn.Close()
+
+	cfg := loadConfig(t, endpoint.ECRFlags{Endpoint: standIn.URL, STSEndpoint: standIn.URL})
+
+	id, err := auth.CallerIdentity(context.Background(), cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, "123456789012", aws.ToString(id.Account))
+
+	out, err := ecr.NewFromConfig(cfg).DescribeRepositories(context.Background(), &ecr.DescribeRepositoriesInput{})
+	assert.Nil(t, err)
+	assert.Equal(t, "app", aws.ToString(out.Repositories[0].RepositoryName))
+
+	assert.Equal(t, []string{"sts", "AmazonEC2ContainerRegistry_V20150921.DescribeRepositories"}, requests)
+}
+
+// hostRecorder records the host each request is sent to without sending it.
+type hostRecorder struct {
+	hosts []string
+}
+
+func (h *hostRecorder) Do(r *http.Request) (*http.Response, error) {
+	h.hosts = append(h.hosts, r.URL.Host)
+	return nil, fmt.Errorf("not sent")
+}
+
+func TestECRFIPSAndDualStack(t *testing.T) {
+	cases := []struct {
+		name  string
+		flags endpoint.ECRFlags
+		hosts []string
+	}{
+		{name: "default", hosts: []string{"sts.eu-west-2.amazonaws.com", "api.ecr.eu-west-2.amazonaws.com"}},
+		{name: "fips", flags: endpoint.ECRFlags{UseFIPS: true}, hosts: []string{"sts-fips.eu-west-2.amazonaws.com", "ecr-fips.eu-west-2.amazonaws.com"}},
+		{name: "dualstack", flags: endpoint.ECRFlags{UseDualStack: true}, hosts: []string{"sts.eu-west-2.api.aws", "api.ecr.eu-west-2.api.aws"}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &hostRecorder{}
+			cfg := loadConfig(t, tt.flags)
+			cfg.HTTPClient = recorder
+
+			_, err := auth.CallerIdentity(context.Background(), cfg)
+			assert.NotNil(t, err)
+			_, err = ecr.NewFromConfig(cfg).DescribeRepositories(context.Background(), &ecr.DescribeRepositoriesInput{})
+			assert.NotNil(t, err)
+
+			assert.Equal(t, tt.hosts, recorder.hosts)
+		})
+	}
+}
+
+func TestECRFlagsInvalid(t *testing.T) {
+	_, err := (&endpoint.ECRFlags{Endpoint: "vpce-123.api.ecr.eu-west-2.vpce.amazonaws.com"}).ConfigOptions()
+	assert.EqualError(t, err, `invalid --ecr-endpoint "vpce-123.api.ecr.eu-west-2.vpce.amazonaws.com", expected a URL such as https://host:port`)
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package endpoint
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package endpoint
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/spf13/pflag"
+)
+
+// S3Flags points the S3 client at an S3 compatible store such as MinIO or
+// Ceph RGW instead of AWS.
+type S3Flags struct {
+	Endpoint  string
+	PathStyle bool
+	CABundle  string
+}
+
+func (f *S3Flags) AddFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&f.Endpoint, "s3-endpoint", "", "", "URL of an S3 compatible store to use instead of AWS, e.g. https://minio.internal:9000")
+	flags.BoolVarP(&f.PathStyle, "s3-path-style", "", false, "address buckets as https://host/bucket rather than https://bucket.host, most S3 compatible stores need this")
+	flags.StringVarP(&f.CABundle, "s3-ca-bundle", "", "", "PEM file of extra certificate authorities to trust for S3, for stores with a private CA")
+}
+
+// Options returns the S3 client options for the flags.
+func (f *S3Flags) Options() (func(*s3.Options), error) {
+	if f.Endpoint != "" {
+		u, err := url.Parse(f.Endpoint)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid --s3-endpoint %q, expected a URL such as https://host:port", f.Endpoint)
+		}
+	}
+
+	var httpClient *awshttp.BuildableClient
+	if f.CABundle != "" {
+		pool, err := CertPool(f.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --s3-ca-bundle: %w", err)
+		}
+		httpClient = awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+			if tr.TLSClientConfig == nil {
+				tr.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+			}
+			tr.TLSClientConfig.RootCAs = pool
+		})
+	}
+
+	return func(o *s3.Options) {
+		if f.Endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(f.Endpoint, func(e *aws.Endpoint) {
+				e.HostnameImmutable = f.PathStyle
+			})
+		}
+		o.UsePathStyle = f.PathStyle
+		if httpClient != nil {
+			o.HTTPClient = httpClient
+		}
+	}, nil
+}
+
+// CertPool adds the certificates in a PEM file to the system pool.
+func CertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %q: %w", path, err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %q", path)
+	}
+
+	return pool, nil
+}
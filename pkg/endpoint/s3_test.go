@@ -0,0 +1,85 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package docker-reassembler
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package endpoint_test
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"docker-reassembler/pkg/endpoint"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+// newStore starts a TLS server standing in for an S3 compatible store and
+// writes its certificate to a CA bundle.
+func newStore(t *testing.T) (*httptest.Server, string, *[]string) {
+	paths := []string{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Host+r.URL.Path)
+		w.Header().Set("Content-Length", "5")
+	}))
+	t.Cleanup(server.Close)
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.Nil(t, ioutil.WriteFile(bundle, cert, 0o600))
+
+	return server, bundle, &paths
+}
+
+func newClient(t *testing.T, flags endpoint.S3Flags) *s3.Client {
+	options, err := flags.Options()
+	assert.Nil(t, err)
+
+	return s3.NewFromConfig(aws.Config{
+		Region:           "us-east-1",
+		RetryMaxAttempts: 1,
+		Credentials:      credentials.NewStaticCredentialsProvider("minio", "minio123", ""),
+	}, options)
+}
+
+func TestS3PathStyleEndpoint(t *testing.T) {
+	server, bundle, paths := newStore(t)
+	client := newClient(t, endpoint.S3Flags{Endpoint: server.URL, PathStyle: true, CABundle: bundle})
+
+	out, err := client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String("images"),
+		Key:    aws.String("app/manifest.json"),
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), out.ContentLength)
+	assert.Equal(t, []string{server.Listener.Addr().String() + "/images/app/manifest.json"}, *paths)
+}
+
+func TestS3EndpointUntrustedCA(t *testing.T) {
+	server, _, paths := newStore(t)
+	client := newClient(t, endpoint.S3Flags{Endpoint: server.URL, PathStyle: true})
+
+	_, err := client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String("images"),
+		Key:    aws.String("app/manifest.json"),
+	})
+
+	assert.NotNil(t, err)
+	assert.Empty(t, *paths)
+}
+
+func TestS3FlagsInvalid(t *testing.T) {
+	_, err := (&endpoint.S3Flags{Endpoint: "minio:9000"}).Options()
+	assert.NotNil(t, err)
+
+	_, err = (&endpoint.S3Flags{CABundle: filepath.Join(t.TempDir(), "missing.pem")}).Options()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,148 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package export
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package export
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+
+	dkr "docker-reassembler/pkg/docker"
+	lgr "docker-reassembler/pkg/logger"
+	"docker-reassembler/pkg/source"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/dustin/go-humanize"
+	"github.com/opencontainers/go-digest"
+	"github.com/pterm/pterm"
+)
+
+type IUploader interface {
+	Upload(ctx context.Context, input *s3.PutObjectInput,
+		opts ...func(*manager.Uploader)) (*manager.UploadOutput, error)
+}
+
+type ExportInput struct {
+	Source   source.ISource
+	Uploader IUploader
+	Bucket   string
+	Prefix   string
+	Logger   lgr.ILogger
+}
+
+// Export writes an image to an S3 prefix in the layout the downloader
+// consumes: one sha256__<hex> object per blob and a manifest.json. The
+// manifest is written last, so a prefix without one is an incomplete export.
+func Export(ctx context.Context, input *ExportInput) ([]string, error) {
+	manBuffer, err := input.Source.Manifest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	manifest, err := dkr.FromBlob(manBuffer, input.Logger)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing manifest from blob: %w", err)
+	}
+
+	digests := []digest.Digest{manifest.ConfigInfo().Digest}
+	for _, layer := range manifest.LayerInfos() {
+		digests = append(digests, layer.Digest)
+	}
+
+	keys := []string{}
+	seen := map[digest.Digest]bool{}
+	for _, dgst := range digests {
+		if seen[dgst] {
+			continue
+		}
+		seen[dgst] = true
+
+		key, err := exportBlob(ctx, input, dgst)
+		if err != nil {
+			return nil, fmt.Errorf("error exporting blob %s: %w", dgst, err)
+		}
+		keys = append(keys, key)
+	}
+
+	key := path.Join(input.Prefix, source.MANIFEST_FILE_NAME)
+	_, err = input.Uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(input.Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(manBuffer),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error writing s3://%s/%s: %w", input.Bucket, key, err)
+	}
+	input.Logger.Printfln(pterm.Info, "Exported s3://%s/%s", input.Bucket, key)
+
+	return append(keys, key), nil
+}
+
+func exportBlob(ctx context.Context, input *ExportInput, dgst digest.Digest) (string, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", fmt.Errorf("invalid digest: %w", err)
+	}
+
+	size, err := input.Source.BlobSize(ctx, dgst.String())
+	if err != nil {
+		return "", err
+	}
+
+	// The blob is hashed on its way through and a mismatch fails the last
+	// read, so the uploader abandons the object rather than storing a
+	// corrupt blob under its content addressed key
+	body := &verifyingReader{
+		r:        source.NewBlobReader(ctx, input.Source, dgst.String(), size),
+		digest:   dgst,
+		verifier: dgst.Verifier(),
+		size:     size,
+	}
+
+	key := path.Join(input.Prefix, source.BlobFileName(dgst.String()))
+	_, err = input.Uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(input.Bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error writing s3://%s/%s: %w", input.Bucket, key, err)
+	}
+
+	input.Logger.Printfln(pterm.Info, "Exported s3://%s/%s (%s)", input.Bucket, key, humanize.Bytes(uint64(size)))
+
+	return key, nil
+}
+
+// verifyingReader returns an error instead of the end of the blob when
+// what was read does not match the expected size and digest.
+type verifyingReader struct {
+	r        io.Reader
+	digest   digest.Digest
+	verifier digest.Verifier
+	size     int64
+	n        int64
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.n += int64(n)
+	v.verifier.Write(p[:n])
+	if err != io.EOF {
+		return n, err
+	}
+
+	if v.n != v.size {
+		return n, fmt.Errorf("blob %s holds %d bytes, expected %d", v.digest, v.n, v.size)
+	}
+	if !v.verifier.Verified() {
+		return n, fmt.Errorf("blob does not match digest %s", v.digest)
+	}
+
+	return n, io.EOF
+}
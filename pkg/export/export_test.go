@@ -0,0 +1,109 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package export_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package export_test
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"docker-reassembler/pkg/export"
+	"docker-reassembler/pkg/internal/testsource"
+	"docker-reassembler/pkg/source"
+	"docker-reassembler/pkg/utils"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockUploader struct {
+	objects map[string][]byte
+}
+
+func (m *mockUploader) Upload(ctx context.Context, input *s3.PutObjectInput,
+	opts ...func(*manager.Uploader),
+) (*manager.UploadOutput, error) {
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.objects[*input.Key] = body
+	return &manager.UploadOutput{}, nil
+}
+
+func TestExport(t *testing.T) {
+	src := testsource.NewImage([]byte(`{"architecture":"amd64"}`), []byte("layer-bytes"))
+	uploader := &mockUploader{objects: map[string][]byte{}}
+
+	keys, err := export.Export(context.Background(), &export.ExportInput{
+		Source:   src,
+		Uploader: uploader,
+		Bucket:   "bucket",
+		Prefix:   "app/1.0",
+		Logger:   &utils.PtermLogger{},
+	})
+
+	assert.Nil(t, err)
+	assert.Len(t, keys, 3)
+	assert.Equal(t, "app/1.0/manifest.json", keys[2], "manifest is written last")
+	assert.Equal(t, src.Raw, uploader.objects["app/1.0/manifest.json"])
+	assert.Equal(t, []byte("layer-bytes"),
+		uploader.objects["app/1.0/"+"sha256__"+digest.FromBytes([]byte("layer-bytes")).Encoded()])
+}
+
+func TestExportDigestMismatch(t *testing.T) {
+	src := testsource.NewImage([]byte(`{"architecture":"amd64"}`), []byte("layer-bytes"))
+	for k := range src.Blobs {
+		if string(src.Blobs[k]) == "layer-bytes" {
+			src.Blobs[k] = []byte("LAYER-BYTES")
+		}
+	}
+	uploader := &mockUploader{objects: map[string][]byte{}}
+
+	_, err := export.Export(context.Background(), &export.ExportInput{
+		Source:   src,
+		Uploader: uploader,
+		Bucket:   "bucket",
+		Prefix:   "app/1.0",
+		Logger:   &utils.PtermLogger{},
+	})
+
+	assert.NotNil(t, err)
+	_, ok := uploader.objects["app/1.0/manifest.json"]
+	assert.False(t, ok, "manifest must not be written for a corrupt export")
+	_, ok = uploader.objects["app/1.0/"+"sha256__"+digest.FromBytes([]byte("layer-bytes")).Encoded()]
+	assert.False(t, ok, "a corrupt blob must not be stored under its digest")
+}
+
+func TestExportSizeMismatch(t *testing.T) {
+	src := testsource.NewImage([]byte(`{"architecture":"amd64"}`), []byte("layer-bytes"))
+	layerKey := digest.FromBytes([]byte("layer-bytes")).String()
+	src.Blobs[layerKey] = []byte("layer")
+	uploader := &mockUploader{objects: map[string][]byte{}}
+
+	_, err := export.Export(context.Background(), &export.ExportInput{
+		Source:   &sizedSource{Memory: src, size: int64(len("layer-bytes"))},
+		Uploader: uploader,
+		Bucket:   "bucket",
+		Prefix:   "app/1.0",
+		Logger:   &utils.PtermLogger{},
+	})
+
+	assert.NotNil(t, err)
+	_, ok := uploader.objects["app/1.0/"+source.BlobFileName(layerKey)]
+	assert.False(t, ok, "a truncated blob must not be stored under its digest")
+}
+
+// sizedSource reports every blob as size bytes long whatever it holds.
+type sizedSource struct {
+	*testsource.Memory
+	size int64
+}
+
+func (s *sizedSource) BlobSize(ctx context.Context, dgst string) (int64, error) {
+	return s.size, nil
+}
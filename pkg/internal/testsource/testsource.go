@@ -0,0 +1,59 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package testsource
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package testsource
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Memory is an image held in memory, blobs are keyed by digest.
+type Memory struct {
+	Raw   []byte
+	Blobs map[string][]byte
+}
+
+func (m *Memory) Manifest(ctx context.Context) ([]byte, error) {
+	return m.Raw, nil
+}
+
+func (m *Memory) BlobSize(ctx context.Context, dgst string) (int64, error) {
+	return int64(len(m.Blobs[dgst])), nil
+}
+
+func (m *Memory) ReadBlobAt(ctx context.Context, dgst string, p []byte, off int64) (int, error) {
+	blob := m.Blobs[dgst]
+	if off >= int64(len(blob)) {
+		return 0, io.EOF
+	}
+	n := copy(p, blob[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// NewImage is a docker image with a single layer.
+func NewImage(config, layer []byte) *Memory {
+	configDigest := digest.FromBytes(config)
+	layerDigest := digest.FromBytes(layer)
+	manifest := fmt.Sprintf(`{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+  "config": {"mediaType": "application/vnd.docker.container.image.v1+json", "size": %d, "digest": %q},
+  "layers": [{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "size": %d, "digest": %q}]
+}`, len(config), configDigest, len(layer), layerDigest)
+
+	return &Memory{
+		Raw: []byte(manifest),
+		Blobs: map[string][]byte{
+			configDigest.String(): config,
+			layerDigest.String():  layer,
+		},
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package metrics
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/pterm/pterm"
+)
+
+const NAMESPACE = "docker_reassembler"
+
+// Registry holds every metric of the tool. Metrics are always recorded, they
+// are only exposed when Serve is called.
+var Registry = prometheus.NewRegistry()
+
+var (
+	BytesDownloaded = newCounter("downloaded_bytes_total", "Bytes downloaded from S3.")
+	BytesUploaded   = newCounter("uploaded_bytes_total", "Layer bytes accepted by ECR.")
+	LayersSkipped   = newCounter("layers_skipped_total", "Layers not uploaded because the registry already held them.")
+	PartsRetried    = newCounter("parts_retried_total", "Layer part uploads that were retried.")
+	APIErrors       = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "api_errors_total",
+		Help:      "Failed AWS API calls by operation and error code.",
+	}, []string{"operation", "code"})
+	Images = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "images_total",
+		Help:      "Images put to a registry by status, completed or failed.",
+	}, []string{"status"})
+	LayerUploadDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "layer_upload_duration_seconds",
+		Help:      "Time taken to upload a layer to ECR.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	})
+)
+
+func init() {
+	Registry.MustRegister(BytesDownloaded, BytesUploaded, LayersSkipped, PartsRetried,
+		APIErrors, Images, LayerUploadDuration,
+		collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+func newCounter(name, help string) prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{Namespace: NAMESPACE, Name: name, Help: help})
+}
+
+// APIError counts a failed call, the code is the AWS error code when there
+// is one.
+func APIError(operation string, err error) {
+	if err == nil {
+		return
+	}
+
+	code := "unknown"
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		code = apiErr.ErrorCode()
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		code = "canceled"
+	}
+	APIErrors.WithLabelValues(operation, code).Inc()
+}
+
+func ImageCompleted(err error) {
+	status := "completed"
+	if err != nil {
+		status = "failed"
+	}
+	Images.WithLabelValues(status).Inc()
+}
+
+// Serve exposes /metrics on addr until the returned server is shut down.
+func Serve(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: listener.Addr().String(), Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			pterm.Error.Printfln("metrics server error: %v", err)
+		}
+	}()
+	pterm.Info.Printfln("serving metrics on http://%s/metrics", server.Addr)
+
+	return server, nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package metrics_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"docker-reassembler/pkg/metrics"
+
+	"github.com/aws/smithy-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIError(t *testing.T) {
+	metrics.APIError("PutImage", &smithy.GenericAPIError{Code: "ThrottlingException"})
+	metrics.APIError("PutImage", errors.New("connection reset"))
+	metrics.APIError("PutImage", nil)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.APIErrors.WithLabelValues("PutImage", "ThrottlingException")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.APIErrors.WithLabelValues("PutImage", "unknown")))
+}
+
+func TestServe(t *testing.T) {
+	server, err := metrics.Serve("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Shutdown(context.Background())
+
+	metrics.ImageCompleted(errors.New("failed"))
+	metrics.BytesUploaded.Add(42)
+
+	resp, err := http.Get("http://" + server.Addr + "/metrics")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, strings.Contains(string(body), "docker_reassembler_uploaded_bytes_total 42"))
+	assert.True(t, strings.Contains(string(body), `docker_reassembler_images_total{status="failed"} 1`))
+}
@@ -0,0 +1,34 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package report
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package report
+
+import (
+	"github.com/pterm/pterm"
+	"github.com/spf13/pflag"
+)
+
+type Flags struct {
+	Path   string
+	Format string
+}
+
+func (f *Flags) AddFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&f.Path, "report", "", "", "write a report of the migrated images to this file")
+	flags.StringVarP(&f.Format, "report-format", "", "", "report format, json or junit, defaults to junit for .xml files and json otherwise")
+}
+
+// Write writes the report when --report is set.
+func (f *Flags) Write(r *Report) error {
+	if f.Path == "" {
+		return nil
+	}
+
+	if err := r.Write(f.Path, f.Format); err != nil {
+		return err
+	}
+	pterm.Info.Printfln("report written to %s", f.Path)
+
+	return nil
+}
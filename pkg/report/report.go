@@ -0,0 +1,252 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package report
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package report
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"docker-reassembler/pkg/upload"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ecrTypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	FORMAT_JSON  = "json"
+	FORMAT_JUNIT = "junit"
+
+	STATUS_SUCCEEDED = "succeeded"
+	STATUS_FAILED    = "failed"
+)
+
+type Layer struct {
+	Digest string `json:"digest"`
+	Bytes  int64  `json:"bytes"`
+	Parts  int    `json:"parts"`
+	// PartSizes are the sizes the parts were sent in, in order
+	PartSizes []int64       `json:"partSizes,omitempty"`
+	Retries   int           `json:"retries"`
+	Duration  time.Duration `json:"durationNanos"`
+	Skipped   bool          `json:"skipped"`
+}
+
+// Image is the outcome of migrating one image to one registry.
+type Image struct {
+	Source         string        `json:"source"`
+	Region         string        `json:"region,omitempty"`
+	RegistryId     string        `json:"registryId"`
+	RepositoryName string        `json:"repositoryName"`
+	Tags           []string      `json:"tags"`
+	ManifestDigest string        `json:"manifestDigest,omitempty"`
+	Status         string        `json:"status"`
+	Error          string        `json:"error,omitempty"`
+	Duration       time.Duration `json:"durationNanos"`
+	Layers         []Layer       `json:"layers"`
+}
+
+type Report struct {
+	mu         sync.Mutex
+	Command    string    `json:"command"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Images     []Image   `json:"images"`
+}
+
+func New(command string) *Report {
+	return &Report{Command: command, StartedAt: time.Now().UTC(), Images: []Image{}}
+}
+
+// AddUpload records the outcome of an upload, source describes where the
+// image was read from, e.g. s3://bucket/prefix.
+func (r *Report) AddUpload(source, region string, input *upload.UploadInput, img *ecrTypes.Image,
+	duration time.Duration, err error,
+) {
+	image := Image{
+		Source:         source,
+		Region:         region,
+		RegistryId:     input.RegistryId,
+		RepositoryName: input.RepositoryName,
+		Tags:           []string{input.Tag},
+		Status:         STATUS_SUCCEEDED,
+		Duration:       duration,
+		Layers:         []Layer{},
+	}
+	if err != nil {
+		image.Status = STATUS_FAILED
+		image.Error = err.Error()
+	}
+	if img != nil && img.ImageId != nil {
+		image.ManifestDigest = aws.ToString(img.ImageId.ImageDigest)
+	}
+	if input.Stats != nil {
+		for _, layer := range input.Stats.Layers {
+			image.Layers = append(image.Layers, Layer{
+				Digest:    layer.Digest,
+				Bytes:     layer.Bytes,
+				Parts:     len(layer.PartSizes),
+				PartSizes: layer.PartSizes,
+				Retries:   layer.Retries,
+				Duration:  layer.Duration,
+				Skipped:   layer.Skipped,
+			})
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Images = append(r.Images, image)
+}
+
+// AddFailure records an image that failed before any upload was attempted.
+func (r *Report) AddFailure(source, repositoryName, tag string, err error) {
+	image := Image{
+		Source:         source,
+		RepositoryName: repositoryName,
+		Tags:           []string{tag},
+		Status:         STATUS_FAILED,
+		Error:          err.Error(),
+		Layers:         []Layer{},
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Images = append(r.Images, image)
+}
+
+func (r *Report) Failures() int {
+	failures := 0
+	for _, image := range r.Images {
+		if image.Status != STATUS_SUCCEEDED {
+			failures++
+		}
+	}
+	return failures
+}
+
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit writes one test case per image, named after its tags and
+// classed by registry and repository.
+func (r *Report) WriteJUnit(w io.Writer) error {
+	suite := junitTestSuite{
+		Name:      r.Command,
+		Tests:     len(r.Images),
+		Failures:  r.Failures(),
+		Time:      seconds(r.FinishedAt.Sub(r.StartedAt)),
+		Timestamp: r.StartedAt.Format(time.RFC3339),
+	}
+
+	for _, image := range r.Images {
+		out := &strings.Builder{}
+		fmt.Fprintf(out, "source: %s\nmanifest digest: %s\n", image.Source, image.ManifestDigest)
+		for _, layer := range image.Layers {
+			if layer.Skipped {
+				fmt.Fprintf(out, "layer %s: skipped\n", layer.Digest)
+				continue
+			}
+			fmt.Fprintf(out, "layer %s: %s in %d part(s), %d retries, %s\n", layer.Digest,
+				humanize.IBytes(uint64(layer.Bytes)), layer.Parts, layer.Retries, layer.Duration.Round(time.Millisecond))
+		}
+
+		testCase := junitTestCase{
+			ClassName: fmt.Sprintf("%s.%s", image.RegistryId, image.RepositoryName),
+			Name:      strings.Join(image.Tags, ","),
+			Time:      seconds(image.Duration),
+			SystemOut: out.String(),
+		}
+		if image.Status != STATUS_SUCCEEDED {
+			testCase.Failure = &junitFailure{Message: image.Status, Text: image.Error}
+		}
+		suite.Cases = append(suite.Cases, testCase)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// Write finishes the report and writes it to path, the format is taken from
+// the extension when it is empty.
+func (r *Report) Write(path, format string) error {
+	r.FinishedAt = time.Now().UTC()
+
+	if format == "" {
+		format = FORMAT_JSON
+		if strings.EqualFold(filepath.Ext(path), ".xml") {
+			format = FORMAT_JUNIT
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating report %q: %w", path, err)
+	}
+	defer f.Close()
+
+	switch format {
+	case FORMAT_JSON:
+		err = r.WriteJSON(f)
+	case FORMAT_JUNIT:
+		err = r.WriteJUnit(f)
+	default:
+		return fmt.Errorf("unknown report format %q, expected %s or %s", format, FORMAT_JSON, FORMAT_JUNIT)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing report %q: %w", path, err)
+	}
+
+	return f.Close()
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package report_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package report_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"docker-reassembler/pkg/report"
+	"docker-reassembler/pkg/upload"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ecrTypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func newReport() *report.Report {
+	r := report.New("assemble")
+	r.AddUpload("s3://bucket/app/1.0", "eu-west-2", &upload.UploadInput{
+		RegistryId:     "123456789012",
+		RepositoryName: "app",
+		Tag:            "1.0",
+		Stats: &upload.Stats{Layers: []upload.LayerStats{
+			{Digest: "sha256:aaa", Bytes: 10, PartSizes: []int64{10}, Duration: time.Second},
+			{Digest: "sha256:bbb", Skipped: true},
+		}},
+	}, &ecrTypes.Image{ImageId: &ecrTypes.ImageIdentifier{ImageDigest: aws.String("sha256:ccc")}}, time.Second, nil)
+	r.AddUpload("s3://bucket/app/1.0", "us-east-1", &upload.UploadInput{
+		RegistryId:     "210987654321",
+		RepositoryName: "app",
+		Tag:            "1.0",
+	}, nil, time.Second, errors.New("access denied"))
+	return r
+}
+
+func TestWriteJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.Nil(t, newReport().WriteJSON(buf))
+
+	decoded := report.Report{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Len(t, decoded.Images, 2)
+	assert.Equal(t, "sha256:ccc", decoded.Images[0].ManifestDigest)
+	assert.Equal(t, []int64{10}, decoded.Images[0].Layers[0].PartSizes)
+	assert.True(t, decoded.Images[0].Layers[1].Skipped)
+	assert.Equal(t, report.STATUS_FAILED, decoded.Images[1].Status)
+	assert.Equal(t, "access denied", decoded.Images[1].Error)
+}
+
+func TestWriteJUnit(t *testing.T) {
+	buf := &bytes.Buffer{}
+	r := newReport()
+	assert.Equal(t, 1, r.Failures())
+	assert.Nil(t, r.WriteJUnit(buf))
+
+	out := buf.String()
+	assert.True(t, strings.Contains(out, `<testsuite name="assemble" tests="2" failures="1"`))
+	assert.True(t, strings.Contains(out, `<testcase classname="210987654321.app" name="1.0"`))
+	assert.True(t, strings.Contains(out, `<failure message="failed">access denied</failure>`))
+}
+
+func TestAddFailure(t *testing.T) {
+	r := report.New("assemble")
+	r.AddFailure("s3://bucket/app/1.0", "app", "1.0", errors.New("no such bucket"))
+	assert.Equal(t, 1, r.Failures())
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, r.WriteJUnit(buf))
+	assert.True(t, strings.Contains(buf.String(), `<failure message="failed">no such bucket</failure>`))
+}
@@ -0,0 +1,167 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package retry
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"docker-reassembler/pkg/auth"
+	lgr "docker-reassembler/pkg/logger"
+	"docker-reassembler/pkg/metrics"
+
+	"github.com/aws/smithy-go"
+	"github.com/pterm/pterm"
+)
+
+const (
+	DEFAULT_MAX_ATTEMPTS = 5
+	DEFAULT_BASE_DELAY   = time.Millisecond * 500
+	DEFAULT_MAX_DELAY    = time.Second * 30
+)
+
+// Policy controls how often and how patiently a failed call is retried.
+// Delays grow exponentially from BaseDelay up to MaxDelay with full jitter.
+type Policy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+func DefaultPolicy() Policy {
+	return Policy{
+		MaxAttempts: DEFAULT_MAX_ATTEMPTS,
+		BaseDelay:   DEFAULT_BASE_DELAY,
+		MaxDelay:    DEFAULT_MAX_DELAY,
+	}
+}
+
+// Backoff returns how long to wait after the given (1 based) failed attempt.
+func (p Policy) Backoff(attempt int) time.Duration {
+	if p.BaseDelay <= 0 {
+		return 0
+	}
+
+	ceiling := float64(p.BaseDelay) * math.Pow(2, float64(attempt-1))
+	if p.MaxDelay > 0 && ceiling > float64(p.MaxDelay) {
+		ceiling = float64(p.MaxDelay)
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// Do calls fn until it succeeds, returns an error that is not retryable or
+// the policy runs out of attempts. It returns the number of attempts made.
+func Do(ctx context.Context, policy Policy, logger lgr.ILogger, operation string,
+	fn func() error,
+) (int, error) {
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil {
+			return attempt, nil
+		}
+		metrics.APIError(operation, err)
+
+		if attempt >= maxAttempts || !IsRetryable(err) || ctx.Err() != nil {
+			return attempt, err
+		}
+
+		delay := policy.Backoff(attempt)
+		if logger != nil {
+			logger.Printfln(pterm.Warning, "%s failed (attempt %d of %d), retrying in %s: %v",
+				operation, attempt, maxAttempts, delay.Round(time.Millisecond), err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return attempt, fmt.Errorf("%s retry cancelled: %w", operation, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
+
+// permanentError stops Do from retrying an error it would otherwise retry,
+// while errors.Is and errors.As still see the error it wraps.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks err as not worth retrying, for callers that handle it
+// better themselves.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// IsRetryable classifies throttling, server side (5xx), network and expired
+// credential errors as worth retrying, unless they are marked Permanent.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var permanent *permanentError
+	if errors.As(err, &permanent) {
+		return false
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if auth.IsExpiredTokenError(err) {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "Throttling", "ThrottlingException", "ThrottledException", "RequestThrottled",
+			"RequestThrottledException", "TooManyRequestsException", "RequestLimitExceeded",
+			"SlowDown", "ServerException", "InternalError", "InternalFailure",
+			"ServiceUnavailable", "ServiceUnavailableException", "RequestTimeout",
+			"RequestTimeoutException":
+			return true
+		}
+	}
+
+	var statusErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &statusErr) {
+		code := statusErr.HTTPStatusCode()
+		if code == 429 || code >= 500 {
+			return true
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
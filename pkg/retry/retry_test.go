@@ -0,0 +1,85 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package retry_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package retry_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"docker-reassembler/pkg/retry"
+
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{err: nil, retryable: false},
+		{err: fmt.Errorf("boom"), retryable: false},
+		{err: &smithy.GenericAPIError{Code: "ThrottlingException"}, retryable: true},
+		{err: &smithy.GenericAPIError{Code: "ServerException"}, retryable: true},
+		{err: &smithy.GenericAPIError{Code: "ExpiredTokenException"}, retryable: true},
+		{err: &smithy.GenericAPIError{Code: "LayerAlreadyExistsException"}, retryable: false},
+		{err: fmt.Errorf("read: %w", io.ErrUnexpectedEOF), retryable: true},
+		{err: fmt.Errorf("wrapped: %w", context.Canceled), retryable: false},
+		{err: retry.Permanent(&smithy.GenericAPIError{Code: "RequestTimeout"}), retryable: false},
+	}
+
+	for _, tt := range cases {
+		assert.Equal(t, tt.retryable, retry.IsRetryable(tt.err), "%v", tt.err)
+	}
+}
+
+func TestDoRetriesUntilSuccess(t *testing.T) {
+	policy := retry.Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	calls := 0
+	attempts, err := retry.Do(context.Background(), policy, nil, "test", func() error {
+		calls++
+		if calls < 3 {
+			return &smithy.GenericAPIError{Code: "ThrottlingException"}
+		}
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestDoStopsOnPermanentError(t *testing.T) {
+	policy := retry.Policy{MaxAttempts: 5, BaseDelay: time.Millisecond}
+
+	attempts, err := retry.Do(context.Background(), policy, nil, "test", func() error {
+		return fmt.Errorf("permanent")
+	})
+
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestDoGivesUp(t *testing.T) {
+	policy := retry.Policy{MaxAttempts: 2, BaseDelay: time.Millisecond}
+
+	attempts, err := retry.Do(context.Background(), policy, nil, "test", func() error {
+		return &smithy.GenericAPIError{Code: "ServerException"}
+	})
+
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, attempts)
+}
+
+func TestBackoffIsCapped(t *testing.T) {
+	policy := retry.Policy{BaseDelay: time.Second, MaxDelay: time.Second * 2}
+
+	for attempt := 1; attempt < 10; attempt++ {
+		assert.LessOrEqual(t, policy.Backoff(attempt), time.Second*2)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package rewrite
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package rewrite
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	dkr "docker-reassembler/pkg/docker"
+	lgr "docker-reassembler/pkg/logger"
+	"docker-reassembler/pkg/source"
+
+	man "github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pterm/pterm"
+)
+
+const (
+	COMPRESSION_KEEP = "keep"
+	COMPRESSION_GZIP = "gzip"
+	COMPRESSION_ZSTD = "zstd"
+)
+
+// imageConfig is the part of the image config the rewrites check or change.
+type imageConfig struct {
+	RootFS struct {
+		DiffIDs []digest.Digest `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// Recompress writes the image in src to dir in the reassembler layout with
+// every layer compressed with algorithm (gzip or zstd). Docker manifests
+// have no zstd layer type, so they are converted to OCI ones for zstd. The
+// uncompressed content of each layer is checked against the config's
+// rootfs.diff_ids, which therefore stay valid, and every blob is checked
+// against its digest as it is read and again once written.
+func Recompress(ctx context.Context, src source.ISource, dir, algorithm string, logger lgr.ILogger) (*source.Dir, error) {
+	target, err := compression.AlgorithmByName(algorithm)
+	if err != nil || (algorithm != COMPRESSION_GZIP && algorithm != COMPRESSION_ZSTD) {
+		return nil, fmt.Errorf("unsupported layer compression %q, expected gzip, zstd or keep", algorithm)
+	}
+
+	manBuffer, err := src.Manifest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	manifest, err := dkr.FromBlob(manBuffer, logger)
+	if err != nil {
+		return nil, err
+	}
+	if s2, ok := manifest.(*man.Schema2); ok && algorithm == COMPRESSION_ZSTD {
+		if manifest, err = schema2ToOCI(s2); err != nil {
+			return nil, err
+		}
+	}
+
+	configInfo := manifest.ConfigInfo()
+	configBuffer, err := copyBlob(ctx, src, configInfo.Digest, configInfo.Size, dir)
+	if err != nil {
+		return nil, err
+	}
+	config := imageConfig{}
+	if err := json.Unmarshal(configBuffer, &config); err != nil {
+		return nil, fmt.Errorf("error parsing image config: %w", err)
+	}
+
+	layers := manifest.LayerInfos()
+	if len(layers) != len(config.RootFS.DiffIDs) {
+		return nil, fmt.Errorf("manifest has %d layers but the config has %d diff ids",
+			len(layers), len(config.RootFS.DiffIDs))
+	}
+
+	updated := []types.BlobInfo{}
+	for i, layer := range layers {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("recompression interrupted: %w", err)
+		}
+
+		info, err := recompressLayer(ctx, src, layer.BlobInfo, config.RootFS.DiffIDs[i], target, dir)
+		if err != nil {
+			return nil, fmt.Errorf("error recompressing layer %s: %w", layer.Digest, err)
+		}
+		if info.Digest != layer.Digest {
+			logger.Printfln(pterm.Info, "layer %s recompressed with %s to %s (%d to %d bytes)",
+				layer.Digest, algorithm, info.Digest, layer.Size, info.Size)
+		}
+		updated = append(updated, info)
+	}
+
+	if err := manifest.UpdateLayerInfos(updated); err != nil {
+		return nil, fmt.Errorf("error updating manifest layers: %w", err)
+	}
+	newManifest, err := manifest.Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("error serializing manifest: %w", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, source.MANIFEST_FILE_NAME), newManifest, 0o644); err != nil {
+		return nil, fmt.Errorf("error writing manifest: %w", err)
+	}
+
+	return source.NewDir(dir), nil
+}
+
+// recompressLayer writes a layer compressed with target to dir, layers
+// that already are are copied as they are.
+func recompressLayer(ctx context.Context, src source.ISource, layer types.BlobInfo, diffID digest.Digest,
+	target compression.Algorithm, dir string,
+) (types.BlobInfo, error) {
+	verifier := layer.Digest.Verifier()
+	current, decompressor, raw, err := compression.DetectCompressionFormat(
+		io.TeeReader(source.NewBlobReader(ctx, src, layer.Digest.String(), layer.Size), verifier))
+	if err != nil {
+		return types.BlobInfo{}, fmt.Errorf("error detecting compression: %w", err)
+	}
+	info := types.BlobInfo{
+		MediaType:   layer.MediaType,
+		Annotations: layer.Annotations,
+		URLs:        layer.URLs,
+	}
+
+	tmp, err := ioutil.TempFile(dir, "layer-")
+	if err != nil {
+		return types.BlobInfo{}, fmt.Errorf("error creating layer file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	digester := digest.Canonical.Digester()
+	output := io.MultiWriter(tmp, digester.Hash())
+	reader := raw
+	if decompressor != nil && current.Name() == target.Name() {
+		info.CompressionOperation = types.PreserveOriginal
+		if info.Size, err = io.Copy(output, reader); err != nil {
+			return types.BlobInfo{}, fmt.Errorf("error copying layer: %w", err)
+		}
+	} else {
+		if decompressor != nil {
+			rc, err := decompressor(reader)
+			if err != nil {
+				return types.BlobInfo{}, fmt.Errorf("error decompressing layer: %w", err)
+			}
+			defer rc.Close()
+			reader = rc
+		}
+
+		// The uncompressed content must be what the config says it is
+		diffVerifier := diffID.Verifier()
+		counter := &countingWriter{w: output}
+		compressor, err := compression.CompressStream(counter, target, nil)
+		if err != nil {
+			return types.BlobInfo{}, fmt.Errorf("error compressing layer: %w", err)
+		}
+		if _, err := io.Copy(compressor, io.TeeReader(reader, diffVerifier)); err != nil {
+			compressor.Close()
+			return types.BlobInfo{}, fmt.Errorf("error compressing layer: %w", err)
+		}
+		if err := compressor.Close(); err != nil {
+			return types.BlobInfo{}, fmt.Errorf("error compressing layer: %w", err)
+		}
+		if !diffVerifier.Verified() {
+			return types.BlobInfo{}, fmt.Errorf("uncompressed layer does not match diff id %s", diffID)
+		}
+
+		info.Size = counter.n
+		info.CompressionOperation = types.Compress
+		info.CompressionAlgorithm = &target
+	}
+	// Drain anything the decompressor left so the whole blob is verified
+	if _, err := io.Copy(ioutil.Discard, raw); err != nil {
+		return types.BlobInfo{}, fmt.Errorf("error reading layer: %w", err)
+	}
+	if !verifier.Verified() {
+		return types.BlobInfo{}, fmt.Errorf("layer does not match its digest")
+	}
+	if err := tmp.Close(); err != nil {
+		return types.BlobInfo{}, fmt.Errorf("error writing layer: %w", err)
+	}
+
+	info.Digest = digester.Digest()
+	path := filepath.Join(dir, source.BlobFileName(info.Digest.String()))
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return types.BlobInfo{}, fmt.Errorf("error writing layer: %w", err)
+	}
+
+	return info, verifyFile(path, info.Digest, info.Size)
+}
+
+// copyBlob copies a blob as it is into dir and returns its content.
+func copyBlob(ctx context.Context, src source.ISource, dgst digest.Digest, size int64, dir string) ([]byte, error) {
+	blob, err := ioutil.ReadAll(source.NewBlobReader(ctx, src, dgst.String(), size))
+	if err != nil {
+		return nil, fmt.Errorf("error reading blob %s: %w", dgst, err)
+	}
+	if dgst.Algorithm().FromBytes(blob) != dgst {
+		return nil, fmt.Errorf("blob %s does not match its digest", dgst)
+	}
+
+	path := filepath.Join(dir, source.BlobFileName(dgst.String()))
+	if err := ioutil.WriteFile(path, blob, 0o644); err != nil {
+		return nil, fmt.Errorf("error writing blob %s: %w", dgst, err)
+	}
+
+	return blob, nil
+}
+
+// verifyFile reads a written blob back and checks it against its digest
+// and size before it is pushed.
+func verifyFile(path string, dgst digest.Digest, size int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error verifying %s: %w", dgst, err)
+	}
+	defer file.Close()
+
+	verifier := dgst.Verifier()
+	n, err := io.Copy(verifier, bufio.NewReader(file))
+	if err != nil {
+		return fmt.Errorf("error verifying %s: %w", dgst, err)
+	}
+	if n != size || !verifier.Verified() {
+		return fmt.Errorf("written blob %s does not match its digest", dgst)
+	}
+
+	return nil
+}
+
+// schema2ToOCI converts a docker manifest to the equivalent OCI one.
+func schema2ToOCI(s2 *man.Schema2) (*man.OCI1, error) {
+	mediaTypes := map[string]string{
+		man.DockerV2Schema2LayerMediaType:            imgspecv1.MediaTypeImageLayerGzip,
+		man.DockerV2SchemaLayerMediaTypeUncompressed: imgspecv1.MediaTypeImageLayer,
+		man.DockerV2Schema2ForeignLayerMediaType:     imgspecv1.MediaTypeImageLayerNonDistributable,
+		man.DockerV2Schema2ForeignLayerMediaTypeGzip: imgspecv1.MediaTypeImageLayerNonDistributableGzip,
+	}
+
+	layers := []imgspecv1.Descriptor{}
+	for _, layer := range s2.LayersDescriptors {
+		mediaType, ok := mediaTypes[layer.MediaType]
+		if !ok {
+			return nil, fmt.Errorf("layer %s has unsupported media type %q", layer.Digest, layer.MediaType)
+		}
+		layers = append(layers, imgspecv1.Descriptor{
+			MediaType: mediaType,
+			Digest:    layer.Digest,
+			Size:      layer.Size,
+			URLs:      layer.URLs,
+		})
+	}
+
+	return man.OCI1FromComponents(imgspecv1.Descriptor{
+		MediaType: imgspecv1.MediaTypeImageConfig,
+		Digest:    s2.ConfigDescriptor.Digest,
+		Size:      s2.ConfigDescriptor.Size,
+	}, layers), nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
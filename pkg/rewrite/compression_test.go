@@ -0,0 +1,119 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package rewrite_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package rewrite_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"docker-reassembler/pkg/rewrite"
+	"docker-reassembler/pkg/source"
+	"docker-reassembler/pkg/utils"
+
+	man "github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+// newLayout writes a random image with gzip layers and a docker manifest.
+func newLayout(t *testing.T, layers int64) *source.Dir {
+	img, err := random.Image(2048, layers)
+	assert.Nil(t, err)
+	dir := t.TempDir()
+	assert.Nil(t, source.WriteImage(context.Background(), img, dir, &utils.PtermLogger{}))
+
+	return source.NewDir(dir)
+}
+
+// assertLayers checks every layer is compressed with algorithm and has the
+// media type the manifest gives it.
+func assertLayers(t *testing.T, dir *source.Dir, algorithm string, mediaType string) man.Manifest {
+	manBuffer, err := dir.Manifest(context.Background())
+	assert.Nil(t, err)
+	manifest, err := man.FromBlob(manBuffer, man.GuessMIMEType(manBuffer))
+	assert.Nil(t, err)
+
+	for _, layer := range manifest.LayerInfos() {
+		assert.Equal(t, mediaType, layer.MediaType)
+		blob, err := ioutil.ReadFile(filepath.Join(dir.Path, source.BlobFileName(layer.Digest.String())))
+		assert.Nil(t, err)
+		assert.Equal(t, layer.Digest, digest.FromBytes(blob))
+		assert.Equal(t, layer.Size, int64(len(blob)))
+		detected, _, _, err := compression.DetectCompressionFormat(bytes.NewReader(blob))
+		assert.Nil(t, err)
+		assert.Equal(t, algorithm, detected.Name())
+	}
+
+	return manifest
+}
+
+func TestRecompressZstdAndBack(t *testing.T) {
+	src := newLayout(t, 2)
+	original, err := src.Manifest(context.Background())
+	assert.Nil(t, err)
+
+	zstd, err := rewrite.Recompress(context.Background(), src, t.TempDir(), rewrite.COMPRESSION_ZSTD, &utils.PtermLogger{})
+	assert.Nil(t, err)
+	manifest := assertLayers(t, zstd, "zstd", imgspecv1.MediaTypeImageLayerZstd)
+	assert.Equal(t, imgspecv1.MediaTypeImageConfig, manifest.ConfigInfo().MediaType,
+		"docker manifests become OCI ones for zstd")
+
+	gzip, err := rewrite.Recompress(context.Background(), zstd, t.TempDir(), rewrite.COMPRESSION_GZIP, &utils.PtermLogger{})
+	assert.Nil(t, err)
+	assertLayers(t, gzip, "gzip", imgspecv1.MediaTypeImageLayerGzip)
+
+	// The config, and with it the diff ids, is carried over untouched
+	originalManifest, err := man.FromBlob(original, man.GuessMIMEType(original))
+	assert.Nil(t, err)
+	assert.Equal(t, originalManifest.ConfigInfo().Digest, manifest.ConfigInfo().Digest)
+}
+
+func TestRecompressKeepsMatchingLayers(t *testing.T) {
+	src := newLayout(t, 1)
+	original, err := src.Manifest(context.Background())
+	assert.Nil(t, err)
+
+	out, err := rewrite.Recompress(context.Background(), src, t.TempDir(), rewrite.COMPRESSION_GZIP, &utils.PtermLogger{})
+	assert.Nil(t, err)
+	rewritten, err := out.Manifest(context.Background())
+	assert.Nil(t, err)
+
+	assert.JSONEq(t, string(original), string(rewritten))
+}
+
+func TestRecompressRejectsCorruptLayer(t *testing.T) {
+	src := newLayout(t, 1)
+	manBuffer, err := src.Manifest(context.Background())
+	assert.Nil(t, err)
+	manifest, err := man.FromBlob(manBuffer, man.GuessMIMEType(manBuffer))
+	assert.Nil(t, err)
+	layer := filepath.Join(src.Path, source.BlobFileName(manifest.LayerInfos()[0].Digest.String()))
+	blob, err := ioutil.ReadFile(layer)
+	assert.Nil(t, err)
+	blob[len(blob)-1] ^= 0xff
+	assert.Nil(t, ioutil.WriteFile(layer, blob, 0o644))
+
+	_, err = rewrite.Recompress(context.Background(), src, t.TempDir(), rewrite.COMPRESSION_ZSTD, &utils.PtermLogger{})
+
+	assert.NotNil(t, err)
+}
+
+func TestFlagsApply(t *testing.T) {
+	src := newLayout(t, 1)
+
+	same, cleanup, err := (&rewrite.Flags{LayerCompression: rewrite.COMPRESSION_KEEP}).Apply(context.Background(), src, t.TempDir(), &utils.PtermLogger{})
+	assert.Nil(t, err)
+	cleanup()
+	assert.Equal(t, source.ISource(src), same)
+
+	_, _, err = (&rewrite.Flags{LayerCompression: "brotli"}).Apply(context.Background(), src, t.TempDir(), &utils.PtermLogger{})
+	assert.EqualError(t, err, `invalid --layer-compression "brotli", expected gzip, zstd or keep`)
+}
@@ -0,0 +1,204 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package rewrite
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package rewrite
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	lgr "docker-reassembler/pkg/logger"
+	"docker-reassembler/pkg/source"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/pflag"
+)
+
+// Flags selects the rewrites applied to an image before it is uploaded.
+type Flags struct {
+	LayerCompression string
+	SquashTo         int
+
+	Labels            []string
+	RemoveLabels      []string
+	Annotations       []string
+	RemoveAnnotations []string
+	Env               []string
+	RemoveEnv         []string
+	Created           string
+}
+
+func (f *Flags) AddFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&f.LayerCompression, "layer-compression", "", COMPRESSION_KEEP,
+		"recompress every layer with gzip or zstd before upload, zstd turns docker manifests into OCI ones, keep leaves layers as they are")
+	flags.IntVarP(&f.SquashTo, "squash-to", "", 0,
+		"merge the oldest layers so the image has at most this many, ECR takes 99 at most, 0 leaves layers as they are")
+	flags.StringArrayVarP(&f.Labels, "label", "", nil, "add or replace an image config label, key=value")
+	flags.StringSliceVarP(&f.RemoveLabels, "remove-label", "", nil, "remove image config label(s) by key")
+	flags.StringArrayVarP(&f.Annotations, "annotation", "", nil,
+		"add or replace a manifest annotation, key=value, docker manifests become OCI ones")
+	flags.StringSliceVarP(&f.RemoveAnnotations, "remove-annotation", "", nil, "remove manifest annotation(s) by key")
+	flags.StringArrayVarP(&f.Env, "env", "", nil, "add or replace an image config env var, NAME=value")
+	flags.StringSliceVarP(&f.RemoveEnv, "remove-env", "", nil, "remove image config env var(s) by name")
+	flags.StringVarP(&f.Created, "created", "", "", "set the image config created timestamp, RFC 3339 or now")
+}
+
+// Metadata is the config and manifest changes the flags ask for.
+func (f *Flags) Metadata() (*Metadata, error) {
+	metadata := &Metadata{
+		RemoveLabels:      f.RemoveLabels,
+		RemoveAnnotations: f.RemoveAnnotations,
+		RemoveEnv:         f.RemoveEnv,
+	}
+
+	var err error
+	if metadata.Labels, err = keyValues("--label", f.Labels); err != nil {
+		return nil, err
+	}
+	if metadata.Annotations, err = keyValues("--annotation", f.Annotations); err != nil {
+		return nil, err
+	}
+	for _, entry := range f.Env {
+		if !strings.Contains(entry, "=") || strings.HasPrefix(entry, "=") {
+			return nil, fmt.Errorf("invalid --env %q, expected NAME=value", entry)
+		}
+		metadata.Env = append(metadata.Env, entry)
+	}
+
+	switch f.Created {
+	case "":
+	case "now":
+		created := time.Now()
+		metadata.Created = &created
+	default:
+		created, err := time.Parse(time.RFC3339, f.Created)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --created %q, expected an RFC 3339 timestamp or now: %w", f.Created, err)
+		}
+		metadata.Created = &created
+	}
+
+	return metadata, nil
+}
+
+func keyValues(flag string, entries []string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid %s %q, expected key=value", flag, entry)
+		}
+		values[parts[0]] = parts[1]
+	}
+	return values, nil
+}
+
+// Validate checks the flags before any work is done.
+func (f *Flags) Validate() error {
+	if f.SquashTo < 0 {
+		return fmt.Errorf("invalid --squash-to %d, expected a positive number of layers", f.SquashTo)
+	}
+	if _, err := f.Metadata(); err != nil {
+		return err
+	}
+
+	switch f.LayerCompression {
+	case COMPRESSION_KEEP, COMPRESSION_GZIP, COMPRESSION_ZSTD:
+		return nil
+	}
+
+	return fmt.Errorf("invalid --layer-compression %q, expected gzip, zstd or keep", f.LayerCompression)
+}
+
+// Apply rewrites src as the flags ask, each rewrite writing the image to a
+// new directory under workDir that cleanup closes and removes. src is
+// returned as it is when there is nothing to rewrite.
+func (f *Flags) Apply(ctx context.Context, src source.ISource, workDir string, logger lgr.ILogger) (
+	rewritten source.ISource, cleanup func(), err error,
+) {
+	if err := f.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	dirs := []string{}
+	rewrites := []*source.Dir{}
+	cleanup = func() {
+		for _, dir := range rewrites {
+			dir.Close()
+		}
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}
+	defer func() {
+		if err != nil {
+			cleanup()
+		}
+	}()
+
+	newDir := func(step string) (string, error) {
+		if err := os.MkdirAll(workDir, 0o775); err != nil {
+			return "", fmt.Errorf("error creating %q: %w", workDir, err)
+		}
+		dir, err := ioutil.TempDir(workDir, step+"-")
+		if err != nil {
+			return "", fmt.Errorf("error creating directory to rewrite the image to: %w", err)
+		}
+		dirs = append(dirs, dir)
+		return dir, nil
+	}
+
+	rewritten = src
+	step := func(name string, rewrite func(dir string) (*source.Dir, error)) error {
+		dir, err := newDir(name)
+		if err != nil {
+			return err
+		}
+		out, err := rewrite(dir)
+		if err != nil {
+			return err
+		}
+		rewrites = append(rewrites, out)
+		rewritten = out
+		return nil
+	}
+
+	if f.SquashTo > 0 {
+		err := step("squash", func(dir string) (*source.Dir, error) {
+			return Squash(ctx, rewritten, dir, f.SquashTo, logger)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if f.LayerCompression != COMPRESSION_KEEP {
+		logger.Printfln(pterm.Info, "recompressing layers with %s", f.LayerCompression)
+		err := step("recompress", func(dir string) (*source.Dir, error) {
+			return Recompress(ctx, rewritten, dir, f.LayerCompression, logger)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	metadata, err := f.Metadata()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !metadata.Empty() {
+		logger.Printfln(pterm.Info, "rewriting image metadata")
+		err := step("metadata", func(dir string) (*source.Dir, error) {
+			return RewriteMetadata(ctx, rewritten, dir, metadata, logger)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return rewritten, cleanup, nil
+}
@@ -0,0 +1,219 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package rewrite
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package rewrite
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	dkr "docker-reassembler/pkg/docker"
+	lgr "docker-reassembler/pkg/logger"
+	"docker-reassembler/pkg/source"
+
+	man "github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+	"github.com/pterm/pterm"
+)
+
+// Metadata holds changes to the image config and manifest.
+type Metadata struct {
+	Labels            map[string]string
+	RemoveLabels      []string
+	Annotations       map[string]string
+	RemoveAnnotations []string
+	// Env entries are KEY=value, replacing a variable of the same name
+	Env       []string
+	RemoveEnv []string
+	Created   *time.Time
+}
+
+// Empty is true when there is nothing to change.
+func (m *Metadata) Empty() bool {
+	return len(m.Labels) == 0 && len(m.RemoveLabels) == 0 &&
+		len(m.Annotations) == 0 && len(m.RemoveAnnotations) == 0 &&
+		len(m.Env) == 0 && len(m.RemoveEnv) == 0 && m.Created == nil
+}
+
+// RewriteMetadata writes the image in src to dir in the reassembler layout
+// with the metadata changes applied, giving the config and manifest new
+// digests. Layers are kept as they are, linked from a source on disk or
+// copied from any other. Docker manifests have no
+// annotations so they become OCI ones when annotations are added.
+func RewriteMetadata(ctx context.Context, src source.ISource, dir string, metadata *Metadata, logger lgr.ILogger) (*source.Dir, error) {
+	manBuffer, err := src.Manifest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	manifest, err := dkr.FromBlob(manBuffer, logger)
+	if err != nil {
+		return nil, err
+	}
+	if s2, ok := manifest.(*man.Schema2); ok && len(metadata.Annotations) > 0 {
+		logger.Printfln(pterm.Info, "converting the docker manifest to OCI to add annotations")
+		if manifest, err = schema2ToOCI(s2); err != nil {
+			return nil, err
+		}
+	}
+
+	configInfo := manifest.ConfigInfo()
+	configBuffer, err := ioutil.ReadAll(source.NewBlobReader(ctx, src, configInfo.Digest.String(), configInfo.Size))
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+	if configInfo.Digest.Algorithm().FromBytes(configBuffer) != configInfo.Digest {
+		return nil, fmt.Errorf("config %s does not match its digest", configInfo.Digest)
+	}
+	newConfig, err := rewriteConfig(configBuffer, metadata)
+	if err != nil {
+		return nil, err
+	}
+	newDigest := digest.FromBytes(newConfig)
+	if err := ioutil.WriteFile(filepath.Join(dir, source.BlobFileName(newDigest.String())), newConfig, 0o644); err != nil {
+		return nil, fmt.Errorf("error writing config: %w", err)
+	}
+	logger.Printfln(pterm.Info, "config %s rewritten to %s", configInfo.Digest, newDigest)
+
+	for _, layer := range manifest.LayerInfos() {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("metadata rewrite interrupted: %w", err)
+		}
+		if err := copyLayer(ctx, src, layer.BlobInfo, dir); err != nil {
+			return nil, err
+		}
+	}
+
+	switch m := manifest.(type) {
+	case *man.Schema2:
+		m.ConfigDescriptor.Digest = newDigest
+		m.ConfigDescriptor.Size = int64(len(newConfig))
+	case *man.OCI1:
+		m.Config.Digest = newDigest
+		m.Config.Size = int64(len(newConfig))
+		if m.Annotations == nil {
+			m.Annotations = map[string]string{}
+		}
+		for _, key := range metadata.RemoveAnnotations {
+			delete(m.Annotations, key)
+		}
+		for key, value := range metadata.Annotations {
+			m.Annotations[key] = value
+		}
+		if len(m.Annotations) == 0 {
+			m.Annotations = nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported manifest type %s", configInfo.MediaType)
+	}
+
+	newManifest, err := manifest.Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("error writing manifest: %w", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, source.MANIFEST_FILE_NAME), newManifest, 0o644); err != nil {
+		return nil, fmt.Errorf("error writing manifest: %w", err)
+	}
+
+	return source.NewDir(dir), nil
+}
+
+// rewriteConfig applies the label, env and created changes to a config,
+// keeping every other field as it is.
+func rewriteConfig(configBuffer []byte, metadata *Metadata) ([]byte, error) {
+	config := map[string]json.RawMessage{}
+	if err := json.Unmarshal(configBuffer, &config); err != nil {
+		return nil, fmt.Errorf("error parsing image config: %w", err)
+	}
+	runConfig := map[string]json.RawMessage{}
+	if raw, ok := config["config"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &runConfig); err != nil {
+			return nil, fmt.Errorf("error parsing image config: %w", err)
+		}
+	}
+
+	labels := map[string]string{}
+	if raw, ok := runConfig["Labels"]; ok {
+		if err := json.Unmarshal(raw, &labels); err != nil {
+			return nil, fmt.Errorf("error parsing image config labels: %w", err)
+		}
+	}
+	for _, key := range metadata.RemoveLabels {
+		delete(labels, key)
+	}
+	for key, value := range metadata.Labels {
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[key] = value
+	}
+
+	env := []string{}
+	if raw, ok := runConfig["Env"]; ok {
+		if err := json.Unmarshal(raw, &env); err != nil {
+			return nil, fmt.Errorf("error parsing image config env: %w", err)
+		}
+	}
+	for _, key := range metadata.RemoveEnv {
+		env = removeEnv(env, key)
+	}
+	for _, entry := range metadata.Env {
+		env = setEnv(env, entry)
+	}
+
+	var err error
+	if len(labels) > 0 {
+		if runConfig["Labels"], err = json.Marshal(labels); err != nil {
+			return nil, err
+		}
+	} else {
+		delete(runConfig, "Labels")
+	}
+	if len(env) > 0 {
+		if runConfig["Env"], err = json.Marshal(env); err != nil {
+			return nil, err
+		}
+	} else {
+		delete(runConfig, "Env")
+	}
+	if config["config"], err = json.Marshal(runConfig); err != nil {
+		return nil, err
+	}
+	if metadata.Created != nil {
+		if config["created"], err = json.Marshal(metadata.Created.UTC()); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(config)
+}
+
+func envName(entry string) string {
+	return strings.SplitN(entry, "=", 2)[0]
+}
+
+func removeEnv(env []string, name string) []string {
+	kept := []string{}
+	for _, entry := range env {
+		if envName(entry) != name {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// setEnv replaces the variable entry names in place, or appends it.
+func setEnv(env []string, entry string) []string {
+	for i, existing := range env {
+		if envName(existing) == envName(entry) {
+			env[i] = entry
+			return env
+		}
+	}
+	return append(env, entry)
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package rewrite_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package rewrite_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"docker-reassembler/pkg/rewrite"
+	"docker-reassembler/pkg/source"
+	"docker-reassembler/pkg/utils"
+
+	man "github.com/containers/image/v5/manifest"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+// readImage reads the manifest and parsed config of a layout, checking the
+// config against its digest.
+func readImage(t *testing.T, dir *source.Dir) (man.Manifest, *v1.ConfigFile) {
+	manBuffer, err := dir.Manifest(context.Background())
+	assert.Nil(t, err)
+	manifest, err := man.FromBlob(manBuffer, man.GuessMIMEType(manBuffer))
+	assert.Nil(t, err)
+
+	config, err := ioutil.ReadFile(filepath.Join(dir.Path, source.BlobFileName(manifest.ConfigInfo().Digest.String())))
+	assert.Nil(t, err)
+	assert.Equal(t, manifest.ConfigInfo().Digest, digest.FromBytes(config))
+	assert.Equal(t, manifest.ConfigInfo().Size, int64(len(config)))
+	configFile, err := v1.ParseConfigFile(bytes.NewReader(config))
+	assert.Nil(t, err)
+
+	return manifest, configFile
+}
+
+func TestRewriteMetadata(t *testing.T) {
+	src := newLayeredLayout(t, layerTar(t, tarEntry{"a", "a"}))
+	original, originalConfig := readImage(t, src)
+	assert.Equal(t, []string{"A=b"}, originalConfig.Config.Env)
+
+	created := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	labelled, err := rewrite.RewriteMetadata(context.Background(), src, t.TempDir(), &rewrite.Metadata{
+		Labels:  map[string]string{"team": "platform", "source": "artifactory/app"},
+		Env:     []string{"A=c", "MIGRATED=true"},
+		Created: &created,
+	}, &utils.PtermLogger{})
+	assert.Nil(t, err)
+	manifest, config := readImage(t, labelled)
+	assert.NotEqual(t, original.ConfigInfo().Digest, manifest.ConfigInfo().Digest)
+	_, ok := manifest.(*man.Schema2)
+	assert.True(t, ok, "docker manifests stay docker ones without annotations")
+	assert.Equal(t, map[string]string{"team": "platform", "source": "artifactory/app"}, config.Config.Labels)
+	assert.Equal(t, []string{"A=c", "MIGRATED=true"}, config.Config.Env)
+	assert.Equal(t, created, config.Created.Time.UTC())
+	assert.Equal(t, originalConfig.RootFS, config.RootFS)
+	assert.Equal(t, originalConfig.History, config.History)
+	assert.Equal(t, original.LayerInfos()[0].Digest, manifest.LayerInfos()[0].Digest)
+	layerName := source.BlobFileName(original.LayerInfos()[0].Digest.String())
+	srcLayer, err := os.Stat(filepath.Join(src.Path, layerName))
+	assert.Nil(t, err)
+	labelledLayer, err := os.Stat(filepath.Join(labelled.Path, layerName))
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(srcLayer, labelledLayer), "layers on disk are linked, not copied")
+
+	annotated, err := rewrite.RewriteMetadata(context.Background(), labelled, t.TempDir(), &rewrite.Metadata{
+		RemoveLabels: []string{"team"},
+		RemoveEnv:    []string{"A"},
+		Annotations:  map[string]string{imgspecv1.AnnotationSource: "artifactory/app"},
+	}, &utils.PtermLogger{})
+	assert.Nil(t, err)
+	manifest, config = readImage(t, annotated)
+	oci, ok := manifest.(*man.OCI1)
+	assert.True(t, ok, "docker manifests become OCI ones to take annotations")
+	assert.Equal(t, map[string]string{imgspecv1.AnnotationSource: "artifactory/app"}, oci.Annotations)
+	assert.Equal(t, imgspecv1.MediaTypeImageLayerGzip, manifest.LayerInfos()[0].MediaType)
+	assert.Equal(t, map[string]string{"source": "artifactory/app"}, config.Config.Labels)
+	assert.Equal(t, []string{"MIGRATED=true"}, config.Config.Env)
+
+	removed, err := rewrite.RewriteMetadata(context.Background(), annotated, t.TempDir(), &rewrite.Metadata{
+		RemoveAnnotations: []string{imgspecv1.AnnotationSource},
+	}, &utils.PtermLogger{})
+	assert.Nil(t, err)
+	manifest, _ = readImage(t, removed)
+	assert.Nil(t, manifest.(*man.OCI1).Annotations)
+}
+
+func TestMetadataFlags(t *testing.T) {
+	for _, flags := range []*rewrite.Flags{
+		{LayerCompression: rewrite.COMPRESSION_KEEP, Labels: []string{"team"}},
+		{LayerCompression: rewrite.COMPRESSION_KEEP, Annotations: []string{"=x"}},
+		{LayerCompression: rewrite.COMPRESSION_KEEP, Env: []string{"PATH"}},
+		{LayerCompression: rewrite.COMPRESSION_KEEP, Created: "yesterday"},
+	} {
+		assert.NotNil(t, flags.Validate())
+	}
+
+	flags := &rewrite.Flags{
+		LayerCompression: rewrite.COMPRESSION_KEEP,
+		Labels:           []string{"url=https://example.com/?a=b"},
+		Created:          "2022-09-01T12:00:00Z",
+	}
+	metadata, err := flags.Metadata()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"url": "https://example.com/?a=b"}, metadata.Labels)
+
+	rewritten, cleanup, err := flags.Apply(context.Background(), newLayout(t, 1), t.TempDir(), &utils.PtermLogger{})
+	assert.Nil(t, err)
+	defer cleanup()
+	_, config := readImage(t, rewritten.(*source.Dir))
+	assert.Equal(t, "https://example.com/?a=b", config.Config.Labels["url"])
+	assert.Equal(t, 2022, config.Created.Time.Year())
+}
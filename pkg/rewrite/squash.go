@@ -0,0 +1,511 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package rewrite
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package rewrite
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	dkr "docker-reassembler/pkg/docker"
+	lgr "docker-reassembler/pkg/logger"
+	"docker-reassembler/pkg/source"
+
+	man "github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pterm/pterm"
+)
+
+const (
+	WHITEOUT_PREFIX = ".wh."
+	WHITEOUT_OPAQUE = ".wh..wh..opq"
+)
+
+// Squash writes the image in src to dir in the reassembler layout with at
+// most max layers. The oldest layers are merged into one, applying their
+// whiteouts, so the more often changing top layers are kept as they are.
+// The config gets the new diff ids, and the history entries of merged
+// layers are kept but marked empty except for the last one.
+func Squash(ctx context.Context, src source.ISource, dir string, max int, logger lgr.ILogger) (*source.Dir, error) {
+	if max < 1 {
+		return nil, fmt.Errorf("can not squash to %d layers", max)
+	}
+
+	manBuffer, err := src.Manifest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	manifest, err := dkr.FromBlob(manBuffer, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	layers := manifest.LayerInfos()
+	configInfo := manifest.ConfigInfo()
+	if len(layers) <= max {
+		logger.Printfln(pterm.Info, "image has %d layers, nothing to squash", len(layers))
+		if _, err := copyBlob(ctx, src, configInfo.Digest, configInfo.Size, dir); err != nil {
+			return nil, err
+		}
+		for _, layer := range layers {
+			if err := copyLayer(ctx, src, layer.BlobInfo, dir); err != nil {
+				return nil, err
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, source.MANIFEST_FILE_NAME), manBuffer, 0o644); err != nil {
+			return nil, fmt.Errorf("error writing manifest: %w", err)
+		}
+		return source.NewDir(dir), nil
+	}
+
+	configBuffer, err := ioutil.ReadAll(source.NewBlobReader(ctx, src, configInfo.Digest.String(), configInfo.Size))
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+	if configInfo.Digest.Algorithm().FromBytes(configBuffer) != configInfo.Digest {
+		return nil, fmt.Errorf("config %s does not match its digest", configInfo.Digest)
+	}
+
+	merged := len(layers) - max + 1
+	logger.Printfln(pterm.Info, "squashing the %d oldest of %d layers into one", merged, len(layers))
+	squashed, diffID, err := mergeLayers(ctx, src, layers[:merged], dir)
+	if err != nil {
+		return nil, err
+	}
+
+	newLayers := []types.BlobInfo{squashed}
+	for _, layer := range layers[merged:] {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("squash interrupted: %w", err)
+		}
+		if err := copyLayer(ctx, src, layer.BlobInfo, dir); err != nil {
+			return nil, err
+		}
+		newLayers = append(newLayers, layer.BlobInfo)
+	}
+
+	newConfig, err := squashConfig(configBuffer, merged, diffID, logger)
+	if err != nil {
+		return nil, err
+	}
+	newConfigInfo := types.BlobInfo{
+		Digest:    digest.FromBytes(newConfig),
+		Size:      int64(len(newConfig)),
+		MediaType: configInfo.MediaType,
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, source.BlobFileName(newConfigInfo.Digest.String())), newConfig, 0o644); err != nil {
+		return nil, fmt.Errorf("error writing config: %w", err)
+	}
+
+	newManifest, err := buildManifest(manifest, newConfigInfo, newLayers)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, source.MANIFEST_FILE_NAME), newManifest, 0o644); err != nil {
+		return nil, fmt.Errorf("error writing manifest: %w", err)
+	}
+
+	return source.NewDir(dir), nil
+}
+
+// squashConfig rewrites the diff ids and history of a config after its
+// first merged layers were squashed into one with diffID. Other fields are
+// kept as they are.
+func squashConfig(configBuffer []byte, merged int, diffID digest.Digest, logger lgr.ILogger) ([]byte, error) {
+	config := map[string]json.RawMessage{}
+	if err := json.Unmarshal(configBuffer, &config); err != nil {
+		return nil, fmt.Errorf("error parsing image config: %w", err)
+	}
+
+	rootfs := map[string]json.RawMessage{}
+	if err := json.Unmarshal(config["rootfs"], &rootfs); err != nil {
+		return nil, fmt.Errorf("error parsing image config rootfs: %w", err)
+	}
+	diffIDs := []digest.Digest{}
+	if err := json.Unmarshal(rootfs["diff_ids"], &diffIDs); err != nil {
+		return nil, fmt.Errorf("error parsing image config diff ids: %w", err)
+	}
+	if len(diffIDs) < merged {
+		return nil, fmt.Errorf("image config has %d diff ids, expected at least %d", len(diffIDs), merged)
+	}
+	diffIDs = append([]digest.Digest{diffID}, diffIDs[merged:]...)
+
+	history := []map[string]interface{}{}
+	if raw, ok := config["history"]; ok {
+		if err := json.Unmarshal(raw, &history); err != nil {
+			return nil, fmt.Errorf("error parsing image config history: %w", err)
+		}
+	}
+	nonEmpty := []int{}
+	for i, entry := range history {
+		if empty, _ := entry["empty_layer"].(bool); !empty {
+			nonEmpty = append(nonEmpty, i)
+		}
+	}
+	switch {
+	case len(history) == 0:
+	case len(nonEmpty) != len(diffIDs)+merged-1:
+		logger.Printfln(pterm.Warning, "image history does not match its layers, dropping it")
+		delete(config, "history")
+		history = nil
+	default:
+		// The merged layers' entries stay for the record, only the last
+		// one still stands for a layer
+		for _, i := range nonEmpty[:merged-1] {
+			history[i]["empty_layer"] = true
+		}
+		last := history[nonEmpty[merged-1]]
+		comment := fmt.Sprintf("squashed %d layers", merged)
+		if existing, _ := last["comment"].(string); existing != "" {
+			comment = existing + ", " + comment
+		}
+		last["comment"] = comment
+	}
+
+	var err error
+	if rootfs["diff_ids"], err = json.Marshal(diffIDs); err != nil {
+		return nil, err
+	}
+	if config["rootfs"], err = json.Marshal(rootfs); err != nil {
+		return nil, err
+	}
+	if history != nil {
+		if config["history"], err = json.Marshal(history); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(config)
+}
+
+// buildManifest makes a manifest of the same type as manifest with a new
+// config and layers.
+func buildManifest(manifest man.Manifest, config types.BlobInfo, layers []types.BlobInfo) ([]byte, error) {
+	switch m := manifest.(type) {
+	case *man.Schema2:
+		descriptors := []man.Schema2Descriptor{}
+		for _, layer := range layers {
+			descriptors = append(descriptors, man.Schema2Descriptor{
+				MediaType: layer.MediaType, Size: layer.Size, Digest: layer.Digest, URLs: layer.URLs,
+			})
+		}
+		return man.Schema2FromComponents(man.Schema2Descriptor{
+			MediaType: m.ConfigDescriptor.MediaType, Size: config.Size, Digest: config.Digest,
+		}, descriptors).Serialize()
+	case *man.OCI1:
+		descriptors := []imgspecv1.Descriptor{}
+		for _, layer := range layers {
+			descriptors = append(descriptors, imgspecv1.Descriptor{
+				MediaType: layer.MediaType, Size: layer.Size, Digest: layer.Digest,
+				URLs: layer.URLs, Annotations: layer.Annotations,
+			})
+		}
+		oci := man.OCI1FromComponents(imgspecv1.Descriptor{
+			MediaType: m.Config.MediaType, Size: config.Size, Digest: config.Digest,
+		}, descriptors)
+		oci.Annotations = m.Annotations
+		return oci.Serialize()
+	}
+
+	return nil, fmt.Errorf("unsupported manifest type %s", manifest.ConfigInfo().MediaType)
+}
+
+// mergeEntry is the last version of a path across the merged layers.
+type mergeEntry struct {
+	header *tar.Header
+	// at is the layer and entry index the path is written out at
+	at [2]int
+	// link is what a hard link pointed to when it was made, it is set for
+	// links whose target was replaced or removed since, which are written
+	// as a copy of what they pointed to
+	link *mergeEntry
+	// linkAt is where the target of a hard link was when it was made
+	linkAt [2]int
+}
+
+// mergeLayers writes the layers as one gzip compressed layer equivalent to
+// applying them in order. The layers are the bottom ones of the image, so
+// whiteouts are applied and dropped as there is nothing below left to hide.
+func mergeLayers(ctx context.Context, src source.ISource, layers []man.LayerInfo, dir string) (
+	types.BlobInfo, digest.Digest, error,
+) {
+	// The first pass only reads headers to settle which version of each
+	// path survives
+	entries := map[string]*mergeEntry{}
+	// removeTree removes what is under prefix in the layers below layer
+	removeTree := func(prefix string, layer int) {
+		for name, entry := range entries {
+			if strings.HasPrefix(name, prefix+"/") && entry.at[0] < layer {
+				delete(entries, name)
+			}
+		}
+	}
+	for l, layer := range layers {
+		err := readLayer(ctx, src, layer.BlobInfo, func(i int, hdr *tar.Header, _ io.Reader) error {
+			name := cleanName(hdr.Name)
+			dirName, baseName := path.Split(name)
+			dirName = strings.TrimSuffix(dirName, "/")
+			switch {
+			case baseName == WHITEOUT_OPAQUE:
+				// A whiteout only hides the layers below its own
+				removeTree(dirName, l)
+			case strings.HasPrefix(baseName, WHITEOUT_PREFIX):
+				target := path.Join(dirName, strings.TrimPrefix(baseName, WHITEOUT_PREFIX))
+				if existing, ok := entries[target]; ok && existing.at[0] < l {
+					delete(entries, target)
+				}
+				removeTree(target, l)
+			default:
+				existing, ok := entries[name]
+				if ok && existing.header.Typeflag == tar.TypeDir && hdr.Typeflag == tar.TypeDir {
+					// Keep the directory ahead of its children
+					existing.header = hdr
+					return nil
+				}
+				if ok && existing.header.Typeflag == tar.TypeDir {
+					removeTree(name, l+1)
+				}
+				entry := &mergeEntry{header: hdr, at: [2]int{l, i}}
+				if hdr.Typeflag == tar.TypeLink {
+					if target, ok := entries[cleanName(hdr.Linkname)]; ok {
+						entry.link, entry.linkAt = target, target.at
+						if target.link != nil {
+							entry.link = target.link
+						}
+					}
+				}
+				entries[name] = entry
+			}
+			return nil
+		})
+		if err != nil {
+			return types.BlobInfo{}, "", err
+		}
+	}
+
+	// A hard link whose target is still the one it was made to comes after
+	// it and is written as it was. Otherwise the link kept the content it
+	// pointed to, which is read into a file to write the link as a copy.
+	spool := map[[2]int]bool{}
+	at := map[[2]int]*mergeEntry{}
+	for _, entry := range entries {
+		at[entry.at] = entry
+		if entry.link == nil {
+			continue
+		}
+		if target, ok := entries[cleanName(entry.header.Linkname)]; ok && target.at == entry.linkAt {
+			entry.link = nil
+			continue
+		}
+		spool[entry.link.at] = true
+	}
+	spooled := map[[2]int]string{}
+	defer func() {
+		for _, name := range spooled {
+			os.Remove(name)
+		}
+	}()
+
+	tmp, err := ioutil.TempFile(dir, "squash-")
+	if err != nil {
+		return types.BlobInfo{}, "", fmt.Errorf("error creating layer file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	digester := digest.Canonical.Digester()
+	counter := &countingWriter{w: io.MultiWriter(tmp, digester.Hash())}
+	compressor, err := compression.CompressStream(counter, compression.Gzip, nil)
+	if err != nil {
+		return types.BlobInfo{}, "", fmt.Errorf("error compressing layer: %w", err)
+	}
+	diffDigester := digest.Canonical.Digester()
+	tw := tar.NewWriter(io.MultiWriter(compressor, diffDigester.Hash()))
+
+	// The second pass writes the surviving entries in their original order
+	for l, layer := range layers {
+		err := readLayer(ctx, src, layer.BlobInfo, func(i int, _ *tar.Header, content io.Reader) error {
+			if spool[[2]int{l, i}] {
+				name, err := spoolContent(dir, content)
+				if err != nil {
+					return err
+				}
+				spooled[[2]int{l, i}] = name
+			}
+			entry, ok := at[[2]int{l, i}]
+			if !ok {
+				return nil
+			}
+			hdr := *entry.header
+			if entry.link != nil {
+				hdr = *entry.link.header
+				hdr.Name = entry.header.Name
+			}
+			if name, ok := spooled[entry.linkSource()]; ok {
+				f, err := os.Open(name)
+				if err != nil {
+					return fmt.Errorf("error reading %s: %w", hdr.Name, err)
+				}
+				defer f.Close()
+				content = f
+			}
+			hdr.Name = cleanName(hdr.Name)
+			if hdr.Typeflag == tar.TypeDir {
+				hdr.Name += "/"
+			}
+			if err := tw.WriteHeader(&hdr); err != nil {
+				return fmt.Errorf("error writing %s: %w", hdr.Name, err)
+			}
+			if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+				if _, err := io.Copy(tw, content); err != nil {
+					return fmt.Errorf("error writing %s: %w", hdr.Name, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return types.BlobInfo{}, "", err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return types.BlobInfo{}, "", fmt.Errorf("error writing layer: %w", err)
+	}
+	if err := compressor.Close(); err != nil {
+		return types.BlobInfo{}, "", fmt.Errorf("error compressing layer: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return types.BlobInfo{}, "", fmt.Errorf("error writing layer: %w", err)
+	}
+
+	info := types.BlobInfo{
+		Digest:    digester.Digest(),
+		Size:      counter.n,
+		MediaType: gzipMediaType(layers[len(layers)-1].MediaType),
+	}
+	layerPath := filepath.Join(dir, source.BlobFileName(info.Digest.String()))
+	if err := os.Rename(tmp.Name(), layerPath); err != nil {
+		return types.BlobInfo{}, "", fmt.Errorf("error writing layer: %w", err)
+	}
+
+	return info, diffDigester.Digest(), verifyFile(layerPath, info.Digest, info.Size)
+}
+
+// linkSource is where the content of the entry is read from.
+func (e *mergeEntry) linkSource() [2]int {
+	if e.link != nil {
+		return e.link.at
+	}
+	return e.at
+}
+
+// spoolContent copies the content of an entry to a new file under dir.
+func spoolContent(dir string, content io.Reader) (string, error) {
+	f, err := ioutil.TempFile(dir, "link-")
+	if err != nil {
+		return "", fmt.Errorf("error creating hard link content file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, content); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("error writing hard link content: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("error writing hard link content: %w", err)
+	}
+
+	return f.Name(), nil
+}
+
+// readLayer calls fn for each entry of a layer, checking the layer against
+// its digest.
+func readLayer(ctx context.Context, src source.ISource, layer types.BlobInfo,
+	fn func(i int, hdr *tar.Header, content io.Reader) error,
+) error {
+	verifier := layer.Digest.Verifier()
+	raw := io.TeeReader(source.NewBlobReader(ctx, src, layer.Digest.String(), layer.Size), verifier)
+	uncompressed, _, err := compression.AutoDecompress(raw)
+	if err != nil {
+		return fmt.Errorf("error decompressing layer %s: %w", layer.Digest, err)
+	}
+	defer uncompressed.Close()
+
+	tr := tar.NewReader(uncompressed)
+	for i := 0; ; i++ {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("squash interrupted: %w", err)
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading layer %s: %w", layer.Digest, err)
+		}
+		if err := fn(i, hdr, tr); err != nil {
+			return err
+		}
+	}
+
+	if _, err := io.Copy(ioutil.Discard, raw); err != nil {
+		return fmt.Errorf("error reading layer %s: %w", layer.Digest, err)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("layer %s does not match its digest", layer.Digest)
+	}
+
+	return nil
+}
+
+// copyLayer copies a layer as it is into dir. The layer file of an image
+// already on disk is linked rather than copied when it can be.
+func copyLayer(ctx context.Context, src source.ISource, layer types.BlobInfo, dir string) error {
+	layerPath := filepath.Join(dir, source.BlobFileName(layer.Digest.String()))
+	if srcDir, ok := src.(*source.Dir); ok {
+		srcPath := filepath.Join(srcDir.Path, source.BlobFileName(layer.Digest.String()))
+		if err := os.Link(srcPath, layerPath); err == nil {
+			return verifyFile(layerPath, layer.Digest, layer.Size)
+		}
+	}
+
+	file, err := os.Create(layerPath)
+	if err != nil {
+		return fmt.Errorf("error creating %q: %w", layerPath, err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, source.NewBlobReader(ctx, src, layer.Digest.String(), layer.Size)); err != nil {
+		return fmt.Errorf("error copying layer %s: %w", layer.Digest, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error copying layer %s: %w", layer.Digest, err)
+	}
+
+	return verifyFile(layerPath, layer.Digest, layer.Size)
+}
+
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// gzipMediaType is the gzip layer media type of the manifest type
+// mediaType belongs to.
+func gzipMediaType(mediaType string) string {
+	if strings.HasPrefix(mediaType, "application/vnd.oci.") {
+		return imgspecv1.MediaTypeImageLayerGzip
+	}
+	return man.DockerV2Schema2LayerMediaType
+}
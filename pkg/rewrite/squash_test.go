@@ -0,0 +1,245 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package rewrite_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package rewrite_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"docker-reassembler/pkg/rewrite"
+	"docker-reassembler/pkg/source"
+	"docker-reassembler/pkg/utils"
+
+	man "github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+type tarEntry struct {
+	name    string
+	content string
+}
+
+// layerTar builds an uncompressed layer, names ending in / are directories.
+func layerTar(t *testing.T, entries ...tarEntry) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, entry := range entries {
+		hdr := &tar.Header{Name: entry.name, Mode: 0o644, Typeflag: tar.TypeReg, Size: int64(len(entry.content))}
+		if entry.name[len(entry.name)-1] == '/' {
+			hdr = &tar.Header{Name: entry.name, Mode: 0o755, Typeflag: tar.TypeDir}
+		}
+		assert.Nil(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(entry.content))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, tw.Close())
+
+	return buf.Bytes()
+}
+
+// linkLayerTar builds an uncompressed layer with the entries followed by
+// hard links, from the first name of each pair to the second.
+func linkLayerTar(t *testing.T, entries []tarEntry, links ...[2]string) []byte {
+	buf := bytes.NewBuffer(layerTar(t, entries...))
+	// Drop the end of archive blocks to carry on writing
+	buf.Truncate(buf.Len() - 1024)
+	tw := tar.NewWriter(buf)
+	for _, link := range links {
+		assert.Nil(t, tw.WriteHeader(&tar.Header{Name: link[0], Linkname: link[1], Mode: 0o644, Typeflag: tar.TypeLink}))
+	}
+	assert.Nil(t, tw.Close())
+
+	return buf.Bytes()
+}
+
+// squashAll squashes every layer of src into one and returns its files.
+func squashAll(t *testing.T, src *source.Dir) map[string]string {
+	squashed, err := rewrite.Squash(context.Background(), src, t.TempDir(), 1, &utils.PtermLogger{})
+	assert.Nil(t, err)
+	manBuffer, err := squashed.Manifest(context.Background())
+	assert.Nil(t, err)
+	manifest, err := man.FromBlob(manBuffer, man.GuessMIMEType(manBuffer))
+	assert.Nil(t, err)
+	layers := manifest.LayerInfos()
+	assert.Equal(t, 1, len(layers))
+
+	return layerFiles(t, squashed, layers[0].Digest)
+}
+
+// newLayeredLayout writes an image with the layers and one history entry
+// per layer plus an empty one.
+func newLayeredLayout(t *testing.T, layers ...[]byte) *source.Dir {
+	img, err := mutate.Config(empty.Image, v1.Config{Env: []string{"A=b"}})
+	assert.Nil(t, err)
+	for i, layer := range layers {
+		layer := layer
+		l, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(layer)), nil
+		})
+		assert.Nil(t, err)
+		img, err = mutate.Append(img, mutate.Addendum{
+			Layer:   l,
+			History: v1.History{CreatedBy: "layer " + string(rune('0'+i))},
+		})
+		assert.Nil(t, err)
+	}
+	img, err = mutate.Append(img, mutate.Addendum{History: v1.History{CreatedBy: "ENV A=b", EmptyLayer: true}})
+	assert.Nil(t, err)
+
+	dir := t.TempDir()
+	assert.Nil(t, source.WriteImage(context.Background(), img, dir, &utils.PtermLogger{}))
+	return source.NewDir(dir)
+}
+
+// layerFiles reads the names and contents of a layer in dir.
+func layerFiles(t *testing.T, dir *source.Dir, layer digest.Digest) map[string]string {
+	blob, err := ioutil.ReadFile(filepath.Join(dir.Path, source.BlobFileName(layer.String())))
+	assert.Nil(t, err)
+	uncompressed, _, err := compression.AutoDecompress(bytes.NewReader(blob))
+	assert.Nil(t, err)
+
+	files := map[string]string{}
+	tr := tar.NewReader(uncompressed)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		content, err := ioutil.ReadAll(tr)
+		assert.Nil(t, err)
+		files[hdr.Name] = string(content)
+	}
+
+	return files
+}
+
+func TestSquash(t *testing.T) {
+	src := newLayeredLayout(t,
+		layerTar(t, tarEntry{"a/", ""}, tarEntry{"a/x", "x"}, tarEntry{"a/y", "y"}, tarEntry{"b", "b"}, tarEntry{"e/", ""}, tarEntry{"e/f", "f"}),
+		layerTar(t, tarEntry{"a/.wh.x", ""}, tarEntry{"c", "c"}, tarEntry{"e", "e is a file now"}),
+		layerTar(t, tarEntry{"a/.wh..wh..opq", ""}, tarEntry{"a/z", "z"}, tarEntry{".wh.b", ""}, tarEntry{"c", "c2"}),
+		layerTar(t, tarEntry{"d", "d"}),
+	)
+
+	squashed, err := rewrite.Squash(context.Background(), src, t.TempDir(), 2, &utils.PtermLogger{})
+	assert.Nil(t, err)
+
+	manBuffer, err := squashed.Manifest(context.Background())
+	assert.Nil(t, err)
+	manifest, err := man.FromBlob(manBuffer, man.GuessMIMEType(manBuffer))
+	assert.Nil(t, err)
+	layers := manifest.LayerInfos()
+	assert.Equal(t, 2, len(layers))
+
+	merged := layerFiles(t, squashed, layers[0].Digest)
+	names := []string{}
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"a/", "a/z", "c", "e"}, names)
+	assert.Equal(t, "c2", merged["c"])
+	assert.Equal(t, "e is a file now", merged["e"])
+	assert.Equal(t, map[string]string{"d": "d"}, layerFiles(t, squashed, layers[1].Digest))
+
+	config, err := ioutil.ReadFile(filepath.Join(squashed.Path, source.BlobFileName(manifest.ConfigInfo().Digest.String())))
+	assert.Nil(t, err)
+	assert.Equal(t, manifest.ConfigInfo().Digest, digest.FromBytes(config))
+	configFile, err := v1.ParseConfigFile(bytes.NewReader(config))
+	assert.Nil(t, err)
+
+	// The diff ids are those of the uncompressed layers
+	assert.Equal(t, 2, len(configFile.RootFS.DiffIDs))
+	for i, layer := range layers {
+		blob, err := ioutil.ReadFile(filepath.Join(squashed.Path, source.BlobFileName(layer.Digest.String())))
+		assert.Nil(t, err)
+		uncompressed, _, err := compression.AutoDecompress(bytes.NewReader(blob))
+		assert.Nil(t, err)
+		diffID, err := digest.FromReader(uncompressed)
+		assert.Nil(t, err)
+		assert.Equal(t, diffID.String(), configFile.RootFS.DiffIDs[i].String())
+	}
+
+	// History is kept with the merged entries marked empty
+	assert.Equal(t, 5, len(configFile.History))
+	empty := []bool{}
+	for _, entry := range configFile.History {
+		empty = append(empty, entry.EmptyLayer)
+	}
+	assert.Equal(t, []bool{true, true, false, false, true}, empty)
+	assert.Equal(t, "squashed 3 layers", configFile.History[2].Comment)
+	assert.Equal(t, "layer 2", configFile.History[2].CreatedBy)
+
+	// Other config fields are carried over
+	assert.Equal(t, []string{"A=b"}, configFile.Config.Env)
+}
+
+func TestSquashUnderLimit(t *testing.T) {
+	src := newLayout(t, 2)
+	original, err := src.Manifest(context.Background())
+	assert.Nil(t, err)
+
+	squashed, err := rewrite.Squash(context.Background(), src, t.TempDir(), 2, &utils.PtermLogger{})
+	assert.Nil(t, err)
+	manBuffer, err := squashed.Manifest(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, original, manBuffer)
+	assertLayers(t, squashed, "gzip", man.DockerV2Schema2LayerMediaType)
+}
+
+func TestSquashFlags(t *testing.T) {
+	flags := &rewrite.Flags{LayerCompression: rewrite.COMPRESSION_KEEP, SquashTo: -1}
+	assert.NotNil(t, flags.Validate())
+
+	flags.SquashTo = 1
+	rewritten, cleanup, err := flags.Apply(context.Background(), newLayout(t, 3), t.TempDir(), &utils.PtermLogger{})
+	assert.Nil(t, err)
+	defer cleanup()
+	manifest := assertLayers(t, rewritten.(*source.Dir), "gzip", man.DockerV2Schema2LayerMediaType)
+	assert.Equal(t, 1, len(manifest.LayerInfos()))
+}
+
+func TestSquashSameLayerWhiteout(t *testing.T) {
+	src := newLayeredLayout(t,
+		layerTar(t, tarEntry{"a/", ""}, tarEntry{"a/x", "x"}, tarEntry{"w", "w0"}),
+		layerTar(t, tarEntry{"a/y", "y"}, tarEntry{"a/.wh..wh..opq", ""}, tarEntry{"w", "w1"}, tarEntry{".wh.w", ""}),
+	)
+
+	// A whiteout only hides the layers below, not entries of its own layer
+	// that come ahead of it
+	assert.Equal(t, map[string]string{"a/": "", "a/y": "y", "w": "w1"}, squashAll(t, src))
+}
+
+func TestSquashHardLinks(t *testing.T) {
+	src := newLayeredLayout(t,
+		linkLayerTar(t,
+			[]tarEntry{{"kept", "k"}, {"replaced", "old"}, {"removed", "gone"}},
+			[2]string{"kept-link", "kept"}, [2]string{"replaced-link", "replaced"}, [2]string{"removed-link", "removed"},
+		),
+		layerTar(t, tarEntry{"replaced", "new"}, tarEntry{".wh.removed", ""}),
+	)
+
+	// Links whose target changed keep the content they pointed to
+	assert.Equal(t, map[string]string{
+		"kept":          "k",
+		"kept-link":     "",
+		"replaced":      "new",
+		"replaced-link": "old",
+		"removed-link":  "gone",
+	}, squashAll(t, src))
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package scan
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package scan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/pflag"
+)
+
+// Flags holds the command line options for waiting on image scans after a put.
+type Flags struct {
+	Wait         bool
+	Timeout      time.Duration
+	PollInterval time.Duration
+	FailOn       string
+	Report       string
+}
+
+func (f *Flags) AddFlags(flags *pflag.FlagSet) {
+	flags.BoolVarP(&f.Wait, "wait-for-scan", "", false, "wait for the ECR scan on push to complete and report the findings")
+	flags.DurationVarP(&f.Timeout, "scan-timeout", "", DEFAULT_TIMEOUT, "how long to wait for each image scan")
+	flags.DurationVarP(&f.PollInterval, "scan-poll-interval", "", DEFAULT_POLL_INTERVAL, "delay between image scan status checks")
+	flags.StringVarP(&f.FailOn, "scan-fail-on", "", DEFAULT_FAIL_ON, "fail when there are findings of this severity or above, NONE to only report")
+	flags.StringVarP(&f.Report, "scan-report", "", "", "write the scan findings as JSON to this file, - for stdout")
+}
+
+// Validate checks the flags before any image is put, so a bad threshold
+// does not surface only after the uploads are done.
+func (f *Flags) Validate() error {
+	if _, err := ParseSeverity(f.FailOn); err != nil {
+		return fmt.Errorf("invalid --scan-fail-on: %w", err)
+	}
+	return nil
+}
+
+// Run waits for the scan of each image, prints a summary of each and writes
+// the report. An error is returned when any scan failed or has findings at
+// or above the threshold.
+func (f *Flags) Run(ctx context.Context, inputs []*WaitInput) error {
+	threshold, err := ParseSeverity(f.FailOn)
+	if err != nil {
+		return fmt.Errorf("invalid --scan-fail-on: %w", err)
+	}
+
+	results := []*Result{}
+	failed := 0
+	for _, input := range inputs {
+		input.Timeout = f.Timeout
+		input.PollInterval = f.PollInterval
+
+		result, err := Wait(ctx, input)
+		if err != nil {
+			pterm.Error.Printfln("error waiting for the scan of %s:%s in registry %s: %v",
+				input.RepositoryName, input.ImageTag, input.RegistryId, err)
+			failed++
+			continue
+		}
+		results = append(results, result)
+
+		PrintSummary(result)
+		if result.Status == STATUS_NOT_SCANNED {
+			continue
+		}
+		if n := result.Exceeds(threshold); n > 0 {
+			pterm.Error.Printfln("%s:%s in registry %s has %d finding(s) of severity %s or above",
+				result.RepositoryName, result.ImageTag, result.RegistryId, n, threshold)
+			failed++
+		}
+	}
+
+	if f.Report != "" {
+		if err := WriteReport(f.Report, results); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d image scan(s) failed or exceeded %s", failed, len(inputs), threshold)
+	}
+
+	return nil
+}
+
+func PrintSummary(result *Result) {
+	pterm.Info.Printfln("scan of %s:%s (%s) in registry %s: %s",
+		result.RepositoryName, result.ImageTag, result.ImageDigest, result.RegistryId, result.Status)
+	if result.Status == STATUS_NOT_SCANNED {
+		pterm.Warning.Printfln("no scan was started, check scan on push is enabled for the repository or registry")
+		return
+	}
+
+	data := pterm.TableData{{"Severity", "Findings"}}
+	for i := len(Severities) - 1; i >= 0; i-- {
+		if n, ok := result.SeverityCounts[Severities[i]]; ok {
+			data = append(data, []string{Severities[i], fmt.Sprint(n)})
+		}
+	}
+	if len(data) == 1 {
+		pterm.Success.Printfln("no findings")
+		return
+	}
+
+	if err := pterm.DefaultTable.WithHasHeader().WithData(data).Render(); err != nil {
+		pterm.Warning.Printfln("error rendering scan summary: %v", err)
+	}
+}
+
+// WriteReport writes the results as a JSON array to path, or stdout for "-".
+func WriteReport(path string, results []*Result) error {
+	buf, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding scan report: %w", err)
+	}
+
+	if path == "-" {
+		_, err = os.Stdout.Write(append(buf, '\n'))
+	} else {
+		err = ioutil.WriteFile(path, buf, 0o644)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing scan report: %w", err)
+	}
+
+	return nil
+}
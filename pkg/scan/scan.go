@@ -0,0 +1,240 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package scan
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package scan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	lgr "docker-reassembler/pkg/logger"
+	"docker-reassembler/pkg/retry"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrTypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/pterm/pterm"
+)
+
+const (
+	DEFAULT_TIMEOUT       = 10 * time.Minute
+	DEFAULT_POLL_INTERVAL = 10 * time.Second
+	DEFAULT_FAIL_ON       = "CRITICAL"
+	// FAIL_ON_NONE reports the findings without failing on any severity
+	FAIL_ON_NONE = "NONE"
+	// DEFAULT_NOT_FOUND_GRACE is how long a scan may go unregistered after
+	// the put before the image is reported as not scanned
+	DEFAULT_NOT_FOUND_GRACE = 30 * time.Second
+	// STATUS_NOT_SCANNED is the result status of an image ECR never started
+	// a scan for, usually because scan on push is disabled
+	STATUS_NOT_SCANNED = "NOT_SCANNED"
+)
+
+// Severities from least to most severe.
+var Severities = []string{"UNDEFINED", "INFORMATIONAL", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+type IScanClient interface {
+	DescribeImageScanFindings(ctx context.Context, params *ecr.DescribeImageScanFindingsInput,
+		optFns ...func(*ecr.Options)) (*ecr.DescribeImageScanFindingsOutput, error)
+}
+
+type WaitInput struct {
+	Client         IScanClient
+	RegistryId     string
+	RepositoryName string
+	ImageTag       string
+	ImageDigest    string
+	Timeout        time.Duration
+	PollInterval   time.Duration
+	NotFoundGrace  time.Duration
+	Retry          retry.Policy
+	Logger         lgr.ILogger
+}
+
+type Finding struct {
+	Name        string `json:"name"`
+	Severity    string `json:"severity"`
+	Description string `json:"description,omitempty"`
+	Uri         string `json:"uri,omitempty"`
+}
+
+// Result is the completed scan of one image, it is what the JSON report holds.
+type Result struct {
+	RegistryId     string           `json:"registryId"`
+	RepositoryName string           `json:"repositoryName"`
+	ImageTag       string           `json:"imageTag"`
+	ImageDigest    string           `json:"imageDigest"`
+	Status         string           `json:"status"`
+	CompletedAt    *time.Time       `json:"completedAt,omitempty"`
+	SeverityCounts map[string]int32 `json:"severityCounts"`
+	Findings       []Finding        `json:"findings"`
+}
+
+// ParseSeverity normalises a --scan-fail-on threshold.
+func ParseSeverity(severity string) (string, error) {
+	severity = strings.ToUpper(strings.TrimSpace(severity))
+	if severity == FAIL_ON_NONE {
+		return severity, nil
+	}
+	if severityRank(severity) < 0 {
+		return "", fmt.Errorf("unknown severity %q, expected one of %s or %s",
+			severity, strings.Join(Severities, ", "), FAIL_ON_NONE)
+	}
+
+	return severity, nil
+}
+
+func severityRank(severity string) int {
+	for i, s := range Severities {
+		if s == severity {
+			return i
+		}
+	}
+	return -1
+}
+
+// Exceeds returns the number of findings at or above threshold.
+func (r *Result) Exceeds(threshold string) int32 {
+	if threshold == FAIL_ON_NONE {
+		return 0
+	}
+
+	var count int32
+	for severity, n := range r.SeverityCounts {
+		if severityRank(severity) >= severityRank(threshold) {
+			count += n
+		}
+	}
+	return count
+}
+
+// Wait polls the scan of the image until it completes or the timeout is
+// reached, then reads every finding. An image with no scan registered once
+// the grace period is over is returned as not scanned.
+func Wait(ctx context.Context, input *WaitInput) (*Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, input.Timeout)
+	defer cancel()
+
+	grace := input.NotFoundGrace
+	if grace <= 0 {
+		grace = DEFAULT_NOT_FOUND_GRACE
+	}
+	notFoundUntil := time.Now().Add(grace)
+
+	params := &ecr.DescribeImageScanFindingsInput{
+		RegistryId:     aws.String(input.RegistryId),
+		RepositoryName: aws.String(input.RepositoryName),
+		ImageId:        &ecrTypes.ImageIdentifier{ImageDigest: aws.String(input.ImageDigest)},
+	}
+
+	input.Logger.Printfln(pterm.Info, "waiting up to %s for the scan of %s:%s", input.Timeout, input.RepositoryName, input.ImageTag)
+	for {
+		var output *ecr.DescribeImageScanFindingsOutput
+		_, err := retry.Do(ctx, input.Retry, input.Logger, "DescribeImageScanFindings", func() (err error) {
+			output, err = input.Client.DescribeImageScanFindings(ctx, params)
+			return err
+		})
+
+		// The scan is not always registered as soon as the put returns
+		var notFound *ecrTypes.ScanNotFoundException
+		if err != nil && !errors.As(err, &notFound) {
+			return nil, fmt.Errorf("error describing image scan findings: %w", err)
+		}
+		if err != nil && time.Now().After(notFoundUntil) {
+			return &Result{
+				RegistryId:     input.RegistryId,
+				RepositoryName: input.RepositoryName,
+				ImageTag:       input.ImageTag,
+				ImageDigest:    input.ImageDigest,
+				Status:         STATUS_NOT_SCANNED,
+				SeverityCounts: map[string]int32{},
+				Findings:       []Finding{},
+			}, nil
+		}
+
+		if err == nil && output.ImageScanStatus != nil {
+			switch output.ImageScanStatus.Status {
+			case ecrTypes.ScanStatusComplete, ecrTypes.ScanStatusActive:
+				return collect(ctx, input, params, output)
+			case ecrTypes.ScanStatusInProgress, ecrTypes.ScanStatusPending:
+				input.Logger.Printfln(pterm.Debug, "scan status %s", output.ImageScanStatus.Status)
+			default:
+				return nil, fmt.Errorf("image scan %s: %s", output.ImageScanStatus.Status,
+					aws.ToString(output.ImageScanStatus.Description))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for the image scan: %w", ctx.Err())
+		case <-time.After(input.PollInterval):
+		}
+	}
+}
+
+func collect(ctx context.Context, input *WaitInput, params *ecr.DescribeImageScanFindingsInput,
+	output *ecr.DescribeImageScanFindingsOutput,
+) (*Result, error) {
+	result := &Result{
+		RegistryId:     input.RegistryId,
+		RepositoryName: input.RepositoryName,
+		ImageTag:       input.ImageTag,
+		ImageDigest:    input.ImageDigest,
+		Status:         string(output.ImageScanStatus.Status),
+		SeverityCounts: map[string]int32{},
+		Findings:       []Finding{},
+	}
+
+	for {
+		if findings := output.ImageScanFindings; findings != nil {
+			result.CompletedAt = findings.ImageScanCompletedAt
+			for severity, n := range findings.FindingSeverityCounts {
+				result.SeverityCounts[severity] = n
+			}
+			for _, f := range findings.Findings {
+				result.Findings = append(result.Findings, Finding{
+					Name:        aws.ToString(f.Name),
+					Severity:    string(f.Severity),
+					Description: aws.ToString(f.Description),
+					Uri:         aws.ToString(f.Uri),
+				})
+			}
+			// Enhanced scanning reports through Amazon Inspector instead
+			for _, f := range findings.EnhancedFindings {
+				finding := Finding{
+					Name:        aws.ToString(f.Title),
+					Severity:    aws.ToString(f.Severity),
+					Description: aws.ToString(f.Description),
+				}
+				if f.PackageVulnerabilityDetails != nil {
+					finding.Name = aws.ToString(f.PackageVulnerabilityDetails.VulnerabilityId)
+					finding.Uri = aws.ToString(f.PackageVulnerabilityDetails.SourceUrl)
+				}
+				result.Findings = append(result.Findings, finding)
+			}
+		}
+
+		if output.NextToken == nil {
+			break
+		}
+		params.NextToken = output.NextToken
+		_, err := retry.Do(ctx, input.Retry, input.Logger, "DescribeImageScanFindings", func() (err error) {
+			output, err = input.Client.DescribeImageScanFindings(ctx, params)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error describing image scan findings: %w", err)
+		}
+	}
+
+	sort.SliceStable(result.Findings, func(i, j int) bool {
+		return severityRank(result.Findings[i].Severity) > severityRank(result.Findings[j].Severity)
+	})
+
+	return result, nil
+}
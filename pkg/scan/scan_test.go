@@ -0,0 +1,140 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package scan_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package scan_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"docker-reassembler/pkg/scan"
+	"docker-reassembler/pkg/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrTypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockScanClient struct {
+	responses []*ecr.DescribeImageScanFindingsOutput
+	calls     int
+}
+
+func (m *mockScanClient) DescribeImageScanFindings(ctx context.Context, params *ecr.DescribeImageScanFindingsInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.DescribeImageScanFindingsOutput, error) {
+	m.calls++
+	if m.calls == 1 {
+		return nil, &ecrTypes.ScanNotFoundException{}
+	}
+	out := m.responses[0]
+	if len(m.responses) > 1 {
+		m.responses = m.responses[1:]
+	}
+	return out, nil
+}
+
+func complete(token *string, findings ...ecrTypes.ImageScanFinding) *ecr.DescribeImageScanFindingsOutput {
+	return &ecr.DescribeImageScanFindingsOutput{
+		ImageScanStatus: &ecrTypes.ImageScanStatus{Status: ecrTypes.ScanStatusComplete},
+		ImageScanFindings: &ecrTypes.ImageScanFindings{
+			FindingSeverityCounts: map[string]int32{"CRITICAL": 1, "LOW": 1},
+			Findings:              findings,
+		},
+		NextToken: token,
+	}
+}
+
+func TestWait(t *testing.T) {
+	client := &mockScanClient{responses: []*ecr.DescribeImageScanFindingsOutput{
+		{ImageScanStatus: &ecrTypes.ImageScanStatus{Status: ecrTypes.ScanStatusInProgress}},
+		complete(aws.String("next"), ecrTypes.ImageScanFinding{Name: aws.String("CVE-1"), Severity: ecrTypes.FindingSeverityLow}),
+		complete(nil, ecrTypes.ImageScanFinding{Name: aws.String("CVE-2"), Severity: ecrTypes.FindingSeverityCritical}),
+	}}
+
+	result, err := scan.Wait(context.Background(), &scan.WaitInput{
+		Client:         client,
+		RegistryId:     "123456789012",
+		RepositoryName: "app",
+		ImageTag:       "1.0",
+		ImageDigest:    "sha256:abc",
+		Timeout:        time.Second,
+		PollInterval:   time.Millisecond,
+		Logger:         &utils.PtermLogger{},
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "COMPLETE", result.Status)
+	assert.Len(t, result.Findings, 2)
+	assert.Equal(t, "CVE-2", result.Findings[0].Name, "most severe first")
+	assert.Equal(t, int32(1), result.Exceeds("CRITICAL"))
+	assert.Equal(t, int32(2), result.Exceeds("LOW"))
+	assert.Equal(t, int32(0), result.Exceeds(scan.FAIL_ON_NONE))
+}
+
+func TestWaitTimeout(t *testing.T) {
+	client := &mockScanClient{responses: []*ecr.DescribeImageScanFindingsOutput{
+		{ImageScanStatus: &ecrTypes.ImageScanStatus{Status: ecrTypes.ScanStatusInProgress}},
+	}}
+
+	_, err := scan.Wait(context.Background(), &scan.WaitInput{
+		Client:       client,
+		ImageDigest:  "sha256:abc",
+		Timeout:      20 * time.Millisecond,
+		PollInterval: time.Millisecond,
+		Logger:       &utils.PtermLogger{},
+	})
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+type notFoundScanClient struct {
+	calls int
+}
+
+func (m *notFoundScanClient) DescribeImageScanFindings(ctx context.Context, params *ecr.DescribeImageScanFindingsInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.DescribeImageScanFindingsOutput, error) {
+	m.calls++
+	return nil, &ecrTypes.ScanNotFoundException{}
+}
+
+func TestWaitNotScanned(t *testing.T) {
+	client := &notFoundScanClient{}
+
+	result, err := scan.Wait(context.Background(), &scan.WaitInput{
+		Client:         client,
+		RepositoryName: "app",
+		ImageDigest:    "sha256:abc",
+		Timeout:        time.Minute,
+		PollInterval:   time.Millisecond,
+		NotFoundGrace:  20 * time.Millisecond,
+		Logger:         &utils.PtermLogger{},
+	})
+
+	assert.Nil(t, err, "a scan that is never registered does not wait for the timeout")
+	assert.Equal(t, scan.STATUS_NOT_SCANNED, result.Status)
+	assert.Equal(t, "app", result.RepositoryName)
+	assert.Greater(t, client.calls, 1)
+	assert.Equal(t, int32(0), result.Exceeds("LOW"))
+}
+
+func TestFlagsValidate(t *testing.T) {
+	flags := &scan.Flags{FailOn: "high"}
+	assert.Nil(t, flags.Validate())
+
+	flags.FailOn = "urgent"
+	assert.ErrorContains(t, flags.Validate(), "--scan-fail-on")
+}
+
+func TestParseSeverity(t *testing.T) {
+	severity, err := scan.ParseSeverity("high")
+	assert.Nil(t, err)
+	assert.Equal(t, "HIGH", severity)
+
+	_, err = scan.ParseSeverity("urgent")
+	assert.NotNil(t, err)
+}
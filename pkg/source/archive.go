@@ -0,0 +1,270 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package source
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package source
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	lgr "docker-reassembler/pkg/logger"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/opencontainers/go-digest"
+	"github.com/pterm/pterm"
+)
+
+// ExtractLayout unpacks a tar, optionally gzip compressed, of the
+// reassembler layout into dir. It returns the directory holding the
+// manifest, which may be nested inside the archive.
+func ExtractLayout(ctx context.Context, archive, dir string) (string, error) {
+	file, err := os.Open(archive)
+	if err != nil {
+		return "", fmt.Errorf("error opening %q: %w", archive, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var stream io.Reader = reader
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return "", fmt.Errorf("error decompressing %q: %w", archive, err)
+		}
+		defer gz.Close()
+		stream = gz
+	}
+
+	manifests := []string{}
+	tr := tar.NewReader(stream)
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", fmt.Errorf("extracting %q interrupted: %w", archive, err)
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("error reading %q: %w", archive, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("error reading %q: entry %q is outside the archive", archive, hdr.Name)
+		}
+
+		target := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(target), 0o775); err != nil {
+			return "", fmt.Errorf("error creating directories for %q: %w", target, err)
+		}
+		if err := writeFile(target, tr); err != nil {
+			return "", err
+		}
+		if filepath.Base(name) == MANIFEST_FILE_NAME {
+			manifests = append(manifests, filepath.Dir(target))
+		}
+	}
+
+	if len(manifests) != 1 {
+		return "", fmt.Errorf("expected one %s in %q, found %d", MANIFEST_FILE_NAME, archive, len(manifests))
+	}
+
+	return manifests[0], nil
+}
+
+// DockerArchiveTags lists the repository tags of the images in a docker
+// save archive, images saved by id have none.
+func DockerArchiveTags(archive string) ([]string, error) {
+	manifest, err := tarball.LoadManifest(func() (io.ReadCloser, error) { return os.Open(archive) })
+	if err != nil {
+		return nil, fmt.Errorf("error reading docker archive %q: %w", archive, err)
+	}
+
+	tags := []string{}
+	for _, descriptor := range manifest {
+		tags = append(tags, descriptor.RepoTags...)
+	}
+
+	return tags, nil
+}
+
+// ArchiveImage is an image of a docker save archive and the repository and
+// tag it is put to.
+type ArchiveImage struct {
+	// Ref selects the image in the archive, empty for a lone untagged image
+	Ref        string
+	Repository string
+	Tag        string
+}
+
+// DockerArchiveImages works out which images of the archive to put and the
+// repository and tag each is put to. refs defaults to every tagged image of
+// the archive, repository and tag replace the ones the images were saved as.
+func DockerArchiveImages(archive string, refs []string, repository, tag string) ([]ArchiveImage, error) {
+	if len(refs) == 0 {
+		saved, err := DockerArchiveTags(archive)
+		if err != nil {
+			return nil, err
+		}
+		refs = saved
+	}
+	if len(refs) > 1 && tag != "" {
+		return nil, fmt.Errorf("--tag can only be used when importing a single image, found %d", len(refs))
+	}
+
+	if len(refs) == 0 {
+		// An image saved by id has nothing to name it after
+		if repository == "" || tag == "" {
+			return nil, fmt.Errorf("the image in %q has no tag, --repository-name and --tag are required", archive)
+		}
+		return []ArchiveImage{{Repository: repository, Tag: tag}}, nil
+	}
+
+	images := []ArchiveImage{}
+	for _, ref := range refs {
+		saved, err := name.NewTag(ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image %q: %w", ref, err)
+		}
+		image := ArchiveImage{Ref: ref, Repository: savedRepository(ref, saved), Tag: saved.TagStr()}
+		if repository != "" {
+			image.Repository = repository
+		}
+		if tag != "" {
+			image.Tag = tag
+		}
+		images = append(images, image)
+	}
+
+	return images, nil
+}
+
+// savedRepository is the repository an image was saved as, without the
+// registry and without the library/ docker adds to official images.
+func savedRepository(ref string, saved name.Tag) string {
+	repository := saved.RepositoryStr()
+	if saved.RegistryStr() == name.DefaultRegistry && !strings.Contains(ref, "library/") {
+		repository = strings.TrimPrefix(repository, "library/")
+	}
+
+	return repository
+}
+
+// UnpackDockerArchive writes the image tagged tag in a docker save archive
+// to dir in the reassembler layout. Uncompressed layers are gzip compressed
+// and the manifest is rebuilt with their compressed digests. The tag may be
+// empty when the archive holds a single image.
+func UnpackDockerArchive(ctx context.Context, archive, tag, dir string, logger lgr.ILogger) error {
+	var ref *name.Tag
+	if tag != "" {
+		t, err := name.NewTag(tag)
+		if err != nil {
+			return fmt.Errorf("invalid image tag %q: %w", tag, err)
+		}
+		ref = &t
+	}
+
+	img, err := tarball.ImageFromPath(archive, ref)
+	if err != nil {
+		return fmt.Errorf("error reading docker archive %q: %w", archive, err)
+	}
+
+	return WriteImage(ctx, img, dir, logger)
+}
+
+// WriteImage writes the manifest, config and layers of an image to dir in
+// the reassembler layout, checking each blob against its digest.
+func WriteImage(ctx context.Context, img v1.Image, dir string, logger lgr.ILogger) error {
+	manBuffer, err := img.RawManifest()
+	if err != nil {
+		return fmt.Errorf("error building manifest: %w", err)
+	}
+	configName, err := img.ConfigName()
+	if err != nil {
+		return fmt.Errorf("error reading config digest: %w", err)
+	}
+	configBuffer, err := img.RawConfigFile()
+	if err != nil {
+		return fmt.Errorf("error reading config: %w", err)
+	}
+	if err := writeBlob(filepath.Join(dir, BlobFileName(configName.String())), configName.String(),
+		strings.NewReader(string(configBuffer))); err != nil {
+		return err
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return fmt.Errorf("error reading layers: %w", err)
+	}
+	for _, layer := range layers {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("writing image interrupted: %w", err)
+		}
+
+		layerDigest, err := layer.Digest()
+		if err != nil {
+			return fmt.Errorf("error computing layer digest: %w", err)
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			return fmt.Errorf("error reading layer %s: %w", layerDigest, err)
+		}
+		err = writeBlob(filepath.Join(dir, BlobFileName(layerDigest.String())), layerDigest.String(), rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		logger.Printfln(pterm.Debug, "wrote layer %s", layerDigest)
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, MANIFEST_FILE_NAME), manBuffer, 0o644)
+}
+
+// writeBlob writes r to path, only keeping it when it matches dgst.
+func writeBlob(path, dgst string, r io.Reader) error {
+	expected, err := digest.Parse(dgst)
+	if err != nil {
+		return fmt.Errorf("invalid digest %q: %w", dgst, err)
+	}
+
+	verifier := expected.Verifier()
+	if err := writeFile(path, io.TeeReader(r, verifier)); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		os.Remove(path)
+		return fmt.Errorf("blob %s does not match its digest", dgst)
+	}
+
+	return nil
+}
+
+func writeFile(path string, r io.Reader) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating %q: %w", path, err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return fmt.Errorf("error writing %q: %w", path, err)
+	}
+
+	return file.Close()
+}
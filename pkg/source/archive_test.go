@@ -0,0 +1,137 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package source_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package source_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"docker-reassembler/pkg/source"
+	"docker-reassembler/pkg/utils"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/stretchr/testify/assert"
+)
+
+func tarEntries(t *testing.T, files map[string][]byte, order ...string) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, name := range order {
+		assert.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}))
+		_, err := tw.Write(files[name])
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, tw.Close())
+	return buf.Bytes()
+}
+
+// dockerSave builds an archive the way docker save writes one, with
+// uncompressed layer tars, holding an image for each tag.
+func dockerSave(t *testing.T, tags ...string) (string, map[string][]byte) {
+	files := map[string][]byte{}
+	order := []string{}
+	layers := map[string][]byte{}
+	saved := []map[string]interface{}{}
+	for i, tag := range tags {
+		layer := tarEntries(t, map[string][]byte{"hello.txt": []byte(tag)}, "hello.txt")
+		diffID := fmt.Sprintf("sha256:%x", sha256.Sum256(layer))
+		config := []byte(fmt.Sprintf(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[%q]}}`, diffID))
+		configName := fmt.Sprintf("%x.json", sha256.Sum256(config))
+		layerName := fmt.Sprintf("layer%d/layer.tar", i)
+
+		files[configName], files[layerName] = config, layer
+		order = append(order, configName, layerName)
+		layers[tag] = layer
+		saved = append(saved, map[string]interface{}{"Config": configName, "RepoTags": []string{tag}, "Layers": []string{layerName}})
+	}
+	manifestJSON, err := json.Marshal(saved)
+	assert.Nil(t, err)
+	files["manifest.json"] = manifestJSON
+	order = append(order, "manifest.json")
+
+	archive := filepath.Join(t.TempDir(), "saved.tar")
+	assert.Nil(t, ioutil.WriteFile(archive, tarEntries(t, files, order...), 0o644))
+
+	return archive, layers
+}
+
+func TestDockerArchiveTags(t *testing.T) {
+	archive, _ := dockerSave(t, "app:1.0", "registry.example.com/team/api:2.0")
+
+	tags, err := source.DockerArchiveTags(archive)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"app:1.0", "registry.example.com/team/api:2.0"}, tags)
+}
+
+func TestDockerArchiveImages(t *testing.T) {
+	archive, _ := dockerSave(t, "app:1.0", "library/nginx:1.25", "redis:7", "registry.example.com/team/api:2.0")
+
+	images, err := source.DockerArchiveImages(archive, nil, "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, []source.ArchiveImage{
+		{Ref: "app:1.0", Repository: "app", Tag: "1.0"},
+		{Ref: "library/nginx:1.25", Repository: "library/nginx", Tag: "1.25"},
+		{Ref: "redis:7", Repository: "redis", Tag: "7"},
+		{Ref: "registry.example.com/team/api:2.0", Repository: "team/api", Tag: "2.0"},
+	}, images, "the registry and the library/ docker adds are dropped, an explicit library/ is kept")
+
+	images, err = source.DockerArchiveImages(archive, []string{"redis:7"}, "cache", "stable")
+	assert.Nil(t, err)
+	assert.Equal(t, []source.ArchiveImage{{Ref: "redis:7", Repository: "cache", Tag: "stable"}}, images)
+
+	_, err = source.DockerArchiveImages(archive, nil, "", "stable")
+	assert.NotNil(t, err, "one tag for several images")
+
+	_, err = source.DockerArchiveImages(archive, []string{"App:1.0"}, "", "")
+	assert.NotNil(t, err)
+}
+
+func TestDockerArchiveImagesUntagged(t *testing.T) {
+	archive, _ := dockerSave(t)
+
+	_, err := source.DockerArchiveImages(archive, nil, "app", "")
+	assert.NotNil(t, err, "an image saved by id needs a repository and a tag")
+
+	images, err := source.DockerArchiveImages(archive, nil, "app", "1.0")
+	assert.Nil(t, err)
+	assert.Equal(t, []source.ArchiveImage{{Repository: "app", Tag: "1.0"}}, images)
+}
+
+func TestUnpackDockerArchiveCompressesLayers(t *testing.T) {
+	archive, layers := dockerSave(t, "app:1.0", "app:2.0")
+	dir := t.TempDir()
+
+	err := source.UnpackDockerArchive(context.Background(), archive, "app:2.0", dir, &utils.PtermLogger{})
+	assert.Nil(t, err)
+
+	manBuffer, err := source.NewDir(dir).Manifest(context.Background())
+	assert.Nil(t, err)
+	parsed, err := manifest.Schema2FromManifest(manBuffer)
+	assert.Nil(t, err)
+	assert.Len(t, parsed.LayersDescriptors, 1)
+	layer := parsed.LayersDescriptors[0]
+	assert.Equal(t, manifest.DockerV2Schema2LayerMediaType, layer.MediaType)
+
+	blob, err := ioutil.ReadFile(filepath.Join(dir, source.BlobFileName(layer.Digest.String())))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(blob)), layer.Size)
+	gz, err := gzip.NewReader(bytes.NewReader(blob))
+	assert.Nil(t, err)
+	uncompressed, err := ioutil.ReadAll(gz)
+	assert.Nil(t, err)
+	assert.Equal(t, layers["app:2.0"], uncompressed, "the selected image should be unpacked")
+
+	err = source.UnpackDockerArchive(context.Background(), archive, "", t.TempDir(), &utils.PtermLogger{})
+	assert.NotNil(t, err, "an image must be picked from an archive holding several")
+}
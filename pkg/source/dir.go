@@ -0,0 +1,52 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package source
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package source
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Dir reads an image from a local directory in the reassembler layout.
+// Blob files stay open until Close.
+type Dir struct {
+	Path  string
+	files blobFiles
+}
+
+func NewDir(path string) *Dir {
+	return &Dir{Path: path}
+}
+
+func (d *Dir) Manifest(ctx context.Context) ([]byte, error) {
+	manifestPath := filepath.Join(d.Path, MANIFEST_FILE_NAME)
+	manBuffer, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %q: %w", manifestPath, err)
+	}
+
+	return manBuffer, nil
+}
+
+func (d *Dir) BlobSize(ctx context.Context, digest string) (int64, error) {
+	blobPath := filepath.Join(d.Path, BlobFileName(digest))
+	fi, err := os.Stat(blobPath)
+	if err != nil {
+		return 0, fmt.Errorf("error reading file info for %s: %w", blobPath, err)
+	}
+
+	return fi.Size(), nil
+}
+
+func (d *Dir) ReadBlobAt(ctx context.Context, digest string, p []byte, off int64) (int, error) {
+	return d.files.readAt(filepath.Join(d.Path, BlobFileName(digest)), p, off)
+}
+
+func (d *Dir) Close() error {
+	return d.files.Close()
+}
@@ -0,0 +1,38 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package source_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package source_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"docker-reassembler/pkg/source"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirKeepsBlobOpen(t *testing.T) {
+	dir := t.TempDir()
+	blobPath := filepath.Join(dir, "sha256__abcdef")
+	assert.Nil(t, ioutil.WriteFile(blobPath, []byte("0123456789"), 0o644))
+
+	src := source.NewDir(dir)
+	part := make([]byte, 4)
+	_, err := src.ReadBlobAt(context.Background(), "sha256:abcdef", part, 0)
+	assert.Nil(t, err)
+
+	// Later parts are read through the handle opened for the first one
+	assert.Nil(t, os.Remove(blobPath))
+	n, err := src.ReadBlobAt(context.Background(), "sha256:abcdef", part, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, "4567", string(part[:n]))
+
+	assert.Nil(t, src.Close())
+	_, err = src.ReadBlobAt(context.Background(), "sha256:abcdef", part, 4)
+	assert.NotNil(t, err, "Close releases the handle")
+}
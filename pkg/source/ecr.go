@@ -0,0 +1,211 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package source
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package source
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	lgr "docker-reassembler/pkg/logger"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrTypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	man "github.com/containers/image/v5/manifest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type IECRPullClient interface {
+	BatchGetImage(ctx context.Context, params *ecr.BatchGetImageInput,
+		optFns ...func(*ecr.Options)) (*ecr.BatchGetImageOutput, error)
+
+	GetDownloadUrlForLayer(ctx context.Context, params *ecr.GetDownloadUrlForLayerInput,
+		optFns ...func(*ecr.Options)) (*ecr.GetDownloadUrlForLayerOutput, error)
+}
+
+type IECRListClient interface {
+	ListImages(ctx context.Context, params *ecr.ListImagesInput,
+		optFns ...func(*ecr.Options)) (*ecr.ListImagesOutput, error)
+}
+
+type IHTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// ECR reads an image out of an ECR repository, the manifest through
+// BatchGetImage and the blobs through the pre-signed layer download urls.
+type ECR struct {
+	Client         IECRPullClient
+	HTTPClient     IHTTPClient
+	RegistryId     string
+	RepositoryName string
+	Tag            string
+	Logger         lgr.ILogger
+
+	mu       sync.Mutex
+	manifest []byte
+	sizes    map[string]int64
+	urls     map[string]string
+}
+
+func NewECR(client IECRPullClient, registryId, repositoryName, tag string, logger lgr.ILogger) *ECR {
+	return &ECR{
+		Client:         client,
+		HTTPClient:     http.DefaultClient,
+		RegistryId:     registryId,
+		RepositoryName: repositoryName,
+		Tag:            tag,
+		Logger:         logger,
+	}
+}
+
+func (e *ECR) Manifest(ctx context.Context) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.manifest != nil {
+		return e.manifest, nil
+	}
+
+	input := &ecr.BatchGetImageInput{
+		ImageIds:       []ecrTypes.ImageIdentifier{{ImageTag: aws.String(e.Tag)}},
+		RepositoryName: aws.String(e.RepositoryName),
+		AcceptedMediaTypes: []string{
+			man.DockerV2Schema2MediaType,
+			imgspecv1.MediaTypeImageManifest,
+		},
+	}
+	if e.RegistryId != "" {
+		input.RegistryId = aws.String(e.RegistryId)
+	}
+
+	out, err := e.Client.BatchGetImage(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("error getting image %s:%s: %w", e.RepositoryName, e.Tag, err)
+	}
+	for _, failure := range out.Failures {
+		return nil, fmt.Errorf("error getting image %s:%s: %s: %s", e.RepositoryName, e.Tag,
+			failure.FailureCode, aws.ToString(failure.FailureReason))
+	}
+	if len(out.Images) != 1 || out.Images[0].ImageManifest == nil {
+		return nil, fmt.Errorf("image %s:%s not found", e.RepositoryName, e.Tag)
+	}
+
+	manBuffer := []byte(*out.Images[0].ImageManifest)
+	e.sizes, err = blobSizes(manBuffer, e.Logger)
+	if err != nil {
+		return nil, err
+	}
+	e.manifest = manBuffer
+
+	return e.manifest, nil
+}
+
+func (e *ECR) BlobSize(ctx context.Context, digest string) (int64, error) {
+	if _, err := e.Manifest(ctx); err != nil {
+		return 0, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	size, ok := e.sizes[digest]
+	if !ok || size < 0 {
+		return 0, fmt.Errorf("blob %s has no known size in the manifest of %s:%s", digest, e.RepositoryName, e.Tag)
+	}
+
+	return size, nil
+}
+
+func (e *ECR) ReadBlobAt(ctx context.Context, digest string, p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// Download urls are short lived, so fetch a fresh one if it is refused
+	for attempt := 0; ; attempt++ {
+		url, err := e.downloadUrl(ctx, digest, attempt > 0)
+		if err != nil {
+			return 0, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return 0, fmt.Errorf("error creating request for %s: %w", digest, err)
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+
+		resp, err := e.HTTPClient.Do(req)
+		if err != nil {
+			return 0, fmt.Errorf("error downloading %s: %w", digest, err)
+		}
+
+		if resp.StatusCode == http.StatusForbidden && attempt == 0 {
+			resp.Body.Close()
+			continue
+		}
+
+		defer resp.Body.Close()
+		return readRange(resp, digest, p, off)
+	}
+}
+
+func (e *ECR) downloadUrl(ctx context.Context, digest string, refresh bool) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if url, ok := e.urls[digest]; ok && !refresh {
+		return url, nil
+	}
+
+	input := &ecr.GetDownloadUrlForLayerInput{
+		LayerDigest:    aws.String(digest),
+		RepositoryName: aws.String(e.RepositoryName),
+	}
+	if e.RegistryId != "" {
+		input.RegistryId = aws.String(e.RegistryId)
+	}
+
+	out, err := e.Client.GetDownloadUrlForLayer(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("error getting download url for %s: %w", digest, err)
+	}
+
+	if e.urls == nil {
+		e.urls = map[string]string{}
+	}
+	e.urls[digest] = aws.ToString(out.DownloadUrl)
+
+	return e.urls[digest], nil
+}
+
+// ECRTags lists the tags of every tagged image in an ECR repository.
+func ECRTags(ctx context.Context, client IECRListClient, registryId, repositoryName string) ([]string, error) {
+	input := &ecr.ListImagesInput{
+		RepositoryName: aws.String(repositoryName),
+		Filter:         &ecrTypes.ListImagesFilter{TagStatus: ecrTypes.TagStatusTagged},
+	}
+	if registryId != "" {
+		input.RegistryId = aws.String(registryId)
+	}
+
+	tags := []string{}
+	pager := ecr.NewListImagesPaginator(client, input)
+	for pager.HasMorePages() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error listing images in %s: %w", repositoryName, err)
+		}
+		for _, id := range page.ImageIds {
+			if id.ImageTag != nil {
+				tags = append(tags, *id.ImageTag)
+			}
+		}
+	}
+
+	return tags, nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package source
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package source
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// blobFiles keeps one open handle per blob file, so a blob read part by
+// part, or by several uploads at once, is only opened once. The zero value
+// is ready to use.
+type blobFiles struct {
+	mu    sync.Mutex
+	files map[string]*os.File
+}
+
+func (b *blobFiles) readAt(path string, p []byte, off int64) (int, error) {
+	file, err := b.open(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return file.ReadAt(p, off)
+}
+
+func (b *blobFiles) open(path string) (*os.File, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if file, ok := b.files[path]; ok {
+		return file, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %q: %w", path, err)
+	}
+	if b.files == nil {
+		b.files = map[string]*os.File{}
+	}
+	b.files[path] = file
+
+	return file, nil
+}
+
+// Close closes every open handle, later reads open them again.
+func (b *blobFiles) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var firstErr error
+	for path, file := range b.files {
+		if err := file.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("error closing %q: %w", path, err)
+		}
+	}
+	b.files = nil
+
+	return firstErr
+}
@@ -0,0 +1,112 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package source
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package source
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/opencontainers/go-digest"
+)
+
+// OCI_REF_NAME_ANNOTATION holds the tag of an image in an OCI layout index.
+const OCI_REF_NAME_ANNOTATION = "org.opencontainers.image.ref.name"
+
+// OCILayout reads an image from an OCI image layout directory in place.
+// Blob files stay open until Close.
+type OCILayout struct {
+	Path     string
+	manifest []byte
+	files    blobFiles
+}
+
+// NewOCILayout selects the image tagged tag in the layout at path, the tag
+// may be left out when the layout holds a single image.
+func NewOCILayout(path, tag string) (*OCILayout, error) {
+	index, err := layout.ImageIndexFromPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading OCI layout %q: %w", path, err)
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("error reading index of OCI layout %q: %w", path, err)
+	}
+
+	found := []v1.Descriptor{}
+	for _, desc := range indexManifest.Manifests {
+		if tag == "" || desc.Annotations[OCI_REF_NAME_ANNOTATION] == tag {
+			found = append(found, desc)
+		}
+	}
+	if len(found) != 1 {
+		if tag == "" {
+			return nil, fmt.Errorf("OCI layout %q holds %d images, add :<tag> to pick one", path, len(found))
+		}
+		return nil, fmt.Errorf("found %d images tagged %q in OCI layout %q", len(found), tag, path)
+	}
+
+	desc := found[0]
+	if desc.MediaType.IsIndex() {
+		// ECR takes a single image, so pick linux/amd64 out of a
+		// multi-arch index as the registry source does
+		child, err := index.ImageIndex(desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("error reading index %s: %w", desc.Digest, err)
+		}
+		childManifest, err := child.IndexManifest()
+		if err != nil {
+			return nil, fmt.Errorf("error reading index %s: %w", desc.Digest, err)
+		}
+		platform := v1.Platform{OS: "linux", Architecture: "amd64"}
+		matched := false
+		for _, m := range childManifest.Manifests {
+			if m.Platform != nil && m.Platform.OS == platform.OS && m.Platform.Architecture == platform.Architecture {
+				desc, matched = m, true
+				break
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no %s/%s image in index %s", platform.OS, platform.Architecture, desc.Digest)
+		}
+	}
+
+	l := &OCILayout{Path: path}
+	if l.manifest, err = ioutil.ReadFile(l.blobPath(desc.Digest.String())); err != nil {
+		return nil, fmt.Errorf("error reading manifest %s: %w", desc.Digest, err)
+	}
+
+	return l, nil
+}
+
+func (l *OCILayout) blobPath(dgst string) string {
+	d := digest.Digest(dgst)
+	return filepath.Join(l.Path, "blobs", d.Algorithm().String(), d.Encoded())
+}
+
+func (l *OCILayout) Manifest(ctx context.Context) ([]byte, error) {
+	return l.manifest, nil
+}
+
+func (l *OCILayout) BlobSize(ctx context.Context, digest string) (int64, error) {
+	fi, err := os.Stat(l.blobPath(digest))
+	if err != nil {
+		return 0, fmt.Errorf("error reading file info for %s: %w", digest, err)
+	}
+
+	return fi.Size(), nil
+}
+
+func (l *OCILayout) ReadBlobAt(ctx context.Context, digest string, p []byte, off int64) (int, error) {
+	return l.files.readAt(l.blobPath(digest), p, off)
+}
+
+func (l *OCILayout) Close() error {
+	return l.files.Close()
+}
@@ -0,0 +1,53 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package source
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package source
+
+import (
+	"bufio"
+	"context"
+	"io"
+)
+
+// Sequential reads are issued in chunks of this size so sources backed by
+// remote calls are not hit once per small Read
+const BLOB_READ_CHUNK_SIZE = 8388608
+
+type blobReader struct {
+	ctx    context.Context
+	src    ISource
+	digest string
+	off    int64
+	size   int64
+}
+
+// NewBlobReader reads a whole blob of the given size from a source in order.
+func NewBlobReader(ctx context.Context, src ISource, digest string, size int64) io.Reader {
+	return bufio.NewReaderSize(&blobReader{
+		ctx:    ctx,
+		src:    src,
+		digest: digest,
+		size:   size,
+	}, BLOB_READ_CHUNK_SIZE)
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if remaining := r.size - r.off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := r.src.ReadBlobAt(r.ctx, r.digest, p, r.off)
+	r.off += int64(n)
+	if err == io.EOF {
+		if r.off < r.size {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+
+	return n, err
+}
@@ -0,0 +1,174 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package source
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package source
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	lgr "docker-reassembler/pkg/logger"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// Registry reads an image from any registry implementing the OCI
+// Distribution API, such as a registry:2 container.
+type Registry struct {
+	Ref    name.Reference
+	Auth   authn.Authenticator
+	Logger lgr.ILogger
+
+	mu       sync.Mutex
+	client   *http.Client
+	manifest []byte
+	sizes    map[string]int64
+}
+
+func registryNameOptions(insecure bool) []name.Option {
+	if insecure {
+		return []name.Option{name.Insecure}
+	}
+	return nil
+}
+
+// NewRegistry parses reference (registry/repository:tag) and reads it with
+// auth, insecure allows plain http for local registries.
+func NewRegistry(reference string, insecure bool, auth authn.Authenticator, logger lgr.ILogger) (*Registry, error) {
+	ref, err := name.ParseReference(reference, registryNameOptions(insecure)...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image reference %q: %w", reference, err)
+	}
+
+	if auth == nil {
+		auth = authn.Anonymous
+	}
+
+	return &Registry{Ref: ref, Auth: auth, Logger: logger}, nil
+}
+
+func (r *Registry) Manifest(ctx context.Context) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.manifest != nil {
+		return r.manifest, nil
+	}
+
+	desc, err := remote.Get(r.Ref, remote.WithAuth(r.Auth), remote.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error getting image %s: %w", r.Ref, err)
+	}
+
+	manBuffer := desc.Manifest
+	if desc.MediaType.IsIndex() {
+		// ECR takes a single image, so pick the default platform out of
+		// a multi-arch index
+		img, err := desc.Image()
+		if err != nil {
+			return nil, fmt.Errorf("error resolving image from index %s: %w", r.Ref, err)
+		}
+		manBuffer, err = img.RawManifest()
+		if err != nil {
+			return nil, fmt.Errorf("error reading manifest of %s: %w", r.Ref, err)
+		}
+	}
+
+	r.sizes, err = blobSizes(manBuffer, r.Logger)
+	if err != nil {
+		return nil, err
+	}
+	r.manifest = manBuffer
+
+	return r.manifest, nil
+}
+
+func (r *Registry) BlobSize(ctx context.Context, digest string) (int64, error) {
+	if _, err := r.Manifest(ctx); err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	size, ok := r.sizes[digest]
+	if !ok || size < 0 {
+		return 0, fmt.Errorf("blob %s has no known size in the manifest of %s", digest, r.Ref)
+	}
+
+	return size, nil
+}
+
+func (r *Registry) ReadBlobAt(ctx context.Context, digest string, p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	client, err := r.httpClient(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	repo := r.Ref.Context()
+	url := fmt.Sprintf("%s://%s/v2/%s/blobs/%s",
+		repo.Registry.Scheme(), repo.RegistryStr(), repo.RepositoryStr(), digest)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error creating request for %s: %w", digest, err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error downloading %s: %w", digest, err)
+	}
+	defer resp.Body.Close()
+
+	return readRange(resp, digest, p, off)
+}
+
+// httpClient returns a client that negotiates registry auth (including
+// bearer token exchange) for pulls from the repository.
+func (r *Registry) httpClient(ctx context.Context) (*http.Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.client != nil {
+		return r.client, nil
+	}
+
+	repo := r.Ref.Context()
+	tr, err := transport.NewWithContext(ctx, repo.Registry, r.Auth, http.DefaultTransport,
+		[]string{repo.Scope(transport.PullScope)})
+	if err != nil {
+		return nil, fmt.Errorf("error authenticating with %s: %w", repo.RegistryStr(), err)
+	}
+	r.client = &http.Client{Transport: tr}
+
+	return r.client, nil
+}
+
+// RegistryTags lists the tags of a repository (registry/repository).
+func RegistryTags(ctx context.Context, repository string, insecure bool, auth authn.Authenticator) ([]string, error) {
+	repo, err := name.NewRepository(repository, registryNameOptions(insecure)...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository %q: %w", repository, err)
+	}
+
+	if auth == nil {
+		auth = authn.Anonymous
+	}
+
+	tags, err := remote.List(repo, remote.WithAuth(auth), remote.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error listing tags of %s: %w", repository, err)
+	}
+
+	return tags, nil
+}
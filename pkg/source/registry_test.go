@@ -0,0 +1,70 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package source_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package source_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"docker-reassembler/pkg/source"
+	"docker-reassembler/pkg/utils"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistrySource(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	img, err := random.Image(2048, 2)
+	assert.Nil(t, err)
+	ref, err := name.ParseReference(host+"/team/app:1.0", name.Insecure)
+	assert.Nil(t, err)
+	assert.Nil(t, remote.Write(ref, img))
+
+	tags, err := source.RegistryTags(context.Background(), host+"/team/app", true, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1.0"}, tags)
+
+	src, err := source.NewRegistry(host+"/team/app:1.0", true, nil, &utils.PtermLogger{})
+	assert.Nil(t, err)
+
+	manifest, err := src.Manifest(context.Background())
+	assert.Nil(t, err)
+	expected, err := img.RawManifest()
+	assert.Nil(t, err)
+	assert.Equal(t, expected, manifest)
+
+	layers, err := img.Layers()
+	assert.Nil(t, err)
+	digest, err := layers[1].Digest()
+	assert.Nil(t, err)
+	rc, err := layers[1].Compressed()
+	assert.Nil(t, err)
+	blob, err := ioutil.ReadAll(rc)
+	assert.Nil(t, err)
+
+	size, err := src.BlobSize(context.Background(), digest.String())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(blob)), size)
+
+	part := make([]byte, 100)
+	n, err := src.ReadBlobAt(context.Background(), digest.String(), part, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, n)
+	assert.Equal(t, blob[10:110], part)
+
+	whole, err := ioutil.ReadAll(source.NewBlobReader(context.Background(), src, digest.String(), size))
+	assert.Nil(t, err)
+	assert.Equal(t, blob, whole)
+}
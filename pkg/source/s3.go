@@ -0,0 +1,142 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package source
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package source
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+
+	lgr "docker-reassembler/pkg/logger"
+	"docker-reassembler/pkg/metrics"
+	"docker-reassembler/pkg/retry"
+	"docker-reassembler/pkg/throttle"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type IS3ObjectAPI interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput,
+		optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput,
+		optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+}
+
+// S3 streams an image straight out of a bucket prefix in the reassembler
+// layout using ranged reads, nothing is staged on local disk.
+type S3 struct {
+	Client IS3ObjectAPI
+	Bucket string
+	Prefix string
+	// Limiter holds back blob reads, nil for no limit
+	Limiter *throttle.Limiter
+	// Retry is the policy for blob reads, the default one when not set
+	Retry  retry.Policy
+	Logger lgr.ILogger
+}
+
+func NewS3(client IS3ObjectAPI, bucket, prefix string) *S3 {
+	return &S3{Client: client, Bucket: bucket, Prefix: prefix}
+}
+
+func (s *S3) key(name string) string {
+	return path.Join(s.Prefix, name)
+}
+
+func (s *S3) Manifest(ctx context.Context) ([]byte, error) {
+	out, err := s.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(MANIFEST_FILE_NAME)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting s3://%s/%s: %w", s.Bucket, s.key(MANIFEST_FILE_NAME), err)
+	}
+	defer out.Body.Close()
+
+	manBuffer, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	return manBuffer, nil
+}
+
+func (s *S3) BlobSize(ctx context.Context, digest string) (int64, error) {
+	key := s.key(BlobFileName(digest))
+	out, err := s.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error getting s3://%s/%s: %w", s.Bucket, key, err)
+	}
+
+	return out.ContentLength, nil
+}
+
+func (s *S3) retryPolicy() retry.Policy {
+	if s.Retry.MaxAttempts == 0 {
+		return retry.DefaultPolicy()
+	}
+	return s.Retry
+}
+
+// ReadBlobAt reads the range under the retry policy, a body cut off part
+// way is resumed by asking for only what is still missing.
+func (s *S3) ReadBlobAt(ctx context.Context, digest string, p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	key := s.key(BlobFileName(digest))
+	n, eof := 0, false
+	_, err := retry.Do(ctx, s.retryPolicy(), s.Logger, "GetObject", func() error {
+		read, err := s.readRange(ctx, key, p[n:], off+int64(n))
+		n += read
+		if err == io.EOF {
+			eof = true
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return n, err
+	}
+	if eof {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// readRange makes a single ranged read of key into p.
+func (s *S3) readRange(ctx context.Context, key string, p []byte, off int64) (int, error) {
+	out, err := s.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1)),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error getting s3://%s/%s: %w", s.Bucket, key, err)
+	}
+	defer out.Body.Close()
+
+	// A body shorter than the range S3 promised was cut off, only a range
+	// running past the end of the object is a real end of file
+	n, err := io.ReadFull(s.Limiter.Reader(ctx, out.Body), p)
+	metrics.BytesDownloaded.Add(float64(n))
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = io.EOF
+		if int64(n) < out.ContentLength {
+			err = fmt.Errorf("error reading s3://%s/%s: got %d of %d bytes: %w",
+				s.Bucket, key, n, out.ContentLength, io.ErrUnexpectedEOF)
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package source_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package source_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"docker-reassembler/pkg/metrics"
+	"docker-reassembler/pkg/retry"
+	"docker-reassembler/pkg/source"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockS3ObjectAPI struct {
+	objects map[string][]byte
+	// truncate cuts bodies short of the length they claim
+	truncate int
+	gets     int
+}
+
+func (m *mockS3ObjectAPI) GetObject(ctx context.Context, params *s3.GetObjectInput,
+	optFns ...func(*s3.Options),
+) (*s3.GetObjectOutput, error) {
+	m.gets++
+	obj, ok := m.objects[*params.Key]
+	if !ok {
+		return nil, fmt.Errorf("no such key %q", *params.Key)
+	}
+
+	if params.Range != nil {
+		var first, last int
+		if _, err := fmt.Sscanf(*params.Range, "bytes=%d-%d", &first, &last); err != nil {
+			return nil, err
+		}
+		if last >= len(obj) {
+			last = len(obj) - 1
+		}
+		obj = obj[first : last+1]
+	}
+	length := int64(len(obj))
+	if m.truncate > 0 && m.truncate < len(obj) {
+		obj = obj[:m.truncate]
+	}
+
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(obj)), ContentLength: length}, nil
+}
+
+func (m *mockS3ObjectAPI) HeadObject(ctx context.Context, params *s3.HeadObjectInput,
+	optFns ...func(*s3.Options),
+) (*s3.HeadObjectOutput, error) {
+	obj, ok := m.objects[*params.Key]
+	if !ok {
+		return nil, fmt.Errorf("no such key %q", *params.Key)
+	}
+
+	return &s3.HeadObjectOutput{ContentLength: int64(len(obj))}, nil
+}
+
+func TestS3Source(t *testing.T) {
+	client := &mockS3ObjectAPI{objects: map[string][]byte{
+		"images/app/1.0/manifest.json":  []byte(`{"schemaVersion":2}`),
+		"images/app/1.0/sha256__abcdef": []byte("0123456789"),
+	}}
+	src := source.NewS3(client, "bucket", "images/app/1.0/")
+
+	manifest, err := src.Manifest(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, `{"schemaVersion":2}`, string(manifest))
+
+	size, err := src.BlobSize(context.Background(), "sha256:abcdef")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), size)
+
+	downloaded := testutil.ToFloat64(metrics.BytesDownloaded)
+	part := make([]byte, 4)
+	n, err := src.ReadBlobAt(context.Background(), "sha256:abcdef", part, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, "3456", string(part))
+	assert.Equal(t, downloaded+4, testutil.ToFloat64(metrics.BytesDownloaded))
+
+	part = make([]byte, 4)
+	n, err = src.ReadBlobAt(context.Background(), "sha256:abcdef", part, 8)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "89", string(part[:n]))
+
+	_, err = src.BlobSize(context.Background(), "sha256:missing")
+	assert.NotNil(t, err)
+
+}
+
+func TestS3SourceResumesCutOffBody(t *testing.T) {
+	client := &mockS3ObjectAPI{objects: map[string][]byte{"sha256__abcdef": []byte("0123456789")}, truncate: 2}
+	src := source.NewS3(client, "bucket", "")
+	src.Retry = retry.Policy{MaxAttempts: 2}
+
+	part := make([]byte, 4)
+	n, err := src.ReadBlobAt(context.Background(), "sha256:abcdef", part, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, "3456", string(part), "the rest of the range is asked for again")
+	assert.Equal(t, 2, client.gets)
+
+	client.truncate, client.gets = 1, 0
+	part = make([]byte, 4)
+	n, err = src.ReadBlobAt(context.Background(), "sha256:abcdef", part, 3)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF, "a cut off body is not the end of the blob")
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 2, client.gets)
+}
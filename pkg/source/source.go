@@ -0,0 +1,88 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package source
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package source
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	dkr "docker-reassembler/pkg/docker"
+	lgr "docker-reassembler/pkg/logger"
+)
+
+const MANIFEST_FILE_NAME = "manifest.json"
+
+// ISource is the view of an image that upload consumes: a manifest and
+// random access to the blobs it references.
+type ISource interface {
+	Manifest(ctx context.Context) ([]byte, error)
+	BlobSize(ctx context.Context, digest string) (int64, error)
+	ReadBlobAt(ctx context.Context, digest string, p []byte, off int64) (int, error)
+}
+
+// BlobFileName is the name blobs are stored under in the reassembler
+// layout, sha256:<hex> becomes sha256__<hex>.
+func BlobFileName(digest string) string {
+	return strings.Replace(digest, ":", "__", 1)
+}
+
+// BlobFileNames lists the files the config and layers of a manifest are
+// stored under in the reassembler layout.
+func BlobFileNames(manBuffer []byte, logger lgr.ILogger) ([]string, error) {
+	sizes, err := blobSizes(manBuffer, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for digest := range sizes {
+		names = append(names, BlobFileName(digest))
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// blobSizes maps the config and layer digests of a manifest to their sizes.
+func blobSizes(manBuffer []byte, logger lgr.ILogger) (map[string]int64, error) {
+	manifest, err := dkr.FromBlob(manBuffer, logger)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing manifest from blob: %w", err)
+	}
+
+	sizes := map[string]int64{manifest.ConfigInfo().Digest.String(): manifest.ConfigInfo().Size}
+	for _, layer := range manifest.LayerInfos() {
+		sizes[layer.Digest.String()] = layer.Size
+	}
+
+	return sizes, nil
+}
+
+// readRange fills p from the response to a ranged blob request. Servers
+// that ignore the Range header send the whole blob, so the bytes before
+// off are skipped.
+func readRange(resp *http.Response, digest string, p []byte, off int64) (int, error) {
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, off); err != nil {
+			return 0, fmt.Errorf("error skipping to offset %d of %s: %w", off, digest, err)
+		}
+	default:
+		return 0, fmt.Errorf("error downloading %s: unexpected status %s", digest, resp.Status)
+	}
+
+	n, err := io.ReadFull(resp.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
@@ -0,0 +1,135 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package source
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package source
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	lgr "docker-reassembler/pkg/logger"
+)
+
+const (
+	SCHEME_S3             = "s3"
+	SCHEME_DIR            = "dir"
+	SCHEME_DOCKER_ARCHIVE = "docker-archive"
+	SCHEME_OCI            = "oci"
+	SCHEME_TAR            = "tar"
+)
+
+// URI names where an image is read from:
+//
+//	s3://bucket/prefix            the reassembler layout in S3
+//	dir:/path                     the reassembler layout in a local directory
+//	docker-archive:/file.tar      a docker save archive
+//	oci:/layout[:tag]             an OCI image layout
+//	tar:/export.tgz               the reassembler layout in a (compressed) tar
+type URI struct {
+	Scheme string
+	// Bucket and Prefix are set for s3, Path for the local schemes
+	Bucket string
+	Prefix string
+	Path   string
+	// Tag selects the image of an OCI layout or of a docker archive that
+	// holds more than one
+	Tag string
+}
+
+func ParseURI(value string) (*URI, error) {
+	if rest := strings.TrimPrefix(value, SCHEME_S3+"://"); rest != value {
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("invalid source %q, expected s3://bucket/prefix", value)
+		}
+		return &URI{Scheme: SCHEME_S3, Bucket: bucket, Prefix: strings.Trim(prefix, "/")}, nil
+	}
+
+	scheme, path, ok := strings.Cut(value, ":")
+	if !ok || path == "" {
+		return nil, fmt.Errorf("invalid source %q, expected <scheme>:<path>", value)
+	}
+
+	uri := &URI{Scheme: scheme, Path: path}
+	switch scheme {
+	case SCHEME_DIR, SCHEME_DOCKER_ARCHIVE, SCHEME_TAR:
+	case SCHEME_OCI:
+		// The tag follows the last colon, unless that is part of the path
+		if i := strings.LastIndex(path, ":"); i >= 0 && !strings.Contains(path[i:], "/") {
+			uri.Path, uri.Tag = path[:i], path[i+1:]
+		}
+	default:
+		return nil, fmt.Errorf("invalid source %q, unknown scheme %q", value, scheme)
+	}
+
+	return uri, nil
+}
+
+func (u *URI) String() string {
+	switch u.Scheme {
+	case SCHEME_S3:
+		return fmt.Sprintf("s3://%s/%s", u.Bucket, u.Prefix)
+	case SCHEME_OCI, SCHEME_DOCKER_ARCHIVE:
+		if u.Tag != "" {
+			return fmt.Sprintf("%s:%s:%s", u.Scheme, u.Path, u.Tag)
+		}
+	}
+
+	return fmt.Sprintf("%s:%s", u.Scheme, u.Path)
+}
+
+// Open resolves a local source. Archives that cannot be read in place are
+// unpacked in the reassembler layout into a new directory under workDir.
+// cleanup closes the source and removes anything unpacked.
+func Open(ctx context.Context, uri *URI, workDir string, logger lgr.ILogger) (src ISource, cleanup func(), err error) {
+	unpackDir := func() (string, func(), error) {
+		if err := os.MkdirAll(workDir, 0o775); err != nil {
+			return "", nil, fmt.Errorf("error creating %q: %w", workDir, err)
+		}
+		dir, err := ioutil.TempDir(workDir, uri.Scheme+"-")
+		if err != nil {
+			return "", nil, fmt.Errorf("error creating directory to unpack %s: %w", uri, err)
+		}
+		return dir, func() { os.RemoveAll(dir) }, nil
+	}
+
+	switch uri.Scheme {
+	case SCHEME_DIR:
+		if _, err := os.Stat(uri.Path); err != nil {
+			return nil, nil, fmt.Errorf("error reading source %s: %w", uri, err)
+		}
+		dir := NewDir(uri.Path)
+		return dir, func() { dir.Close() }, nil
+	case SCHEME_OCI:
+		layout, err := NewOCILayout(uri.Path, uri.Tag)
+		if err != nil {
+			return nil, nil, err
+		}
+		return layout, func() { layout.Close() }, nil
+	case SCHEME_TAR, SCHEME_DOCKER_ARCHIVE:
+		dir, remove, err := unpackDir()
+		if err != nil {
+			return nil, nil, err
+		}
+		if uri.Scheme == SCHEME_TAR {
+			dir, err = ExtractLayout(ctx, uri.Path, dir)
+		} else {
+			err = UnpackDockerArchive(ctx, uri.Path, uri.Tag, dir, logger)
+		}
+		if err != nil {
+			remove()
+			return nil, nil, err
+		}
+		unpacked := NewDir(dir)
+		return unpacked, func() {
+			unpacked.Close()
+			remove()
+		}, nil
+	}
+
+	return nil, nil, fmt.Errorf("source %s can not be opened locally", uri)
+}
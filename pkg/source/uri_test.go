@@ -0,0 +1,190 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package source_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package source_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"docker-reassembler/pkg/source"
+	"docker-reassembler/pkg/utils"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseURI(t *testing.T) {
+	cases := []struct {
+		value string
+		uri   *source.URI
+		err   bool
+	}{
+		{value: "s3://images/app/1.0/", uri: &source.URI{Scheme: "s3", Bucket: "images", Prefix: "app/1.0"}},
+		{value: "s3://images", uri: &source.URI{Scheme: "s3", Bucket: "images"}},
+		{value: "dir:/tmp/app/1.0", uri: &source.URI{Scheme: "dir", Path: "/tmp/app/1.0"}},
+		{value: "docker-archive:/exports/app.tar", uri: &source.URI{Scheme: "docker-archive", Path: "/exports/app.tar"}},
+		{value: "oci:/layouts/app:1.0", uri: &source.URI{Scheme: "oci", Path: "/layouts/app", Tag: "1.0"}},
+		{value: "oci:/layouts/app", uri: &source.URI{Scheme: "oci", Path: "/layouts/app"}},
+		{value: "oci:./c:/layout", uri: &source.URI{Scheme: "oci", Path: "./c:/layout"}},
+		{value: "tar:/exports/app.tgz", uri: &source.URI{Scheme: "tar", Path: "/exports/app.tgz"}},
+		{value: "s3://", err: true},
+		{value: "/tmp/app", err: true},
+		{value: "docker://app:1.0", err: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.value, func(t *testing.T) {
+			uri, err := source.ParseURI(tt.value)
+			if tt.err {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.uri, uri)
+		})
+	}
+}
+
+// assertImage checks src serves the manifest, config and layers of img.
+func assertImage(t *testing.T, src source.ISource, img v1.Image) {
+	ctx := context.Background()
+
+	want, err := img.RawManifest()
+	assert.Nil(t, err)
+	manBuffer, err := src.Manifest(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, string(want), string(manBuffer))
+
+	layers, err := img.Layers()
+	assert.Nil(t, err)
+	for _, layer := range layers {
+		dgst, err := layer.Digest()
+		assert.Nil(t, err)
+		size, err := src.BlobSize(ctx, dgst.String())
+		assert.Nil(t, err)
+		blob, err := ioutil.ReadAll(source.NewBlobReader(ctx, src, dgst.String(), size))
+		assert.Nil(t, err)
+		assert.Equal(t, dgst.String(), fmt.Sprintf("sha256:%x", sha256.Sum256(blob)))
+	}
+}
+
+func TestOpenDockerArchive(t *testing.T) {
+	img, err := random.Image(1024, 2)
+	assert.Nil(t, err)
+	archive := filepath.Join(t.TempDir(), "app.tar")
+	ref, err := name.NewTag("app:1.0")
+	assert.Nil(t, err)
+	assert.Nil(t, tarball.WriteToFile(archive, ref, img))
+
+	workDir := t.TempDir()
+	src, cleanup, err := source.Open(context.Background(),
+		&source.URI{Scheme: source.SCHEME_DOCKER_ARCHIVE, Path: archive}, workDir, &utils.PtermLogger{})
+	assert.Nil(t, err)
+
+	assertImage(t, src, img)
+	cleanup()
+	entries, _ := ioutil.ReadDir(workDir)
+	assert.Empty(t, entries, "unpacked archive should be removed")
+}
+
+func TestOpenDockerArchiveTag(t *testing.T) {
+	first, err := random.Image(1024, 1)
+	assert.Nil(t, err)
+	second, err := random.Image(1024, 2)
+	assert.Nil(t, err)
+	archive := filepath.Join(t.TempDir(), "images.tar")
+	refs := map[name.Reference]v1.Image{}
+	for tag, img := range map[string]v1.Image{"app:1.0": first, "app:2.0": second} {
+		ref, err := name.NewTag(tag)
+		assert.Nil(t, err)
+		refs[ref] = img
+	}
+	assert.Nil(t, tarball.MultiRefWriteToFile(archive, refs))
+
+	uri := &source.URI{Scheme: source.SCHEME_DOCKER_ARCHIVE, Path: archive, Tag: "app:2.0"}
+	assert.Equal(t, "docker-archive:"+archive+":app:2.0", uri.String())
+	src, cleanup, err := source.Open(context.Background(), uri, t.TempDir(), &utils.PtermLogger{})
+	assert.Nil(t, err)
+	defer cleanup()
+
+	assertImage(t, src, second)
+}
+
+func TestOpenOCILayout(t *testing.T) {
+	app, err := random.Image(512, 1)
+	assert.Nil(t, err)
+	other, err := random.Image(512, 1)
+	assert.Nil(t, err)
+	dir := t.TempDir()
+	l, err := layout.Write(dir, empty.Index)
+	assert.Nil(t, err)
+	assert.Nil(t, l.AppendImage(app, layout.WithAnnotations(map[string]string{source.OCI_REF_NAME_ANNOTATION: "1.0"})))
+	assert.Nil(t, l.AppendImage(other, layout.WithAnnotations(map[string]string{source.OCI_REF_NAME_ANNOTATION: "2.0"})))
+
+	src, _, err := source.Open(context.Background(), &source.URI{Scheme: source.SCHEME_OCI, Path: dir, Tag: "1.0"}, "", nil)
+	assert.Nil(t, err)
+	assertImage(t, src, app)
+
+	_, _, err = source.Open(context.Background(), &source.URI{Scheme: source.SCHEME_OCI, Path: dir}, "", nil)
+	assert.NotNil(t, err, "a tag is needed to pick one of several images")
+}
+
+func TestOpenTarExport(t *testing.T) {
+	img, err := random.Image(512, 2)
+	assert.Nil(t, err)
+	layoutDir := t.TempDir()
+	assert.Nil(t, source.WriteImage(context.Background(), img, layoutDir, &utils.PtermLogger{}))
+
+	// Exports keep the bucket/<repository>/<tag> directories
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	files, err := ioutil.ReadDir(layoutDir)
+	assert.Nil(t, err)
+	for _, fi := range files {
+		content, err := ioutil.ReadFile(filepath.Join(layoutDir, fi.Name()))
+		assert.Nil(t, err)
+		assert.Nil(t, tw.WriteHeader(&tar.Header{Name: "images/app/1.0/" + fi.Name(), Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err = tw.Write(content)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, gz.Close())
+	archive := filepath.Join(t.TempDir(), "export.tgz")
+	assert.Nil(t, ioutil.WriteFile(archive, buf.Bytes(), 0o644))
+
+	src, cleanup, err := source.Open(context.Background(), &source.URI{Scheme: source.SCHEME_TAR, Path: archive}, t.TempDir(), nil)
+	assert.Nil(t, err)
+	defer cleanup()
+	assertImage(t, src, img)
+}
+
+func TestExtractLayoutRejectsEscapingEntries(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	assert.Nil(t, tw.WriteHeader(&tar.Header{Name: "../manifest.json", Mode: 0o644, Typeflag: tar.TypeReg}))
+	assert.Nil(t, tw.Close())
+	archive := filepath.Join(t.TempDir(), "export.tar")
+	assert.Nil(t, ioutil.WriteFile(archive, buf.Bytes(), 0o644))
+
+	dir := t.TempDir()
+	_, err := source.ExtractLayout(context.Background(), archive, filepath.Join(dir, "out"))
+	assert.NotNil(t, err)
+	_, statErr := os.Stat(filepath.Join(dir, "manifest.json"))
+	assert.True(t, os.IsNotExist(statErr))
+}
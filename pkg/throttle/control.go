@@ -0,0 +1,170 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package throttle
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/pflag"
+)
+
+const CONTROL_POLL_INTERVAL = 5 * time.Second
+
+// Flags holds the transfer rate limits, the limiters are shared by every
+// transfer of a run.
+type Flags struct {
+	MaxDownloadRate string
+	MaxUploadRate   string
+	ControlFile     string
+	// downloads is set for commands that limit their downloads
+	downloads bool
+	download  *Limiter
+	upload    *Limiter
+}
+
+func (f *Flags) AddFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&f.MaxUploadRate, "max-upload-rate", "", "", "limit the combined rate of all ECR uploads, e.g. 50MiB/s")
+	flags.StringVarP(&f.ControlFile, "rate-control-file", "", "",
+		"file of upload=<rate> lines, and download=<rate> ones for commands with --max-download-rate, re-read when it changes or on SIGHUP to adjust the limits")
+}
+
+func (f *Flags) AddDownloadFlags(flags *pflag.FlagSet) {
+	f.downloads = true
+	flags.StringVarP(&f.MaxDownloadRate, "max-download-rate", "", "", "limit the combined rate of all S3 downloads, e.g. 50MiB/s")
+}
+
+// Limiters parses the flags into the shared download and upload limiters.
+func (f *Flags) Limiters() (download *Limiter, upload *Limiter, err error) {
+	if f.download == nil {
+		rate, err := ParseRate(f.MaxDownloadRate)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid --max-download-rate: %w", err)
+		}
+		f.download = New("download", rate)
+	}
+	if f.upload == nil {
+		rate, err := ParseRate(f.MaxUploadRate)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid --max-upload-rate: %w", err)
+		}
+		f.upload = New("upload", rate)
+	}
+
+	return f.download, f.upload, nil
+}
+
+// Watch applies the control file to the limiters until ctx is done, when
+// it changes and whenever the process receives SIGHUP.
+func (f *Flags) Watch(ctx context.Context) error {
+	download, upload, err := f.Limiters()
+	if err != nil {
+		return err
+	}
+	if f.ControlFile == "" {
+		return nil
+	}
+	if !f.downloads {
+		download = nil
+	}
+
+	var modified time.Time
+	apply := func(force bool) {
+		info, err := os.Stat(f.ControlFile)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				pterm.Warning.Printfln("error reading rate control file: %v", err)
+			}
+			return
+		}
+		if !force && !info.ModTime().After(modified) {
+			return
+		}
+		modified = info.ModTime()
+
+		if err := ApplyControlFile(f.ControlFile, download, upload); err != nil {
+			pterm.Warning.Printfln("error applying rate control file: %v", err)
+			return
+		}
+		if download == nil {
+			pterm.Info.Printfln("transfer rates: %s", upload)
+			return
+		}
+		pterm.Info.Printfln("transfer rates: %s, %s", download, upload)
+	}
+	apply(true)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		ticker := time.NewTicker(CONTROL_POLL_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				apply(true)
+			case <-ticker.C:
+				apply(false)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// ApplyControlFile sets the rates named in the file, lines are
+// download=<rate> or upload=<rate> and # starts a comment. download is nil
+// for a command that does not limit downloads, download lines are then
+// rejected rather than silently ignored.
+func ApplyControlFile(path string, download, upload *Limiter) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	rates := map[string]int64{}
+	for i, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(strings.SplitN(line, "#", 2)[0])
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("line %d: expected <direction>=<rate>", i+1)
+		}
+		key = strings.TrimSpace(key)
+		if key != "download" && key != "upload" {
+			return fmt.Errorf("line %d: unknown direction %q", i+1, key)
+		}
+		if key == "download" && download == nil {
+			return fmt.Errorf("line %d: this command does not limit downloads", i+1)
+		}
+		rate, err := ParseRate(value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", i+1, err)
+		}
+		rates[key] = rate
+	}
+
+	// Only apply a file that parsed completely
+	if rate, ok := rates["download"]; ok {
+		download.SetRate(rate)
+	}
+	if rate, ok := rates["upload"]; ok {
+		upload.SetRate(rate)
+	}
+
+	return nil
+}
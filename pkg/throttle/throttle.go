@@ -0,0 +1,198 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package throttle
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/dustin/go-humanize"
+	"golang.org/x/time/rate"
+)
+
+// MIN_BURST keeps small rates from turning every read into a wait.
+const MIN_BURST = 64 * 1024
+
+// Limiter is a token bucket of bytes shared by every transfer in one
+// direction. A nil Limiter, or one with a zero rate, does not limit.
+type Limiter struct {
+	mu      sync.RWMutex
+	name    string
+	rate    int64
+	limiter *rate.Limiter
+}
+
+func New(name string, bytesPerSecond int64) *Limiter {
+	l := &Limiter{name: name, limiter: rate.NewLimiter(rate.Inf, 0)}
+	l.SetRate(bytesPerSecond)
+	return l
+}
+
+// ParseRate reads a rate such as 50MiB/s or 10MB, an empty value, 0 or
+// "unlimited" is no limit.
+func ParseRate(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "0" || strings.EqualFold(value, "unlimited") {
+		return 0, nil
+	}
+
+	size, err := humanize.ParseBytes(strings.TrimSuffix(value, "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q: %w", value, err)
+	}
+	if size > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid rate %q: too large", value)
+	}
+
+	return int64(size), nil
+}
+
+func FormatRate(bytesPerSecond int64) string {
+	if bytesPerSecond <= 0 {
+		return "unlimited"
+	}
+	return humanize.IBytes(uint64(bytesPerSecond)) + "/s"
+}
+
+// SetRate changes the limit, transfers already waiting pick it up.
+func (l *Limiter) SetRate(bytesPerSecond int64) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = bytesPerSecond
+	if bytesPerSecond <= 0 {
+		l.limiter.SetLimit(rate.Inf)
+		return
+	}
+
+	burst := bytesPerSecond
+	if burst < MIN_BURST {
+		burst = MIN_BURST
+	}
+	if burst > math.MaxInt32 {
+		burst = math.MaxInt32
+	}
+	l.limiter.SetBurst(int(burst))
+	l.limiter.SetLimit(rate.Limit(bytesPerSecond))
+}
+
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.rate
+}
+
+func (l *Limiter) String() string {
+	return fmt.Sprintf("%s %s", l.name, FormatRate(l.Rate()))
+}
+
+// WaitN blocks until n bytes may be transferred, waiting for at most a
+// burst at a time.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || l.Rate() <= 0 {
+		return nil
+	}
+
+	for n > 0 {
+		chunk := l.limiter.Burst()
+		if chunk > n {
+			chunk = n
+		}
+		if err := l.limiter.WaitN(ctx, chunk); err != nil {
+			// SetRate may have lowered the burst below the chunk since it
+			// was read, the chunk is then cut down to the new burst
+			if ctx.Err() == nil && chunk > l.limiter.Burst() {
+				continue
+			}
+			return err
+		}
+		n -= chunk
+	}
+
+	return nil
+}
+
+type reader struct {
+	ctx     context.Context
+	limiter *Limiter
+	r       io.Reader
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if wErr := r.limiter.WaitN(r.ctx, n); wErr != nil {
+			return n, wErr
+		}
+	}
+	return n, err
+}
+
+// Reader limits reads from r.
+func (l *Limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{ctx: ctx, limiter: l, r: r}
+}
+
+type writerAt struct {
+	ctx     context.Context
+	limiter *Limiter
+	w       io.WriterAt
+}
+
+func (w *writerAt) WriteAt(p []byte, off int64) (int, error) {
+	if err := w.limiter.WaitN(w.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return w.w.WriteAt(p, off)
+}
+
+// APIOption limits the body of a request as it is sent, each attempt is
+// limited on its own. The body is wrapped once the request is signed, so
+// the signer still sees the body it can rewind.
+func (l *Limiter) APIOption() func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		if l == nil {
+			return nil
+		}
+		return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("ThrottleBody",
+			func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (
+				middleware.FinalizeOutput, middleware.Metadata, error,
+			) {
+				if req, ok := in.Request.(*smithyhttp.Request); ok && req.GetStream() != nil {
+					throttled, err := req.SetStream(l.Reader(ctx, req.GetStream()))
+					if err != nil {
+						return middleware.FinalizeOutput{}, middleware.Metadata{}, err
+					}
+					in.Request = throttled
+				}
+				return next.HandleFinalize(ctx, in)
+			}), middleware.After)
+	}
+}
+
+// WriterAt limits writes to w, holding back a download writing into it.
+func (l *Limiter) WriterAt(ctx context.Context, w io.WriterAt) io.WriterAt {
+	if l == nil {
+		return w
+	}
+	return &writerAt{ctx: ctx, limiter: l, w: w}
+}
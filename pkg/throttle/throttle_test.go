@@ -0,0 +1,118 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package throttle_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package throttle_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"docker-reassembler/pkg/throttle"
+
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRate(t *testing.T) {
+	for value, expected := range map[string]int64{
+		"50MiB/s":   50 * 1024 * 1024,
+		"10MB":      10 * 1000 * 1000,
+		"":          0,
+		"unlimited": 0,
+	} {
+		rate, err := throttle.ParseRate(value)
+		assert.Nil(t, err, value)
+		assert.Equal(t, expected, rate, value)
+	}
+
+	_, err := throttle.ParseRate("fast")
+	assert.NotNil(t, err)
+}
+
+func TestLimiterReader(t *testing.T) {
+	limiter := throttle.New("download", 1024*1024)
+	data := make([]byte, 1536*1024)
+
+	started := time.Now()
+	read, err := ioutil.ReadAll(limiter.Reader(context.Background(), bytes.NewReader(data)))
+	assert.Nil(t, err)
+	assert.Len(t, read, len(data))
+
+	// The first second's worth is the burst, the rest waits for tokens
+	assert.GreaterOrEqual(t, time.Since(started), 400*time.Millisecond)
+}
+
+func TestLimiterAPIOption(t *testing.T) {
+	limiter := throttle.New("upload", 1024*1024)
+	data := make([]byte, 1536*1024)
+
+	stack := middleware.NewStack("UploadLayerPart", smithyhttp.NewStackRequest)
+	assert.Nil(t, stack.Serialize.Add(middleware.SerializeMiddlewareFunc("Body",
+		func(ctx context.Context, in middleware.SerializeInput, next middleware.SerializeHandler) (
+			middleware.SerializeOutput, middleware.Metadata, error,
+		) {
+			req, err := in.Request.(*smithyhttp.Request).SetStream(bytes.NewReader(data))
+			if err != nil {
+				return middleware.SerializeOutput{}, middleware.Metadata{}, err
+			}
+			in.Request = req
+			return next.HandleSerialize(ctx, in)
+		}), middleware.After))
+	assert.Nil(t, limiter.APIOption()(stack))
+
+	var sent []byte
+	send := middleware.HandlerFunc(func(ctx context.Context, in interface{}) (interface{}, middleware.Metadata, error) {
+		var err error
+		sent, err = ioutil.ReadAll(in.(*smithyhttp.Request).GetStream())
+		return nil, middleware.Metadata{}, err
+	})
+
+	started := time.Now()
+	_, _, err := middleware.DecorateHandler(send, stack).Handle(context.Background(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, data, sent)
+	assert.GreaterOrEqual(t, time.Since(started), 400*time.Millisecond, "the body is limited as it is sent")
+
+	var none *throttle.Limiter
+	assert.Nil(t, none.APIOption()(middleware.NewStack("UploadLayerPart", smithyhttp.NewStackRequest)))
+}
+
+func TestNilLimiter(t *testing.T) {
+	var limiter *throttle.Limiter
+	assert.Nil(t, limiter.WaitN(context.Background(), 1<<30))
+	assert.Equal(t, int64(0), limiter.Rate())
+}
+
+func TestApplyControlFile(t *testing.T) {
+	download := throttle.New("download", 0)
+	upload := throttle.New("upload", 1024)
+
+	path := filepath.Join(t.TempDir(), "rates")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("# bastion hours\ndownload = 20MiB/s\n"), 0o644))
+	assert.Nil(t, throttle.ApplyControlFile(path, download, upload))
+	assert.Equal(t, int64(20*1024*1024), download.Rate())
+	assert.Equal(t, int64(1024), upload.Rate(), "rates not in the file are kept")
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("download=unlimited\nupload=fast\n"), 0o644))
+	assert.NotNil(t, throttle.ApplyControlFile(path, download, upload))
+	assert.Equal(t, int64(20*1024*1024), download.Rate(), "a bad file changes nothing")
+}
+
+func TestApplyControlFileWithoutDownloads(t *testing.T) {
+	upload := throttle.New("upload", 1024)
+
+	path := filepath.Join(t.TempDir(), "rates")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("upload=2KiB/s\n"), 0o644))
+	assert.Nil(t, throttle.ApplyControlFile(path, nil, upload))
+	assert.Equal(t, int64(2048), upload.Rate())
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("download=20MiB/s\nupload=4KiB/s\n"), 0o644))
+	assert.NotNil(t, throttle.ApplyControlFile(path, nil, upload), "a download rate would have no effect")
+	assert.Equal(t, int64(2048), upload.Rate())
+}
@@ -0,0 +1,103 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package tracing
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const SERVICE_NAME = "docker-reassembler"
+
+// Options selects where spans are exported, tracing is disabled when neither
+// is set.
+type Options struct {
+	// Endpoint of an OTLP/HTTP collector, host:port
+	Endpoint string
+	Insecure bool
+	// File to write spans to as JSON, one object per span
+	File    string
+	Version string
+}
+
+// Setup installs the global tracer provider and returns a function that
+// flushes and stops it.
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	if opts.Endpoint == "" && opts.File == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	providerOpts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", SERVICE_NAME),
+			attribute.String("service.version", opts.Version),
+		)),
+	}
+
+	var file *os.File
+	if opts.File != "" {
+		var err error
+		file, err = os.Create(opts.File)
+		if err != nil {
+			return nil, fmt.Errorf("error creating trace file %q: %w", opts.File, err)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error creating file trace exporter: %w", err)
+		}
+		providerOpts = append(providerOpts, sdktrace.WithSyncer(exporter))
+	}
+
+	if opts.Endpoint != "" {
+		clientOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(opts.Endpoint)}
+		if opts.Insecure {
+			clientOpts = append(clientOpts, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(ctx, clientOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("error creating OTLP trace exporter: %w", err)
+		}
+		providerOpts = append(providerOpts, sdktrace.WithBatcher(exporter))
+	}
+
+	provider := sdktrace.NewTracerProvider(providerOpts...)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			if cErr := file.Close(); err == nil {
+				err = cErr
+			}
+		}
+		return err
+	}, nil
+}
+
+// Start starts a span as a child of any span in ctx. Spans are dropped when
+// Setup has not been called.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(SERVICE_NAME).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err on the span, if any, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,48 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package tracing_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package tracing_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"docker-reassembler/pkg/tracing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.json")
+	shutdown, err := tracing.Setup(context.Background(), tracing.Options{File: path, Version: "test"})
+	assert.Nil(t, err)
+
+	ctx, parent := tracing.Start(context.Background(), "stage.upload")
+	_, child := tracing.Start(ctx, "ecr.UploadLayerPart",
+		attribute.String("layer.digest", "sha256:abc"), attribute.Int("part.index", 3))
+	tracing.End(child, errors.New("throttled"))
+	tracing.End(parent, nil)
+
+	assert.Nil(t, shutdown(context.Background()))
+
+	buf, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	out := string(buf)
+	assert.True(t, strings.Contains(out, `"Name":"ecr.UploadLayerPart"`))
+	assert.True(t, strings.Contains(out, `"Name":"stage.upload"`))
+	assert.True(t, strings.Contains(out, `"sha256:abc"`))
+	assert.True(t, strings.Contains(out, `"Description":"throttled"`))
+	assert.True(t, strings.Contains(out, `"docker-reassembler"`))
+}
+
+func TestDisabled(t *testing.T) {
+	shutdown, err := tracing.Setup(context.Background(), tracing.Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, shutdown(context.Background()))
+}
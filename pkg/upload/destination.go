@@ -0,0 +1,102 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package upload
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package upload
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	ecrTypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+)
+
+var accountIdPattern = regexp.MustCompile(`^[0-9]{12}$`)
+
+// Destination is one registry to put an image to, given on the command line
+// as region=<region>,account=<account id>,role=<role arn>,external-id=<id>.
+// Empty fields fall back to the put credentials.
+type Destination struct {
+	Region     string
+	Account    string
+	RoleArn    string
+	ExternalId string
+}
+
+func ParseDestination(value string) (Destination, error) {
+	dest := Destination{}
+	for _, field := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(field, "=")
+		if !ok {
+			return dest, fmt.Errorf("invalid destination field %q, expected key=value", field)
+		}
+		val = strings.TrimSpace(val)
+		switch strings.TrimSpace(key) {
+		case "region":
+			dest.Region = val
+		case "account":
+			if !accountIdPattern.MatchString(val) {
+				return dest, fmt.Errorf("invalid destination account %q", val)
+			}
+			dest.Account = val
+		case "role":
+			dest.RoleArn = val
+		case "external-id":
+			dest.ExternalId = val
+		default:
+			return dest, fmt.Errorf("unknown destination field %q", key)
+		}
+	}
+
+	return dest, nil
+}
+
+func (d Destination) String() string {
+	account := d.Account
+	if account == "" {
+		account = "default"
+	}
+	region := d.Region
+	if region == "" {
+		region = "default"
+	}
+
+	return fmt.Sprintf("%s/%s", region, account)
+}
+
+// Result is the outcome of one of the inputs given to UploadAll.
+type Result struct {
+	Input    *UploadInput
+	Image    *ecrTypes.Image
+	Duration time.Duration
+	Err      error
+}
+
+// UploadAll runs Upload for each input concurrently. A failure for one input
+// does not stop the others, results are in the same order as the inputs.
+// Parts are reported as log lines rather than spinners when there is more
+// than one input.
+func UploadAll(ctx context.Context, inputs []*UploadInput) []Result {
+	results := make([]Result, len(inputs))
+	for _, input := range inputs {
+		input.concurrent = len(inputs) > 1
+	}
+
+	var wg sync.WaitGroup
+	for i, input := range inputs {
+		wg.Add(1)
+		go func(i int, input *UploadInput) {
+			defer wg.Done()
+			started := time.Now()
+			img, err := Upload(ctx, input)
+			results[i] = Result{Input: input, Image: img, Duration: time.Since(started), Err: err}
+		}(i, input)
+	}
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package upload_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package upload_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"docker-reassembler/pkg/internal/testsource"
+	"docker-reassembler/pkg/upload"
+	"docker-reassembler/pkg/utils"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pterm/pterm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDestination(t *testing.T) {
+	dest, err := upload.ParseDestination("region=eu-west-1,account=123456789012,role=arn:aws:iam::123456789012:role/push")
+	assert.Nil(t, err)
+	assert.Equal(t, upload.Destination{
+		Region:  "eu-west-1",
+		Account: "123456789012",
+		RoleArn: "arn:aws:iam::123456789012:role/push",
+	}, dest)
+	assert.Equal(t, "eu-west-1/123456789012", dest.String())
+
+	dest, err = upload.ParseDestination("region=us-east-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "us-east-1/default", dest.String())
+
+	_, err = upload.ParseDestination("region")
+	assert.NotNil(t, err)
+	_, err = upload.ParseDestination("account=1234")
+	assert.NotNil(t, err)
+	_, err = upload.ParseDestination("zone=a")
+	assert.NotNil(t, err)
+}
+
+type failingSource struct {
+	err error
+}
+
+func (s *failingSource) Manifest(ctx context.Context) ([]byte, error) {
+	return nil, s.err
+}
+
+func (s *failingSource) BlobSize(ctx context.Context, digest string) (int64, error) {
+	return 0, s.err
+}
+
+func (s *failingSource) ReadBlobAt(ctx context.Context, digest string, p []byte, off int64) (int, error) {
+	return 0, s.err
+}
+
+func TestUploadAllKeepsOrder(t *testing.T) {
+	first := errors.New("first")
+	second := errors.New("second")
+	inputs := []*upload.UploadInput{
+		{Source: &failingSource{err: first}, Logger: &utils.PtermLogger{}},
+		{Source: &failingSource{err: second}, Logger: &utils.PtermLogger{}},
+	}
+
+	results := upload.UploadAll(context.Background(), inputs)
+
+	assert.Len(t, results, 2)
+	assert.ErrorIs(t, results[0].Err, first)
+	assert.ErrorIs(t, results[1].Err, second)
+	assert.Same(t, inputs[1], results[1].Input)
+}
+
+// recordingLogger keeps every line printed through it.
+type recordingLogger struct {
+	utils.PtermLogger
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) Printfln(prefixPrinter pterm.PrefixPrinter, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func TestUploadAllLogsPartsPerDestination(t *testing.T) {
+	config, layer := []byte(`{"architecture":"amd64"}`), []byte("0123456789")
+	logger := &recordingLogger{}
+	inputs := []*upload.UploadInput{}
+	for _, registry := range []string{"111111111111", "222222222222"} {
+		client := &partECR{mockECR: &mockECR{}, available: map[string]bool{digest.FromBytes(config).String(): true}}
+		input := newPartUpload(testsource.NewImage(config, layer), client, 4)
+		input.RegistryId = registry
+		input.Logger = logger
+		inputs = append(inputs, input)
+	}
+
+	for _, result := range upload.UploadAll(context.Background(), inputs) {
+		assert.Nil(t, result.Err)
+	}
+	for _, registry := range []string{"111111111111", "222222222222"} {
+		assert.Contains(t, logger.lines, registry+"/app: uploading blob part_2 (2 B)")
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package upload
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package upload
+
+import (
+	"fmt"
+	"time"
+
+	dkr "docker-reassembler/pkg/docker"
+	"docker-reassembler/pkg/retry"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/pflag"
+)
+
+// Flags holds the command line options shared by every command that
+// pushes to ECR.
+type Flags struct {
+	MaxAttempts    int
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+	PartSize       string
+	MinPartSize    string
+	MaxPartSize    string
+	Verify         bool
+}
+
+func (f *Flags) AddFlags(flags *pflag.FlagSet) {
+	flags.IntVarP(&f.MaxAttempts, "max-attempts", "", retry.DEFAULT_MAX_ATTEMPTS, "maximum attempts for each ECR call and each streamed S3 read, the SDK does not retry them on its own")
+	flags.DurationVarP(&f.RetryBaseDelay, "retry-base-delay", "", retry.DEFAULT_BASE_DELAY, "initial delay before retrying a failed ECR call")
+	flags.DurationVarP(&f.RetryMaxDelay, "retry-max-delay", "", retry.DEFAULT_MAX_DELAY, "maximum delay between retries of a failed ECR call")
+	flags.StringVarP(&f.PartSize, "part-size", "", humanize.IBytes(uint64(dkr.LAYER_PART_CEILING_SIZE)), "initial size of each ECR layer part, adapted as the upload progresses")
+	flags.StringVarP(&f.MinPartSize, "min-part-size", "", humanize.IBytes(uint64(dkr.LAYER_PART_MIN_SIZE)), "smallest size a layer part is shrunk to, ECR rejects smaller parts")
+	flags.StringVarP(&f.MaxPartSize, "max-part-size", "", humanize.IBytes(uint64(dkr.LAYER_PART_CEILING_SIZE)), "largest size a layer part is grown to, ECR rejects larger parts so the default is also the limit")
+	flags.BoolVarP(&f.Verify, "verify", "", true, "read the image back from ECR after the put and fail on any difference from the local manifest")
+}
+
+// Policy is the retry policy the options ask for.
+func (f *Flags) Policy() retry.Policy {
+	return retry.Policy{
+		MaxAttempts: f.MaxAttempts,
+		BaseDelay:   f.RetryBaseDelay,
+		MaxDelay:    f.RetryMaxDelay,
+	}
+}
+
+// Apply copies the parsed options onto an upload.
+func (f *Flags) Apply(input *UploadInput) error {
+	input.Retry = f.Policy()
+	input.Verify = f.Verify
+
+	for _, p := range []struct {
+		flag  string
+		value string
+		dest  *int64
+	}{
+		{"part-size", f.PartSize, &input.PartSize.Initial},
+		{"min-part-size", f.MinPartSize, &input.PartSize.Min},
+		{"max-part-size", f.MaxPartSize, &input.PartSize.Max},
+	} {
+		size, err := humanize.ParseBytes(p.value)
+		if err != nil {
+			return fmt.Errorf("invalid --%s %q: %w", p.flag, p.value, err)
+		}
+		*p.dest = int64(size)
+	}
+
+	return nil
+}
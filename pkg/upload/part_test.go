@@ -0,0 +1,297 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package upload_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package upload_test
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"docker-reassembler/pkg/internal/testsource"
+	"docker-reassembler/pkg/metrics"
+	"docker-reassembler/pkg/retry"
+	"docker-reassembler/pkg/source"
+	"docker-reassembler/pkg/upload"
+	"docker-reassembler/pkg/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrTypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/smithy-go"
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// sentPart is one UploadLayerPart call as the registry saw it.
+type sentPart struct {
+	uploadId  string
+	firstByte int64
+	lastByte  int64
+	blob      string
+}
+
+// partECR uploads every blob that is not in available, failing the part
+// calls with whatever fail returns for them.
+type partECR struct {
+	*mockECR
+	available map[string]bool
+	fail      func(call int, params *ecr.UploadLayerPartInput) error
+	parts     []sentPart
+	uploads   int
+}
+
+func (m *partECR) BatchCheckLayerAvailability(ctx context.Context, params *ecr.BatchCheckLayerAvailabilityInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+	out := &ecr.BatchCheckLayerAvailabilityOutput{}
+	for _, d := range params.LayerDigests {
+		availability := ecrTypes.LayerAvailabilityUnavailable
+		if m.available[d] {
+			availability = ecrTypes.LayerAvailabilityAvailable
+		}
+		out.Layers = append(out.Layers, ecrTypes.Layer{LayerDigest: aws.String(d), LayerAvailability: availability})
+	}
+	return out, nil
+}
+
+func (m *partECR) InitiateLayerUpload(ctx context.Context, params *ecr.InitiateLayerUploadInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.InitiateLayerUploadOutput, error) {
+	m.uploads++
+	return &ecr.InitiateLayerUploadOutput{UploadId: aws.String("upload-" + string(rune('0'+m.uploads)))}, nil
+}
+
+func (m *partECR) UploadLayerPart(ctx context.Context, params *ecr.UploadLayerPartInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.UploadLayerPartOutput, error) {
+	m.parts = append(m.parts, sentPart{
+		uploadId:  *params.UploadId,
+		firstByte: *params.PartFirstByte,
+		lastByte:  *params.PartLastByte,
+		blob:      string(params.LayerPartBlob),
+	})
+	if m.fail != nil {
+		if err := m.fail(len(m.parts), params); err != nil {
+			return nil, err
+		}
+	}
+	return &ecr.UploadLayerPartOutput{LastByteReceived: params.PartLastByte, UploadId: params.UploadId}, nil
+}
+
+func (m *partECR) CompleteLayerUpload(ctx context.Context, params *ecr.CompleteLayerUploadInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.CompleteLayerUploadOutput, error) {
+	return &ecr.CompleteLayerUploadOutput{LayerDigest: aws.String(params.LayerDigests[0]), UploadId: params.UploadId}, nil
+}
+
+type countingCredentials struct {
+	invalidated int
+}
+
+func (c *countingCredentials) Invalidate() {
+	c.invalidated++
+}
+
+// newPartUpload uploads only the layer of src in parts of partSize bytes.
+func newPartUpload(src source.ISource, client upload.IClient, partSize int64) *upload.UploadInput {
+	return &upload.UploadInput{
+		Client:         client,
+		RepositoryName: "app",
+		RegistryId:     "123456789012",
+		Tag:            "1.0",
+		Source:         src,
+		Logger:         &utils.PtermLogger{},
+		Retry:          retry.Policy{MaxAttempts: 3},
+		PartSize:       upload.PartSizePolicy{Initial: partSize, Min: partSize, Max: partSize},
+		Stats:          &upload.Stats{},
+	}
+}
+
+func TestUploadRefreshesExpiredCredentials(t *testing.T) {
+	config, layer := []byte(`{"architecture":"amd64"}`), []byte("0123456789")
+	src := testsource.NewImage(config, layer)
+	client := &partECR{
+		mockECR:   &mockECR{},
+		available: map[string]bool{digest.FromBytes(config).String(): true},
+		fail: func(call int, params *ecr.UploadLayerPartInput) error {
+			if call == 2 {
+				return &smithy.GenericAPIError{Code: "ExpiredTokenException", Message: "token expired"}
+			}
+			return nil
+		},
+	}
+	creds := &countingCredentials{}
+	input := newPartUpload(src, client, 4)
+	input.Credentials = creds
+
+	_, err := upload.Upload(context.Background(), input)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, creds.invalidated)
+	assert.Equal(t, 1, client.uploads, "the part is resent under the same upload")
+	assert.Equal(t, []sentPart{
+		{uploadId: "upload-1", firstByte: 0, lastByte: 3, blob: "0123"},
+		{uploadId: "upload-1", firstByte: 4, lastByte: 7, blob: "4567"},
+		{uploadId: "upload-1", firstByte: 4, lastByte: 7, blob: "4567"},
+		{uploadId: "upload-1", firstByte: 8, lastByte: 9, blob: "89"},
+	}, client.parts)
+}
+
+func TestUploadShrinksRejectedParts(t *testing.T) {
+	config, layer := []byte(`{"architecture":"amd64"}`), []byte("0123456789")
+	src := testsource.NewImage(config, layer)
+	client := &partECR{
+		mockECR:   &mockECR{},
+		available: map[string]bool{digest.FromBytes(config).String(): true},
+		fail: func(call int, params *ecr.UploadLayerPartInput) error {
+			if len(params.LayerPartBlob) > 4 {
+				return &smithy.GenericAPIError{Code: "RequestEntityTooLarge"}
+			}
+			return nil
+		},
+	}
+	input := newPartUpload(src, client, 8)
+	input.PartSize.Min = 4
+
+	_, err := upload.Upload(context.Background(), input)
+	assert.Nil(t, err)
+	assert.Equal(t, []sentPart{
+		{uploadId: "upload-1", firstByte: 0, lastByte: 7, blob: "01234567"},
+		{uploadId: "upload-1", firstByte: 0, lastByte: 3, blob: "0123"},
+		{uploadId: "upload-1", firstByte: 4, lastByte: 7, blob: "4567"},
+		{uploadId: "upload-1", firstByte: 8, lastByte: 9, blob: "89"},
+	}, client.parts)
+}
+
+func TestUploadRetriesTimeoutAtMinimumPartSize(t *testing.T) {
+	config, layer := []byte(`{"architecture":"amd64"}`), []byte("0123456789")
+	src := testsource.NewImage(config, layer)
+	client := &partECR{
+		mockECR:   &mockECR{},
+		available: map[string]bool{digest.FromBytes(config).String(): true},
+		fail: func(call int, params *ecr.UploadLayerPartInput) error {
+			if call <= 2 {
+				return &smithy.GenericAPIError{Code: "RequestTimeout"}
+			}
+			return nil
+		},
+	}
+
+	_, err := upload.Upload(context.Background(), newPartUpload(src, client, 4))
+	assert.Nil(t, err, "a part that can not shrink is retried as is")
+	assert.Equal(t, 5, len(client.parts))
+	assert.Equal(t, client.parts[0], client.parts[2])
+}
+
+func TestUploadRetriesAndResumesParts(t *testing.T) {
+	config, layer := []byte(`{"architecture":"amd64"}`), []byte("0123456789")
+	src := testsource.NewImage(config, layer)
+	client := &partECR{
+		mockECR:   &mockECR{},
+		available: map[string]bool{digest.FromBytes(config).String(): true},
+		fail: func(call int, params *ecr.UploadLayerPartInput) error {
+			switch call {
+			case 1:
+				return &smithy.GenericAPIError{Code: "RequestTimeout"}
+			case 3:
+				// The registry kept the first two bytes of the part
+				return &ecrTypes.InvalidLayerPartException{
+					Message:               aws.String("invalid part"),
+					LastValidByteReceived: aws.Int64(5),
+				}
+			}
+			return nil
+		},
+	}
+	input := newPartUpload(src, client, 4)
+
+	_, err := upload.Upload(context.Background(), input)
+	assert.Nil(t, err)
+	assert.Equal(t, []sentPart{
+		{uploadId: "upload-1", firstByte: 0, lastByte: 3, blob: "0123"},
+		{uploadId: "upload-1", firstByte: 0, lastByte: 3, blob: "0123"},
+		{uploadId: "upload-1", firstByte: 4, lastByte: 7, blob: "4567"},
+		{uploadId: "upload-1", firstByte: 6, lastByte: 9, blob: "6789"},
+	}, client.parts, "the next part starts after the last valid byte")
+	assert.Equal(t, 1, input.Stats.Layers[1].Retries)
+	assert.Equal(t, []int64{4, 2, 4}, input.Stats.Layers[1].PartSizes, "only the bytes the registry kept are counted")
+}
+
+func TestUploadFailsOnLastValidByteBeforePart(t *testing.T) {
+	config, layer := []byte(`{"architecture":"amd64"}`), []byte("0123456789")
+	client := &partECR{
+		mockECR:   &mockECR{},
+		available: map[string]bool{digest.FromBytes(config).String(): true},
+		fail: func(call int, params *ecr.UploadLayerPartInput) error {
+			if call == 2 {
+				return &ecrTypes.InvalidLayerPartException{
+					Message:               aws.String("invalid part"),
+					LastValidByteReceived: aws.Int64(1),
+				}
+			}
+			return nil
+		},
+	}
+
+	_, err := upload.Upload(context.Background(), newPartUpload(testsource.NewImage(config, layer), client, 4))
+	assert.NotNil(t, err)
+	assert.Len(t, client.parts, 2, "the upload does not go back over parts already taken")
+}
+
+// shortSource returns fewer bytes than asked for, as a cut off ranged read
+// that still reports the end of the blob would.
+type shortSource struct {
+	*testsource.Memory
+}
+
+func (s *shortSource) ReadBlobAt(ctx context.Context, dgst string, p []byte, off int64) (int, error) {
+	n, _ := s.Memory.ReadBlobAt(ctx, dgst, p[:len(p)/2], off)
+	return n, io.EOF
+}
+
+func TestUploadFailsOnShortRead(t *testing.T) {
+	config, layer := []byte(`{"architecture":"amd64"}`), []byte("0123456789")
+	client := &partECR{
+		mockECR:   &mockECR{},
+		available: map[string]bool{digest.FromBytes(config).String(): true},
+	}
+
+	_, err := upload.Upload(context.Background(), newPartUpload(&shortSource{testsource.NewImage(config, layer)}, client, 4))
+	assert.NotNil(t, err)
+	assert.Empty(t, client.parts, "no part goes out padded")
+}
+
+// initFailECR fails every InitiateLayerUpload with err.
+type initFailECR struct {
+	*partECR
+	err error
+}
+
+func (m *initFailECR) InitiateLayerUpload(ctx context.Context, params *ecr.InitiateLayerUploadInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.InitiateLayerUploadOutput, error) {
+	return nil, m.err
+}
+
+func TestUploadCountsEachFailedAttemptOnce(t *testing.T) {
+	config, layer := []byte(`{"architecture":"amd64"}`), []byte("0123456789")
+	client := &initFailECR{
+		partECR: &partECR{mockECR: &mockECR{}, available: map[string]bool{digest.FromBytes(config).String(): true}},
+		err:     &smithy.GenericAPIError{Code: "ThrottlingException"},
+	}
+	counter := metrics.APIErrors.WithLabelValues("InitiateLayerUpload", "ThrottlingException")
+	before := testutil.ToFloat64(counter)
+
+	_, err := upload.Upload(context.Background(), newPartUpload(testsource.NewImage(config, layer), client, 4))
+
+	assert.NotNil(t, err)
+	assert.Equal(t, before+3, testutil.ToFloat64(counter), "one count per attempt")
+}
+
+func TestSingleAttempt(t *testing.T) {
+	options := ecr.Options{}
+	upload.SingleAttempt(&options)
+	assert.Equal(t, 1, options.Retryer.MaxAttempts(), "retries are left to the retry policy")
+}
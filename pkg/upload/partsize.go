@@ -0,0 +1,138 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package upload
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package upload
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	dkr "docker-reassembler/pkg/docker"
+
+	ecrTypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/smithy-go"
+)
+
+// Number of consecutive successful parts before the part size is grown again
+const PART_SIZE_GROW_AFTER = 4
+
+type PartSizePolicy struct {
+	Initial int64
+	Min     int64
+	Max     int64
+}
+
+// DefaultPartSizePolicy starts as large as ECR takes a part, parts cannot
+// grow past that so the largest layers still take one call per 20Mb.
+func DefaultPartSizePolicy() PartSizePolicy {
+	return PartSizePolicy{
+		Initial: dkr.LAYER_PART_CEILING_SIZE,
+		Min:     dkr.LAYER_PART_MIN_SIZE,
+		Max:     dkr.LAYER_PART_CEILING_SIZE,
+	}
+}
+
+// PartSizer picks the size of the next layer part. It halves the size when
+// the registry rejects a part or times out and doubles it again after a run
+// of successful parts, staying within the policy bounds.
+type PartSizer struct {
+	mu        sync.Mutex
+	policy    PartSizePolicy
+	size      int64
+	successes int
+}
+
+func NewPartSizer(policy PartSizePolicy) *PartSizer {
+	def := DefaultPartSizePolicy()
+	if policy.Min <= 0 {
+		policy.Min = def.Min
+	}
+	if policy.Max <= 0 {
+		policy.Max = def.Max
+	}
+	if policy.Max < policy.Min {
+		policy.Max = policy.Min
+	}
+	if policy.Initial <= 0 {
+		policy.Initial = def.Initial
+	}
+	if policy.Initial > policy.Max {
+		policy.Initial = policy.Max
+	}
+	if policy.Initial < policy.Min {
+		policy.Initial = policy.Min
+	}
+
+	return &PartSizer{policy: policy, size: policy.Initial}
+}
+
+func (p *PartSizer) Size() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
+
+// Success records an accepted part and grows the size after enough of them.
+func (p *PartSizer) Success() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.successes++
+	if p.successes < PART_SIZE_GROW_AFTER || p.size >= p.policy.Max {
+		return
+	}
+
+	p.successes = 0
+	p.size *= 2
+	if p.size > p.policy.Max {
+		p.size = p.policy.Max
+	}
+}
+
+// Shrink halves the part size and reports false if it is already at the
+// minimum, in which case the failure cannot be blamed on the part size.
+func (p *PartSizer) Shrink() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.successes = 0
+	if p.size <= p.policy.Min {
+		return false
+	}
+
+	p.size /= 2
+	if p.size < p.policy.Min {
+		p.size = p.policy.Min
+	}
+	return true
+}
+
+// isPartSizeError reports whether a failed part is likely to succeed if it
+// is resent in smaller pieces.
+func isPartSizeError(err error) bool {
+	var partEx *ecrTypes.InvalidLayerPartException
+	if errors.As(err, &partEx) {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "RequestTimeout", "RequestTimeoutException", "RequestEntityTooLarge":
+			return true
+		}
+	}
+
+	var statusErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &statusErr) {
+		switch statusErr.HTTPStatusCode() {
+		case 408, 413, 504:
+			return true
+		}
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
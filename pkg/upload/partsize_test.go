@@ -0,0 +1,51 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package upload_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package upload_test
+
+import (
+	"testing"
+
+	dkr "docker-reassembler/pkg/docker"
+	"docker-reassembler/pkg/upload"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartSizerShrinksAndGrows(t *testing.T) {
+	sizer := upload.NewPartSizer(upload.PartSizePolicy{Initial: 64, Min: 16, Max: 64})
+	assert.Equal(t, int64(64), sizer.Size())
+
+	assert.True(t, sizer.Shrink())
+	assert.Equal(t, int64(32), sizer.Size())
+	assert.True(t, sizer.Shrink())
+	assert.Equal(t, int64(16), sizer.Size())
+	assert.False(t, sizer.Shrink(), "cannot shrink below the minimum")
+	assert.Equal(t, int64(16), sizer.Size())
+
+	for i := 0; i < upload.PART_SIZE_GROW_AFTER; i++ {
+		sizer.Success()
+	}
+	assert.Equal(t, int64(32), sizer.Size())
+
+	for i := 0; i < upload.PART_SIZE_GROW_AFTER*4; i++ {
+		sizer.Success()
+	}
+	assert.Equal(t, int64(64), sizer.Size(), "cannot grow beyond the maximum")
+}
+
+func TestPartSizerDefaults(t *testing.T) {
+	def := upload.DefaultPartSizePolicy()
+	assert.Equal(t, dkr.LAYER_PART_CEILING_SIZE, def.Initial, "parts start as large as ECR takes them")
+	assert.Equal(t, dkr.LAYER_PART_CEILING_SIZE, def.Max)
+
+	sizer := upload.NewPartSizer(upload.PartSizePolicy{})
+	assert.Equal(t, def.Initial, sizer.Size())
+
+	sizer = upload.NewPartSizer(upload.PartSizePolicy{Initial: 1, Min: 8, Max: 4})
+	assert.Equal(t, int64(8), sizer.Size())
+
+	sizer = upload.NewPartSizer(upload.PartSizePolicy{Min: 8, Max: def.Max})
+	assert.Equal(t, def.Initial, sizer.Size(), "an unset initial size is the default, not the maximum")
+}
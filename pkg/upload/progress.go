@@ -0,0 +1,57 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package upload
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package upload
+
+import (
+	"fmt"
+
+	lgr "docker-reassembler/pkg/logger"
+
+	"github.com/pterm/pterm"
+)
+
+// partProgress shows a layer part being sent, *pterm.SpinnerPrinter is one.
+type partProgress interface {
+	Success(message ...interface{})
+	Fail(message ...interface{})
+	Warning(message ...interface{})
+}
+
+// logProgress reports a part as log lines naming the destination, for
+// uploads running side by side where a spinner each would garble the
+// terminal.
+type logProgress struct {
+	logger lgr.ILogger
+	prefix string
+	text   string
+}
+
+func (p *logProgress) Success(message ...interface{}) {
+	p.logger.Printfln(pterm.Success, "%s: %s", p.prefix, p.text)
+}
+
+func (p *logProgress) Fail(message ...interface{}) {
+	p.logger.Printfln(pterm.Error, "%s: %s failed", p.prefix, p.text)
+}
+
+func (p *logProgress) Warning(message ...interface{}) {
+	p.logger.Printfln(pterm.Warning, "%s: %s", p.prefix, fmt.Sprint(message...))
+}
+
+// startPartProgress starts a spinner for the part, or log lines when the
+// upload runs alongside others.
+func startPartProgress(input *UploadInput, text string) (partProgress, error) {
+	if !input.concurrent {
+		spinner, err := pterm.DefaultSpinner.Start(text)
+		if err != nil {
+			return nil, err
+		}
+		return spinner, nil
+	}
+
+	prefix := fmt.Sprintf("%s/%s", input.RegistryId, input.RepositoryName)
+	input.Logger.Printfln(pterm.Info, "%s: %s", prefix, text)
+	return &logProgress{logger: input.Logger, prefix: prefix, text: text}, nil
+}
@@ -0,0 +1,37 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package upload
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package upload
+
+import (
+	"sync"
+	"time"
+)
+
+// LayerStats records how a single blob made it to the registry.
+type LayerStats struct {
+	Digest    string
+	Bytes     int64
+	PartSizes []int64
+	Retries   int
+	Duration  time.Duration
+	// Skipped is set when the registry already held the blob
+	Skipped bool
+}
+
+// Stats is filled in by Upload when set on the UploadInput.
+type Stats struct {
+	mu     sync.Mutex
+	Layers []LayerStats
+}
+
+func (s *Stats) add(layer LayerStats) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Layers = append(s.Layers, layer)
+}
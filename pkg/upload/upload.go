@@ -8,14 +8,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"math"
-	"os"
-	"path/filepath"
-	"strings"
+	"time"
 
+	"docker-reassembler/pkg/auth"
 	dkr "docker-reassembler/pkg/docker"
 	lgr "docker-reassembler/pkg/logger"
+	"docker-reassembler/pkg/metrics"
+	"docker-reassembler/pkg/retry"
+	"docker-reassembler/pkg/source"
+	"docker-reassembler/pkg/throttle"
+	"docker-reassembler/pkg/tracing"
 
 	man "github.com/containers/image/v5/manifest"
 	"github.com/dustin/go-humanize"
@@ -23,8 +27,8 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ecr"
 	ecrTypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
-	orderedmap "github.com/elliotchance/orderedmap/v2"
 	"github.com/pterm/pterm"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type IClient interface {
@@ -45,6 +49,21 @@ type IClient interface {
 
 	CreateRepository(ctx context.Context, params *ecr.CreateRepositoryInput,
 		optFns ...func(*ecr.Options)) (*ecr.CreateRepositoryOutput, error)
+
+	BatchCheckLayerAvailability(ctx context.Context, params *ecr.BatchCheckLayerAvailabilityInput,
+		optFns ...func(*ecr.Options)) (*ecr.BatchCheckLayerAvailabilityOutput, error)
+
+	BatchGetImage(ctx context.Context, params *ecr.BatchGetImageInput,
+		optFns ...func(*ecr.Options)) (*ecr.BatchGetImageOutput, error)
+
+	DescribeImages(ctx context.Context, params *ecr.DescribeImagesInput,
+		optFns ...func(*ecr.Options)) (*ecr.DescribeImagesOutput, error)
+}
+
+// ICredentialsCache is satisfied by *aws.CredentialsCache and lets an upload
+// force a refresh when a request is rejected with an expired token.
+type ICredentialsCache interface {
+	Invalidate()
 }
 
 type IUploadInput interface {
@@ -59,10 +78,58 @@ type UploadInput struct {
 	Tag             string
 	RoleToAssume    string
 	Logger          lgr.ILogger
+	Credentials     ICredentialsCache
+	Retry           retry.Policy
+	PartSize        PartSizePolicy
+	Stats           *Stats
+	// Limiter is shared by every upload of the run, nil for no limit
+	Limiter *throttle.Limiter
+	// Verify reads the image back after the put and fails the upload when
+	// ECR stored something other than the local manifest
+	Verify bool
+	// Source to read the manifest and blobs from, ImageLayersPath is
+	// read as a local directory when it is not set
+	Source source.ISource
+	// concurrent is set by UploadAll when uploads run side by side
+	concurrent bool
+}
+
+func (input *UploadInput) source() source.ISource {
+	if input.Source == nil {
+		return source.NewDir(input.ImageLayersPath)
+	}
+	return input.Source
+}
+
+func (input *UploadInput) retryPolicy() retry.Policy {
+	if input.Retry.MaxAttempts == 0 {
+		return retry.DefaultPolicy()
+	}
+	return input.Retry
 }
 
 func Upload(ctx context.Context, input *UploadInput) (*ecrTypes.Image, error) {
-	manBuffer, err := ioutil.ReadFile(filepath.Join(input.ImageLayersPath, "manifest.json"))
+	if input.Source == nil {
+		// One source for the whole upload, so each blob file is opened once
+		dir := source.NewDir(input.ImageLayersPath)
+		defer dir.Close()
+		withSource := *input
+		withSource.Source = dir
+		input = &withSource
+	}
+
+	ctx, span := tracing.Start(ctx, "ecr.upload",
+		attribute.String("ecr.registry_id", input.RegistryId),
+		attribute.String("ecr.repository", input.RepositoryName),
+		attribute.String("ecr.tag", input.Tag))
+	image, err := doUpload(ctx, input)
+	metrics.ImageCompleted(err)
+	tracing.End(span, err)
+	return image, err
+}
+
+func doUpload(ctx context.Context, input *UploadInput) (*ecrTypes.Image, error) {
+	manBuffer, err := input.source().Manifest(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("error reading manifest file: %w", err)
 	}
@@ -95,32 +162,62 @@ func Upload(ctx context.Context, input *UploadInput) (*ecrTypes.Image, error) {
 	}
 
 	// Upload layer parts after reading manifest
-	err = uploadLayerParts(ctx, input, manifest)
+	err = uploadLayerParts(ctx, input, NewPartSizer(input.PartSize), manifest)
 	if err != nil {
 		return nil, fmt.Errorf("error uploading layer parts: %w", err)
 	}
 
 	// Put image (manifest)
-	image, err := putEcrImage(ctx, input, manifest)
+	putCtx, span := tracing.Start(ctx, "ecr.PutImage")
+	image, err := putEcrImage(putCtx, input, manifest)
+	tracing.End(span, err)
 	if err != nil {
 		return nil, fmt.Errorf("error putting image: %w", err)
 	}
 
+	if input.Verify {
+		verifyCtx, span := tracing.Start(ctx, "ecr.verify")
+		err := verifyImage(verifyCtx, input, manBuffer, manifest)
+		tracing.End(span, err)
+		if err != nil {
+			return nil, fmt.Errorf("error verifying image: %w", err)
+		}
+	}
+
 	return image, nil
 }
 
+// SingleAttempt turns off the retries of the SDK for an ECR client whose
+// calls are retried by the retry policy, which would otherwise multiply the
+// attempts made.
+func SingleAttempt(o *ecr.Options) {
+	o.Retryer = aws.NopRetryer{}
+}
+
 func checkRepo(ctx context.Context, input *UploadInput) (
 	*ecr.DescribeRepositoriesOutput, *ecr.CreateRepositoryOutput, error,
 ) {
-	descOut, err := input.Client.DescribeRepositories(context.TODO(), &ecr.DescribeRepositoriesInput{
-		RegistryId:      aws.String(input.RegistryId),
-		RepositoryNames: []string{input.RepositoryName},
-	})
-	if err != nil {
+	var descOut *ecr.DescribeRepositoriesOutput
+	notFound := false
+	_, err := retry.Do(ctx, input.retryPolicy(), input.Logger, "DescribeRepositories", func() (err error) {
+		descOut, err = input.Client.DescribeRepositories(ctx, &ecr.DescribeRepositoriesInput{
+			RegistryId:      aws.String(input.RegistryId),
+			RepositoryNames: []string{input.RepositoryName},
+		})
 		var notFoundEx *ecrTypes.RepositoryNotFoundException
 		if errors.As(err, &notFoundEx) {
-			// Create new repository
-			createOut, cErr := input.Client.CreateRepository(ctx, &ecr.CreateRepositoryInput{
+			notFound = true
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error describing repositories: %w", err)
+	}
+	if notFound {
+		var createOut *ecr.CreateRepositoryOutput
+		_, cErr := retry.Do(ctx, input.retryPolicy(), input.Logger, "CreateRepository", func() (err error) {
+			createOut, err = input.Client.CreateRepository(ctx, &ecr.CreateRepositoryInput{
 				RepositoryName: aws.String(input.RepositoryName),
 				EncryptionConfiguration: &ecrTypes.EncryptionConfiguration{
 					EncryptionType: ecrTypes.EncryptionTypeKms,
@@ -147,15 +244,14 @@ func checkRepo(ctx context.Context, input *UploadInput) (
 					},
 				},
 			})
+			return err
+		})
 
-			if cErr != nil {
-				return nil, nil, fmt.Errorf("error creating repository: %w", err)
-			}
-
-			return nil, createOut, nil
-		} else {
-			return nil, nil, fmt.Errorf("error describing repositories: %w", err)
+		if cErr != nil {
+			return nil, nil, fmt.Errorf("error creating repository: %w", cErr)
 		}
+
+		return nil, createOut, nil
 	}
 
 	if len(descOut.Repositories) != 1 {
@@ -167,94 +263,197 @@ func checkRepo(ctx context.Context, input *UploadInput) (
 }
 
 func initLayerUpload(ctx context.Context, input *UploadInput) (*ecr.InitiateLayerUploadOutput, error) {
-	return input.Client.InitiateLayerUpload(ctx, &ecr.InitiateLayerUploadInput{
-		RepositoryName: aws.String(input.RepositoryName),
-		RegistryId:     aws.String(input.RegistryId),
-	}, func(ops *ecr.Options) {
-		ops.Logger = input.Logger
+	var output *ecr.InitiateLayerUploadOutput
+	_, err := retry.Do(ctx, input.retryPolicy(), input.Logger, "InitiateLayerUpload", func() (err error) {
+		output, err = input.Client.InitiateLayerUpload(ctx, &ecr.InitiateLayerUploadInput{
+			RepositoryName: aws.String(input.RepositoryName),
+			RegistryId:     aws.String(input.RegistryId),
+		}, func(ops *ecr.Options) {
+			ops.Logger = input.Logger
+		})
+		return err
 	})
+	return output, err
 }
 
-func uploadLayerParts(ctx context.Context, input *UploadInput, manifest man.Manifest) error {
+func uploadLayerParts(ctx context.Context, input *UploadInput, sizer *PartSizer, manifest man.Manifest) error {
 	input.Logger.Printfln(pterm.Info, "uploading layer parts, depending on your connect, this might take some time")
-	input.Logger.Printfln(pterm.Info, "uploading config layer with digest: %s", manifest.ConfigInfo().Digest.String())
-	err := doUploadLayerParts(ctx, input.Client, input, manifest.ConfigInfo().Digest.String())
+
+	digests := []string{manifest.ConfigInfo().Digest.String()}
+	for _, layer := range manifest.LayerInfos() {
+		digests = append(digests, layer.Digest.String())
+	}
+
+	unique := []string{}
+	seen := map[string]bool{}
+	for _, digest := range digests {
+		if !seen[digest] {
+			seen[digest] = true
+			unique = append(unique, digest)
+		}
+	}
+
+	// Blobs the repository already holds, from an earlier run or another
+	// image, do not need to be sent again
+	available, err := availableLayers(ctx, input, unique)
 	if err != nil {
-		return fmt.Errorf("error uploading config layer: %w", err)
+		input.Logger.Printfln(pterm.Warning, "unable to check layer availability, uploading all layers: %v", err)
+		available = map[string]bool{}
 	}
-	for _, layer := range manifest.LayerInfos() {
-		input.Logger.Printfln(pterm.Info, "uploading layer with digest: %s", layer.Digest.String())
-		err = doUploadLayerParts(ctx, input.Client, input, layer.Digest.String())
+
+	for i, digest := range digests {
+		kind := "layer"
+		if i == 0 {
+			kind = "config layer"
+		}
+
+		if available[digest] {
+			input.Logger.Printfln(pterm.Info, "%s with digest %s already exists, skipping", kind, digest)
+			input.Stats.add(LayerStats{Digest: digest, Skipped: true})
+			metrics.LayersSkipped.Inc()
+			continue
+		}
+
+		input.Logger.Printfln(pterm.Info, "uploading %s with digest: %s", kind, digest)
+		err = doUploadLayerParts(ctx, input.Client, input, sizer, digest)
 		if err != nil {
-			return fmt.Errorf("error uploading layer: %w", err)
+			return fmt.Errorf("error uploading %s: %w", kind, err)
 		}
+		available[digest] = true
 	}
 
 	return nil
 }
 
-func doUploadLayerParts(ctx context.Context, client IClient, input *UploadInput, digest string) error {
+func availableLayers(ctx context.Context, input *UploadInput, digests []string) (map[string]bool, error) {
+	var output *ecr.BatchCheckLayerAvailabilityOutput
+	_, err := retry.Do(ctx, input.retryPolicy(), input.Logger, "BatchCheckLayerAvailability", func() (err error) {
+		output, err = input.Client.BatchCheckLayerAvailability(ctx, &ecr.BatchCheckLayerAvailabilityInput{
+			LayerDigests:   digests,
+			RepositoryName: aws.String(input.RepositoryName),
+			RegistryId:     aws.String(input.RegistryId),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	available := map[string]bool{}
+	for _, layer := range output.Layers {
+		if layer.LayerAvailability == ecrTypes.LayerAvailabilityAvailable && layer.LayerDigest != nil {
+			available[*layer.LayerDigest] = true
+		}
+	}
+
+	return available, nil
+}
+
+func doUploadLayerParts(ctx context.Context, client IClient, input *UploadInput, sizer *PartSizer, digest string) (err error) {
+	ctx, span := tracing.Start(ctx, "ecr.layer", attribute.String("layer.digest", digest))
+	defer func() { tracing.End(span, err) }()
+
+	started := time.Now()
 	initOut, err := initLayerUpload(ctx, input)
 	if err != nil {
 		return fmt.Errorf("error initiating layer upload: %w", err)
 	}
 
-	layerName := strings.Replace(digest, ":", "__", 1)
-	blobPath := filepath.Join(input.ImageLayersPath, strings.Replace(digest, ":", "__", 1))
-	fi, err := os.Stat(blobPath)
+	src := input.source()
+	layerName := source.BlobFileName(digest)
+	fileSize, err := src.BlobSize(ctx, digest)
 	if err != nil {
-		return fmt.Errorf("error reading file info for %s", blobPath)
+		return fmt.Errorf("error reading blob size for %s: %w", digest, err)
 	}
 
 	input.Logger.Printfln(pterm.Debug, "*********************************************")
 	input.Logger.Printfln(pterm.Debug, "uploadId: %q", *initOut.UploadId)
 	input.Logger.Printfln(pterm.Debug, "layerName: %q", layerName)
 	input.Logger.Printfln(pterm.Debug, "layer digest: %s", digest)
-	input.Logger.Printfln(pterm.Debug, "blobPath: %s", blobPath)
-	input.Logger.Printfln(pterm.Debug, "layer size: %d bytes", fi.Size())
+	input.Logger.Printfln(pterm.Debug, "layer size: %d bytes", fileSize)
 
-	blobs, err := layerBlobParts(
-		ctx, digest, blobPath, input.Logger)
-	if err != nil {
-		return fmt.Errorf("error getting layer parts: %w", err)
-	}
+	stats := LayerStats{Digest: digest, Bytes: fileSize}
+	span.SetAttributes(attribute.Int64("layer.size", fileSize))
 
-	firstPart := 0
+	// Part sizes adapt as we go, so this is only an estimate
+	totalPartsNum := uint64(math.Ceil(float64(fileSize) / float64(sizer.Size())))
 
-	input.Logger.Printfln(pterm.Info, "Uploading %d layer parts", len(blobs.Keys()))
-	for _, key := range blobs.Keys() {
-		v, ok := blobs.Get(key)
-		if !ok {
-			return fmt.Errorf("error getting blob")
+	input.Logger.Printfln(pterm.Info, "Uploading about %d layer parts", totalPartsNum)
+
+	// The next part always starts after the last byte the registry reports
+	// having received, which may differ from the local offset after a retry
+	var firstByte int64
+	for part := 0; firstByte < fileSize; part++ {
+		// ECR has no way to abort a layer upload, an unfinished one expires
+		// on its own, so stop cleanly between parts
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("upload of %s interrupted after %d of %d bytes: %w", digest, firstByte, fileSize, err)
+		}
+
+		partSize := sizer.Size()
+		partBuffer := make([]byte, int64(math.Min(float64(partSize), float64(fileSize-firstByte))))
+		// A short read would otherwise go out as a zero padded part
+		n, err := src.ReadBlobAt(ctx, digest, partBuffer, firstByte)
+		if err != nil && !(errors.Is(err, io.EOF) && n == len(partBuffer)) {
+			return fmt.Errorf("error reading partBuffer: %w", err)
 		}
-		spinnerInfo, err := pterm.DefaultSpinner.Start(fmt.Sprintf("uploading blob %s (%s)", key, humanize.Bytes(uint64(len(v)))))
+		if n != len(partBuffer) {
+			return fmt.Errorf("error reading partBuffer: got %d of %d bytes of %s at offset %d",
+				n, len(partBuffer), digest, firstByte)
+		}
+
+		spinnerInfo, err := startPartProgress(input, fmt.Sprintf("uploading blob part_%d (%s)",
+			part, humanize.Bytes(uint64(len(partBuffer)))))
 		if err != nil {
 			return fmt.Errorf("error starting spinner: %w", err)
 		}
 
 		input.Logger.Printfln(pterm.Debug, "blobPart size: %s (%d bytes)",
-			humanize.IBytes(uint64(len(v))), len(v))
-		input.Logger.Printfln(pterm.Debug, "blobPart firstPart: %d", firstPart)
-		input.Logger.Printfln(pterm.Debug, "blobPart lastPart: %d", (firstPart + (len(v) - 1)))
+			humanize.IBytes(uint64(len(partBuffer))), len(partBuffer))
+		input.Logger.Printfln(pterm.Debug, "blobPart firstPart: %d", firstByte)
+		input.Logger.Printfln(pterm.Debug, "blobPart lastPart: %d", firstByte+int64(len(partBuffer))-1)
 		input.Logger.Printfln(pterm.Debug, "uploadId: %s", *initOut.UploadId)
 
-		output, err := client.UploadLayerPart(ctx, &ecr.UploadLayerPartInput{
-			LayerPartBlob:  v,
-			PartFirstByte:  aws.Int64(int64(firstPart)),
-			PartLastByte:   aws.Int64(int64(firstPart + (len(v) - 1))),
-			RepositoryName: aws.String(input.RepositoryName),
-			UploadId:       initOut.UploadId,
-			RegistryId:     aws.String(input.RegistryId),
-		})
+		partCtx, partSpan := tracing.Start(ctx, "ecr.UploadLayerPart",
+			attribute.String("layer.digest", digest),
+			attribute.Int("part.index", part),
+			attribute.Int64("part.first_byte", firstByte),
+			attribute.Int("part.size", len(partBuffer)))
+		lastByteReceived, attempts, err := uploadLayerPart(partCtx, client, input, sizer, initOut.UploadId, partBuffer, firstByte)
+		partSpan.SetAttributes(attribute.Int("part.attempts", attempts))
+		tracing.End(partSpan, err)
+		stats.Retries += attempts - 1
+		metrics.PartsRetried.Add(float64(attempts - 1))
 		if err != nil {
+			var sizeErr *partSizeError
+			if errors.As(err, &sizeErr) {
+				spinnerInfo.Warning(fmt.Sprintf("part of %s rejected, retrying with %s parts: %v",
+					humanize.IBytes(uint64(len(partBuffer))), humanize.IBytes(uint64(sizer.Size())), sizeErr.err))
+				stats.Retries++
+				metrics.PartsRetried.Inc()
+				part--
+				continue
+			}
 			spinnerInfo.Fail()
 			return fmt.Errorf("upload layer part error: %w", err)
 		}
+		// After a resume the registry may hold only some of the part
+		accepted := lastByteReceived - firstByte + 1
+		if accepted <= 0 {
+			spinnerInfo.Fail()
+			return fmt.Errorf("upload layer part error: registry reports last byte %d for the part starting at %d",
+				lastByteReceived, firstByte)
+		}
+		if accepted == int64(len(partBuffer)) {
+			sizer.Success()
+		}
+		stats.PartSizes = append(stats.PartSizes, accepted)
+		metrics.BytesUploaded.Add(float64(accepted))
 
-		// Update firstpart for next iteration
-		firstPart += len(v)
+		// Update firstByte for next iteration
+		firstByte = lastByteReceived + 1
 
-		input.Logger.Printfln(pterm.Debug, "last layer part byte received %d", output.LastByteReceived)
+		input.Logger.Printfln(pterm.Debug, "last layer part byte received %d", lastByteReceived)
 		input.Logger.Printfln(pterm.Debug, "*********************************************")
 		spinnerInfo.Success()
 	}
@@ -265,21 +464,106 @@ func doUploadLayerParts(ctx context.Context, client IClient, input *UploadInput,
 	var existsEx *ecrTypes.LayerAlreadyExistsException
 	if errors.As(err, &existsEx) {
 		input.Logger.Printfln(pterm.Warning, "complete layer part upload: %s", existsEx)
-	} else {
+	} else if err != nil {
 		return err
 	}
 
+	stats.Duration = time.Since(started)
+	input.Stats.add(stats)
+	metrics.LayerUploadDuration.Observe(stats.Duration.Seconds())
+
 	return nil
 }
 
+// partSizeError marks a part failure that is resent in smaller parts, the
+// sizer has already been shrunk, rather than retried as is.
+type partSizeError struct {
+	err error
+}
+
+func (e *partSizeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *partSizeError) Unwrap() error {
+	return e.err
+}
+
+// uploadLayerPart sends a single part under the retry policy and returns the
+// last byte the registry has received for the upload and the number of
+// attempts made. Expired credentials are refreshed before the part is
+// resent under the same upload id. A part rejected for its size is handed
+// back to be resent smaller while the sizer can still shrink, after that
+// it is retried as is like any other failure.
+func uploadLayerPart(ctx context.Context, client IClient, input *UploadInput, sizer *PartSizer,
+	uploadId *string, partBuffer []byte, firstByte int64,
+) (int64, int, error) {
+	lastByte := firstByte + int64(len(partBuffer)) - 1
+
+	attempts, err := retry.Do(ctx, input.retryPolicy(), input.Logger, "UploadLayerPart", func() error {
+		output, err := client.UploadLayerPart(ctx, &ecr.UploadLayerPartInput{
+			LayerPartBlob:  partBuffer,
+			PartFirstByte:  aws.Int64(firstByte),
+			PartLastByte:   aws.Int64(lastByte),
+			RepositoryName: aws.String(input.RepositoryName),
+			UploadId:       uploadId,
+			RegistryId:     aws.String(input.RegistryId),
+		}, func(ops *ecr.Options) {
+			// The part is rate limited as it is sent, every attempt resends all of it
+			ops.APIOptions = append(ops.APIOptions, input.Limiter.APIOption())
+		})
+		if err != nil {
+			// A previous attempt may have landed even though we saw an error,
+			// the registry then tells us where it wants the next part to start
+			var partEx *ecrTypes.InvalidLayerPartException
+			if errors.As(err, &partEx) && partEx.LastValidByteReceived != nil &&
+				*partEx.LastValidByteReceived != firstByte-1 {
+				// Going back before the part would resend what was already
+				// taken, with no end to it
+				if *partEx.LastValidByteReceived < firstByte-1 {
+					return retry.Permanent(fmt.Errorf("registry reports last valid byte %d before the part starting at %d for upload %s: %w",
+						*partEx.LastValidByteReceived, firstByte, *uploadId, err))
+				}
+				input.Logger.Printfln(pterm.Warning, "registry reports last valid byte %d for upload %s, resuming from there",
+					*partEx.LastValidByteReceived, *uploadId)
+				lastByte = *partEx.LastValidByteReceived
+				return nil
+			}
+
+			if input.Credentials != nil && auth.IsExpiredTokenError(err) {
+				input.Logger.Printfln(pterm.Warning, "credentials expired during upload %s, refreshing", *uploadId)
+				input.Credentials.Invalidate()
+			}
+			if isPartSizeError(err) && sizer.Shrink() {
+				return retry.Permanent(&partSizeError{err: err})
+			}
+			return err
+		}
+
+		if output.LastByteReceived != nil {
+			lastByte = *output.LastByteReceived
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, attempts, err
+	}
+
+	return lastByte, attempts, nil
+}
+
 func completeLayerUpload(ctx context.Context, input *UploadInput,
 	uploadId *string, layerDigest []string,
 ) (string, error) {
-	output, err := input.Client.CompleteLayerUpload(ctx, &ecr.CompleteLayerUploadInput{
-		LayerDigests:   layerDigest,
-		RepositoryName: aws.String(input.RepositoryName),
-		UploadId:       uploadId,
-		RegistryId:     aws.String(input.RegistryId),
+	var output *ecr.CompleteLayerUploadOutput
+	_, err := retry.Do(ctx, input.retryPolicy(), input.Logger, "CompleteLayerUpload", func() (err error) {
+		output, err = input.Client.CompleteLayerUpload(ctx, &ecr.CompleteLayerUploadInput{
+			LayerDigests:   layerDigest,
+			RepositoryName: aws.String(input.RepositoryName),
+			UploadId:       uploadId,
+			RegistryId:     aws.String(input.RegistryId),
+		})
+		return err
 	})
 	if err != nil {
 		var digestEx *ecrTypes.InvalidLayerException
@@ -295,24 +579,27 @@ func completeLayerUpload(ctx context.Context, input *UploadInput,
 
 func putEcrImage(ctx context.Context, input *UploadInput, manifest man.Manifest,
 ) (*ecrTypes.Image, error) {
-	manifestPath := filepath.Join(input.ImageLayersPath, "manifest.json")
-	manBuffer, err := ioutil.ReadFile(manifestPath)
+	manBuffer, err := input.source().Manifest(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("error reading %q", manifestPath)
+		return nil, fmt.Errorf("error reading manifest: %w", err)
 	}
 
 	if int64(len(manBuffer)) > dkr.IMAGE_MANIFEST_MAX_SIZE {
 		return nil, fmt.Errorf("image manifest too large, %d is greated than %d", len(manBuffer), dkr.IMAGE_MANIFEST_MAX_SIZE)
 	}
 
-	output, err := input.Client.PutImage(ctx, &ecr.PutImageInput{
-		ImageManifest:  aws.String(string(manBuffer)),
-		RepositoryName: aws.String(input.RepositoryName),
-		// ImageDigest only for existing images (I think)
-		// ImageDigest:            aws.String(manifest.ConfigInfo().Digest.String()),
-		// ImageManifestMediaType: aws.String(manifest.ConfigInfo().MediaType),
-		ImageTag:   aws.String(input.Tag),
-		RegistryId: aws.String(input.RegistryId),
+	var output *ecr.PutImageOutput
+	_, err = retry.Do(ctx, input.retryPolicy(), input.Logger, "PutImage", func() (err error) {
+		output, err = input.Client.PutImage(ctx, &ecr.PutImageInput{
+			ImageManifest:  aws.String(string(manBuffer)),
+			RepositoryName: aws.String(input.RepositoryName),
+			// ImageDigest only for existing images (I think)
+			// ImageDigest:            aws.String(manifest.ConfigInfo().Digest.String()),
+			// ImageManifestMediaType: aws.String(manifest.ConfigInfo().MediaType),
+			ImageTag:   aws.String(input.Tag),
+			RegistryId: aws.String(input.RegistryId),
+		})
+		return err
 	})
 	if err != nil {
 		return nil, fmt.Errorf("put image error: %w", err)
@@ -320,45 +607,3 @@ func putEcrImage(ctx context.Context, input *UploadInput, manifest man.Manifest,
 
 	return output.Image, nil
 }
-
-func layerBlobParts(ctx context.Context, digest string, blobPath string,
-	logger lgr.ILogger,
-) (*orderedmap.OrderedMap[string, []byte], error) {
-	file, err := os.Open(blobPath)
-	if err != nil {
-		return nil, fmt.Errorf("error reading %q: %w", blobPath, err)
-	}
-
-	defer file.Close()
-
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return nil, fmt.Errorf("error with file.Stat(): %w", err)
-	}
-
-	var fileSize int64 = fileInfo.Size()
-
-	const fileChunk = dkr.LAYER_PART_MAX_SIZE
-
-	// Calculate total number of parts the file will be chunked into
-	totalPartsNum := uint64(math.Ceil(float64(fileSize) / float64(fileChunk)))
-
-	logger.Printfln(pterm.Debug, fmt.Sprintf("splitting %q into %d chunks.", blobPath, totalPartsNum))
-	blobsOrdered := orderedmap.NewOrderedMap[string, []byte]()
-
-	for i := uint64(0); i < totalPartsNum; i++ {
-
-		partSize := int(math.Min(float64(fileChunk), float64(fileSize-int64(int64(i)*fileChunk))))
-		partBuffer := make([]byte, partSize)
-
-		_, err := file.Read(partBuffer)
-		if err != nil {
-			return nil, fmt.Errorf("error reading partBuffer: %w", err)
-		}
-
-		blobsOrdered.Set(fmt.Sprintf("part_%d", i), partBuffer)
-
-	}
-
-	return blobsOrdered, nil
-}
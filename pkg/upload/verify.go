@@ -0,0 +1,138 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package upload
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package upload
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	dkr "docker-reassembler/pkg/docker"
+	"docker-reassembler/pkg/retry"
+
+	man "github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+	"github.com/pterm/pterm"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrTypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+)
+
+// VerificationError lists every way the image stored in ECR differs from the
+// local manifest.
+type VerificationError struct {
+	Discrepancies []string
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("stored image does not match the local manifest: %s", strings.Join(e.Discrepancies, "; "))
+}
+
+// verifyImage reads back the image put for input.Tag and compares the stored
+// manifest, its layers and the reported image size with the local manifest.
+func verifyImage(ctx context.Context, input *UploadInput, manBuffer []byte, manifest man.Manifest) error {
+	expected := digest.FromBytes(manBuffer)
+	problems := []string{}
+
+	var getOut *ecr.BatchGetImageOutput
+	_, err := retry.Do(ctx, input.retryPolicy(), input.Logger, "BatchGetImage", func() (err error) {
+		getOut, err = input.Client.BatchGetImage(ctx, &ecr.BatchGetImageInput{
+			RegistryId:         aws.String(input.RegistryId),
+			RepositoryName:     aws.String(input.RepositoryName),
+			ImageIds:           []ecrTypes.ImageIdentifier{{ImageTag: aws.String(input.Tag)}},
+			AcceptedMediaTypes: []string{man.GuessMIMEType(manBuffer)},
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error getting stored image: %w", err)
+	}
+	for _, failure := range getOut.Failures {
+		problems = append(problems, fmt.Sprintf("%s: %s", failure.FailureCode, aws.ToString(failure.FailureReason)))
+	}
+	if len(getOut.Images) != 1 {
+		problems = append(problems, fmt.Sprintf("expected 1 stored image for tag %q, found %d", input.Tag, len(getOut.Images)))
+		return &VerificationError{Discrepancies: problems}
+	}
+
+	stored := getOut.Images[0]
+	if got := aws.ToString(stored.ImageId.ImageDigest); got != expected.String() {
+		problems = append(problems, fmt.Sprintf("image digest is %s, expected %s", got, expected))
+	}
+	storedBuffer := []byte(aws.ToString(stored.ImageManifest))
+	if got := digest.FromBytes(storedBuffer); got != expected {
+		problems = append(problems, fmt.Sprintf("stored manifest digest is %s, expected %s", got, expected))
+	}
+
+	storedManifest, err := dkr.FromBlob(storedBuffer, input.Logger)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("stored manifest can not be parsed: %v", err))
+	} else {
+		problems = append(problems, compareLayers(manifest, storedManifest)...)
+	}
+
+	var descOut *ecr.DescribeImagesOutput
+	_, err = retry.Do(ctx, input.retryPolicy(), input.Logger, "DescribeImages", func() (err error) {
+		descOut, err = input.Client.DescribeImages(ctx, &ecr.DescribeImagesInput{
+			RegistryId:     aws.String(input.RegistryId),
+			RepositoryName: aws.String(input.RepositoryName),
+			ImageIds:       []ecrTypes.ImageIdentifier{{ImageDigest: aws.String(expected.String())}},
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error describing stored image: %w", err)
+	}
+	if len(descOut.ImageDetails) != 1 {
+		problems = append(problems, fmt.Sprintf("expected 1 image description for %s, found %d", expected, len(descOut.ImageDetails)))
+	} else {
+		detail := descOut.ImageDetails[0]
+
+		// ECR reports the compressed size of the layers, some registries
+		// count the config blob as well
+		var layersSize int64
+		for _, layer := range manifest.LayerInfos() {
+			layersSize += layer.Size
+		}
+		if size := aws.ToInt64(detail.ImageSizeInBytes); size != layersSize && size != layersSize+manifest.ConfigInfo().Size {
+			problems = append(problems, fmt.Sprintf("image size is %d, expected %d", size, layersSize))
+		}
+
+		tagged := false
+		for _, t := range detail.ImageTags {
+			tagged = tagged || t == input.Tag
+		}
+		if !tagged {
+			problems = append(problems, fmt.Sprintf("image is not tagged %q", input.Tag))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &VerificationError{Discrepancies: problems}
+	}
+
+	input.Logger.Printfln(pterm.Success, "verified stored image %s", expected)
+	return nil
+}
+
+func compareLayers(local, stored man.Manifest) []string {
+	problems := []string{}
+	if local.ConfigInfo().Digest != stored.ConfigInfo().Digest {
+		problems = append(problems, fmt.Sprintf("config digest is %s, expected %s", stored.ConfigInfo().Digest, local.ConfigInfo().Digest))
+	}
+
+	localLayers, storedLayers := local.LayerInfos(), stored.LayerInfos()
+	if len(localLayers) != len(storedLayers) {
+		return append(problems, fmt.Sprintf("stored image has %d layers, expected %d", len(storedLayers), len(localLayers)))
+	}
+	for i := range localLayers {
+		if localLayers[i].Digest != storedLayers[i].Digest {
+			problems = append(problems, fmt.Sprintf("layer %d digest is %s, expected %s", i, storedLayers[i].Digest, localLayers[i].Digest))
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,158 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package upload_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package upload_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"docker-reassembler/pkg/internal/testsource"
+	"docker-reassembler/pkg/upload"
+	"docker-reassembler/pkg/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrTypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockECR holds every blob as already available, so an upload goes straight
+// to the image put.
+type mockECR struct {
+	manifest string
+	tags     []string
+	size     int64
+	storeAs  func(manifest string) string
+}
+
+func (m *mockECR) InitiateLayerUpload(ctx context.Context, params *ecr.InitiateLayerUploadInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.InitiateLayerUploadOutput, error) {
+	return nil, errors.New("unexpected layer upload")
+}
+
+func (m *mockECR) UploadLayerPart(ctx context.Context, params *ecr.UploadLayerPartInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.UploadLayerPartOutput, error) {
+	return nil, errors.New("unexpected layer upload")
+}
+
+func (m *mockECR) CompleteLayerUpload(ctx context.Context, params *ecr.CompleteLayerUploadInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.CompleteLayerUploadOutput, error) {
+	return nil, errors.New("unexpected layer upload")
+}
+
+func (m *mockECR) PutImage(ctx context.Context, params *ecr.PutImageInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.PutImageOutput, error) {
+	m.manifest = *params.ImageManifest
+	if m.storeAs != nil {
+		m.manifest = m.storeAs(m.manifest)
+	}
+	m.tags = []string{*params.ImageTag}
+
+	return &ecr.PutImageOutput{Image: &ecrTypes.Image{
+		ImageId: &ecrTypes.ImageIdentifier{
+			ImageTag:    params.ImageTag,
+			ImageDigest: aws.String(digest.FromString(m.manifest).String()),
+		},
+		RepositoryName: params.RepositoryName,
+	}}, nil
+}
+
+func (m *mockECR) DescribeRepositories(ctx context.Context, params *ecr.DescribeRepositoriesInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.DescribeRepositoriesOutput, error) {
+	return &ecr.DescribeRepositoriesOutput{Repositories: []ecrTypes.Repository{{
+		RepositoryName: aws.String(params.RepositoryNames[0]),
+		RepositoryArn:  aws.String("arn"),
+		RepositoryUri:  aws.String("uri"),
+	}}}, nil
+}
+
+func (m *mockECR) CreateRepository(ctx context.Context, params *ecr.CreateRepositoryInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.CreateRepositoryOutput, error) {
+	return nil, errors.New("unexpected create repository")
+}
+
+func (m *mockECR) BatchCheckLayerAvailability(ctx context.Context, params *ecr.BatchCheckLayerAvailabilityInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+	out := &ecr.BatchCheckLayerAvailabilityOutput{}
+	for _, d := range params.LayerDigests {
+		out.Layers = append(out.Layers, ecrTypes.Layer{
+			LayerDigest:       aws.String(d),
+			LayerAvailability: ecrTypes.LayerAvailabilityAvailable,
+		})
+	}
+	return out, nil
+}
+
+func (m *mockECR) BatchGetImage(ctx context.Context, params *ecr.BatchGetImageInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.BatchGetImageOutput, error) {
+	return &ecr.BatchGetImageOutput{Images: []ecrTypes.Image{{
+		ImageId: &ecrTypes.ImageIdentifier{
+			ImageTag:    params.ImageIds[0].ImageTag,
+			ImageDigest: aws.String(digest.FromString(m.manifest).String()),
+		},
+		ImageManifest: aws.String(m.manifest),
+	}}}, nil
+}
+
+func (m *mockECR) DescribeImages(ctx context.Context, params *ecr.DescribeImagesInput,
+	optFns ...func(*ecr.Options),
+) (*ecr.DescribeImagesOutput, error) {
+	return &ecr.DescribeImagesOutput{ImageDetails: []ecrTypes.ImageDetail{{
+		ImageDigest:      params.ImageIds[0].ImageDigest,
+		ImageSizeInBytes: aws.Int64(m.size),
+		ImageTags:        m.tags,
+	}}}, nil
+}
+
+func TestUploadVerify(t *testing.T) {
+	src := testsource.NewImage([]byte(`{"architecture":"amd64"}`), []byte("layer-bytes"))
+	client := &mockECR{size: int64(len("layer-bytes"))}
+
+	img, err := upload.Upload(context.Background(), &upload.UploadInput{
+		Client:         client,
+		RepositoryName: "app",
+		RegistryId:     "123456789012",
+		Tag:            "1.0",
+		Source:         src,
+		Logger:         &utils.PtermLogger{},
+		Verify:         true,
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "1.0", *img.ImageId.ImageTag)
+}
+
+func TestUploadVerifyMismatch(t *testing.T) {
+	src := testsource.NewImage([]byte(`{"architecture":"amd64"}`), []byte("layer-bytes"))
+	other := testsource.NewImage([]byte(`{"architecture":"arm64"}`), []byte("other-bytes"))
+	client := &mockECR{
+		size:    int64(len("layer-bytes")),
+		storeAs: func(string) string { return string(other.Raw) },
+	}
+
+	_, err := upload.Upload(context.Background(), &upload.UploadInput{
+		Client:         client,
+		RepositoryName: "app",
+		RegistryId:     "123456789012",
+		Tag:            "1.0",
+		Source:         src,
+		Logger:         &utils.PtermLogger{},
+		Verify:         true,
+	})
+
+	var verifyErr *upload.VerificationError
+	assert.ErrorAs(t, err, &verifyErr)
+	assert.Len(t, verifyErr.Discrepancies, 4, "image digest, manifest digest, config and layer")
+}
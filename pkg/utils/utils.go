@@ -5,6 +5,7 @@ package utils
 
 import (
 	"fmt"
+	"regexp"
 
 	"github.com/aws/smithy-go/logging"
 	"github.com/pterm/pterm"
@@ -45,6 +46,64 @@ func MarkFlagsRequiredTogether(cmd *cobra.Command, flagNames ...string) {
 	cmd.MarkFlagsRequiredTogether(flagNames...)
 }
 
+// RequiredPersistentFlag returns the value of a persistent flag inherited
+// from the parent command, for flags only some subcommands need.
+func RequiredPersistentFlag(cmd *cobra.Command, flagName string) (string, error) {
+	flag := cmd.Parent().PersistentFlags().Lookup(flagName)
+	if flag == nil || flag.Value.String() == "" {
+		return "", fmt.Errorf("required flag(s) \"%s\" not set", flagName)
+	}
+
+	return flag.Value.String(), nil
+}
+
+// FilterTags keeps the tags that match any include pattern (all tags when
+// there are none) and no exclude pattern. Patterns are regular expressions
+// anchored at both ends.
+func FilterTags(tags, include, exclude []string) ([]string, error) {
+	compile := func(patterns []string) ([]*regexp.Regexp, error) {
+		res := []*regexp.Regexp{}
+		for _, p := range patterns {
+			re, err := regexp.Compile("^(?:" + p + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid tag filter %q: %w", p, err)
+			}
+			res = append(res, re)
+		}
+		return res, nil
+	}
+	matchAny := func(res []*regexp.Regexp, tag string) bool {
+		for _, re := range res {
+			if re.MatchString(tag) {
+				return true
+			}
+		}
+		return false
+	}
+
+	includes, err := compile(include)
+	if err != nil {
+		return nil, err
+	}
+	excludes, err := compile(exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := []string{}
+	for _, tag := range tags {
+		if len(includes) > 0 && !matchAny(includes, tag) {
+			continue
+		}
+		if matchAny(excludes, tag) {
+			continue
+		}
+		filtered = append(filtered, tag)
+	}
+
+	return filtered, nil
+}
+
 func Banner(version string) {
 	s, err := pterm.DefaultBigText.WithLetters(
 		putils.LettersFromStringWithStyle(
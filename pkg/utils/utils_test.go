@@ -0,0 +1,32 @@
+// Copyright 2022 Advanced. All rights reserved.
+// Package utils_test
+// Original author pennywisdom (pennywisdom@users.noreply.github.com).
+
+package utils_test
+
+import (
+	"testing"
+
+	"docker-reassembler/pkg/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterTags(t *testing.T) {
+	tags := []string{"1.0", "1.1", "1.1-rc1", "latest", "2.0"}
+
+	filtered, err := utils.FilterTags(tags, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, tags, filtered)
+
+	filtered, err = utils.FilterTags(tags, []string{`1\..*`}, []string{`.*-rc\d+`})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1.0", "1.1"}, filtered)
+
+	filtered, err = utils.FilterTags(tags, []string{"latest", `2\.0`}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"latest", "2.0"}, filtered)
+
+	_, err = utils.FilterTags(tags, []string{"("}, nil)
+	assert.NotNil(t, err)
+}